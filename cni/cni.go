@@ -0,0 +1,345 @@
+// Command cni is a CNI plugin that attaches the containers of a CNI runtime to
+// SocketPlane networks through the API of the daemon of the host. It is
+// installed in the CNI path as socketplane:
+//
+//	go build -o /opt/cni/bin/socketplane ./cni
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/socketplane/socketplane/daemon"
+)
+
+const cniVersion = "0.4.0"
+
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0"}
+
+const defaultDaemonURL = "http://localhost:6675"
+
+// Error codes of the CNI specification
+const (
+	errIncompatibleVersion = 1
+	errInvalidEnvironment  = 4
+	errIOFailure           = 5
+	errDecodingFailure     = 6
+	errInvalidConfig       = 7
+	errTryAgainLater       = 11
+)
+
+// netConf is the network configuration given on stdin. The SocketPlane
+// network defaults to the name of the configuration.
+type netConf struct {
+	CNIVersion string     `json:"cniVersion"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Network    string     `json:"network,omitempty"`
+	Daemon     string     `json:"daemon,omitempty"`
+	PrevResult *cniResult `json:"prevResult,omitempty"`
+}
+
+// cniArgs are the parameters given in the environment
+type cniArgs struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+	Args        map[string]string
+}
+
+type cniInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type cniIPConfig struct {
+	Version   string `json:"version"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
+type cniRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type cniResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	Interfaces []cniInterface `json:"interfaces,omitempty"`
+	IPs        []cniIPConfig  `json:"ips,omitempty"`
+	Routes     []cniRoute     `json:"routes,omitempty"`
+	DNS        struct{}       `json:"dns"`
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       uint   `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *cniError) Error() string {
+	if e.Details != "" {
+		return e.Msg + ": " + e.Details
+	}
+	return e.Msg
+}
+
+func newError(code uint, msg string, err error) *cniError {
+	e := &cniError{CNIVersion: cniVersion, Code: code, Msg: msg}
+	if err != nil {
+		e.Details = err.Error()
+	}
+	return e
+}
+
+func main() {
+	args := getArgs()
+	var result interface{}
+	var err *cniError
+	if args.Command == "VERSION" {
+		result = map[string]interface{}{"cniVersion": cniVersion, "supportedVersions": supportedVersions}
+	} else {
+		result, err = run(args, os.Stdin)
+	}
+	if err != nil {
+		json.NewEncoder(os.Stdout).Encode(err)
+		os.Exit(1)
+	}
+	if result != nil {
+		json.NewEncoder(os.Stdout).Encode(result)
+	}
+}
+
+func getArgs() *cniArgs {
+	args := &cniArgs{
+		Command:     os.Getenv("CNI_COMMAND"),
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        make(map[string]string),
+	}
+	for _, pair := range strings.Split(os.Getenv("CNI_ARGS"), ";") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			args.Args[kv[0]] = kv[1]
+		}
+	}
+	return args
+}
+
+// run decodes the network configuration and executes a command. Only ADD
+// has a result.
+func run(args *cniArgs, stdin io.Reader) (interface{}, *cniError) {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, newError(errIOFailure, "Unable to read the network configuration", err)
+	}
+	conf := &netConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, newError(errDecodingFailure, "Unable to decode the network configuration", err)
+	}
+	if !supportedVersion(conf.CNIVersion) {
+		return nil, newError(errIncompatibleVersion, "Unsupported CNI version "+conf.CNIVersion, nil)
+	}
+	if conf.Network == "" {
+		conf.Network = conf.Name
+	}
+	if conf.Network == "" {
+		return nil, newError(errInvalidConfig, "The network configuration has no name", nil)
+	}
+	if conf.Daemon == "" {
+		conf.Daemon = defaultDaemonURL
+	}
+	if args.ContainerID == "" {
+		return nil, newError(errInvalidEnvironment, "CNI_CONTAINERID is not set", nil)
+	}
+
+	switch args.Command {
+	case "ADD":
+		return cmdAdd(args, conf)
+	case "DEL":
+		return nil, cmdDel(args, conf)
+	case "CHECK":
+		return nil, cmdCheck(args, conf)
+	}
+	return nil, newError(errInvalidEnvironment, "Unknown CNI command "+args.Command, nil)
+}
+
+func supportedVersion(version string) bool {
+	for _, v := range supportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func connectionURL(conf *netConf, containerID string) string {
+	url := conf.Daemon + daemon.API_VERSION + "/connections"
+	if containerID != "" {
+		url += "/" + containerID
+	}
+	return url
+}
+
+// getConnection returns the connection of a container, nil if there is none
+func getConnection(conf *netConf, containerID string) (*daemon.Connection, error) {
+	resp, err := http.Get(connectionURL(conf, containerID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return decodeConnection(resp)
+}
+
+func decodeConnection(resp *http.Response) (*daemon.Connection, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	connection := &daemon.Connection{}
+	if err := json.Unmarshal(body, connection); err != nil {
+		return nil, err
+	}
+	return connection, nil
+}
+
+func deleteConnection(conf *netConf, containerID string) error {
+	req, err := http.NewRequest("DELETE", connectionURL(conf, containerID), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// cmdAdd connects the namespace of a container to the network. The port of
+// the connection is named CNI_IFNAME in the namespace.
+func cmdAdd(args *cniArgs, conf *netConf) (*cniResult, *cniError) {
+	if args.Netns == "" {
+		return nil, newError(errInvalidEnvironment, "CNI_NETNS is not set", nil)
+	}
+	request := &daemon.Connection{
+		ContainerID:     args.ContainerID,
+		ContainerName:   args.Args["K8S_POD_NAME"],
+		ContainerNetns:  args.Netns,
+		ContainerIfName: args.IfName,
+		Network:         conf.Network,
+		RequestedIP:     args.Args["IP"],
+	}
+	data, _ := json.Marshal(request)
+	resp, err := http.Post(connectionURL(conf, ""), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, newError(errTryAgainLater, "Unable to reach the socketplane daemon", err)
+	}
+	defer resp.Body.Close()
+	connection, err := decodeConnection(resp)
+	if err != nil {
+		return nil, newError(errTryAgainLater, "Unable to connect the container", err)
+	}
+	// The daemon records the connections it failed to wire
+	if connection.OvsPortID == "" {
+		deleteConnection(conf, args.ContainerID)
+		return nil, newError(errTryAgainLater, "Unable to connect the container to network "+conf.Network, nil)
+	}
+	if connection.ContainerNetns != args.Netns {
+		return nil, newError(errInvalidEnvironment, "Container "+args.ContainerID+" is connected in another namespace", nil)
+	}
+	if connection.ContainerIfName != args.IfName {
+		return nil, newError(errInvalidEnvironment, "Container "+args.ContainerID+" is connected with another interface", nil)
+	}
+	return connectionResult(conf.CNIVersion, connection), nil
+}
+
+func cmdDel(args *cniArgs, conf *netConf) *cniError {
+	if err := deleteConnection(conf, args.ContainerID); err != nil {
+		return newError(errTryAgainLater, "Unable to disconnect the container", err)
+	}
+	return nil
+}
+
+// cmdCheck checks that the container is still connected as ADD reported
+func cmdCheck(args *cniArgs, conf *netConf) *cniError {
+	connection, err := getConnection(conf, args.ContainerID)
+	if err != nil {
+		return newError(errTryAgainLater, "Unable to get the connection of the container", err)
+	}
+	if connection == nil || connection.OvsPortID == "" {
+		return newError(errInvalidEnvironment, "Container "+args.ContainerID+" is not connected", nil)
+	}
+	if connection.Network != conf.Network || connection.ContainerNetns != args.Netns {
+		return newError(errInvalidEnvironment, "Container "+args.ContainerID+" is connected to another network", nil)
+	}
+	if connection.ContainerIfName != args.IfName {
+		return newError(errInvalidEnvironment, "Container "+args.ContainerID+" is connected with another interface", nil)
+	}
+	if conf.PrevResult != nil {
+		current := connectionResult(conf.CNIVersion, connection)
+		for _, ip := range conf.PrevResult.IPs {
+			if !hasAddress(current, ip.Address) {
+				return newError(errInvalidEnvironment, "Address "+ip.Address+" is no longer assigned", nil)
+			}
+		}
+	}
+	return nil
+}
+
+func hasAddress(result *cniResult, address string) bool {
+	for _, ip := range result.IPs {
+		if ip.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionResult returns the CNI result of a connection, its gateways being
+// the default routes
+func connectionResult(version string, connection *daemon.Connection) *cniResult {
+	details := connection.ConnectionDetails
+	index := 0
+	name := connection.ContainerIfName
+	if name == "" {
+		name = connection.OvsPortID
+	}
+	result := &cniResult{
+		CNIVersion: version,
+		Interfaces: []cniInterface{{Name: name, Mac: details.Mac, Sandbox: connection.ContainerNetns}},
+	}
+	if details.Ip != "" {
+		result.IPs = append(result.IPs, cniIPConfig{Version: "4", Address: details.Ip + details.Subnet, Gateway: details.Gateway, Interface: &index})
+		if net.ParseIP(details.Gateway) != nil {
+			result.Routes = append(result.Routes, cniRoute{Dst: "0.0.0.0/0", GW: details.Gateway})
+		}
+	}
+	if details.Ip6 != "" {
+		result.IPs = append(result.IPs, cniIPConfig{Version: "6", Address: details.Ip6 + details.Subnet6, Gateway: details.Gateway6, Interface: &index})
+		if net.ParseIP(details.Gateway6) != nil {
+			result.Routes = append(result.Routes, cniRoute{Dst: "::/0", GW: details.Gateway6})
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/socketplane/socketplane/daemon"
+)
+
+// fakeDaemon serves the connections API of a daemon. Connections to the
+// broken network are recorded without port, as the daemon does when it fails.
+type fakeDaemon struct {
+	sync.Mutex
+	connections map[string]*daemon.Connection
+}
+
+func (f *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	id := strings.TrimPrefix(r.URL.Path, daemon.API_VERSION+"/connections/")
+	switch {
+	case r.Method == "POST" && r.URL.Path == daemon.API_VERSION+"/connections":
+		connection := &daemon.Connection{}
+		json.NewDecoder(r.Body).Decode(connection)
+		if existing, ok := f.connections[connection.ContainerID]; ok {
+			connection = existing
+		} else if connection.Network != "broken" {
+			connection.OvsPortID = "ovs1234"
+			connection.ConnectionDetails = daemon.OvsConnection{
+				Name: "ovs1234", Ip: "10.1.0.2", Subnet: "/24", Mac: "02:42:0a:01:00:02", Gateway: "10.1.0.1",
+			}
+		}
+		f.connections[connection.ContainerID] = connection
+		json.NewEncoder(w).Encode(connection)
+	case r.Method == "GET" && f.connections[id] != nil:
+		json.NewEncoder(w).Encode(f.connections[id])
+	case r.Method == "DELETE" && f.connections[id] != nil:
+		delete(f.connections, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func runCommand(t *testing.T, server *httptest.Server, command string, network string, prevResult string) (interface{}, *cniError) {
+	conf := `{"cniVersion": "0.4.0", "name": "` + network + `", "type": "socketplane", "daemon": "` + server.URL + `"`
+	if prevResult != "" {
+		conf += `, "prevResult": ` + prevResult
+	}
+	args := &cniArgs{Command: command, ContainerID: "c1", Netns: "/var/run/netns/c1", IfName: "eth0", Args: map[string]string{}}
+	return run(args, strings.NewReader(conf+"}"))
+}
+
+func TestCNIAdd(t *testing.T) {
+	f := &fakeDaemon{connections: make(map[string]*daemon.Connection)}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	result, err := runCommand(t, server, "ADD", "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(result)
+	expected := `{"cniVersion":"0.4.0","interfaces":[{"name":"eth0","mac":"02:42:0a:01:00:02","sandbox":"/var/run/netns/c1"}],` +
+		`"ips":[{"version":"4","address":"10.1.0.2/24","gateway":"10.1.0.1","interface":0}],` +
+		`"routes":[{"dst":"0.0.0.0/0","gw":"10.1.0.1"}],"dns":{}}`
+	if string(data) != expected {
+		t.Fatalf("Expected %s, got %s", expected, data)
+	}
+	if connection := f.connections["c1"]; connection.ContainerNetns != "/var/run/netns/c1" || connection.ContainerIfName != "eth0" || connection.Network != "web" {
+		t.Fatalf("Unexpected connection %+v", f.connections["c1"])
+	}
+
+	if _, err := runCommand(t, server, "CHECK", "web", string(data)); err != nil {
+		t.Fatalf("The connection should check. %v", err)
+	}
+	if _, err := runCommand(t, server, "CHECK", "db", ""); err == nil {
+		t.Fatal("A connection to another network should not check")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := runCommand(t, server, "DEL", "web", ""); err != nil {
+			t.Fatalf("DEL should succeed. %v", err)
+		}
+	}
+	if _, err := runCommand(t, server, "CHECK", "web", ""); err == nil {
+		t.Fatal("A deleted connection should not check")
+	}
+}
+
+func TestCNIAddFailure(t *testing.T) {
+	f := &fakeDaemon{connections: make(map[string]*daemon.Connection)}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	if _, err := runCommand(t, server, "ADD", "broken", ""); err == nil || err.Code != errTryAgainLater {
+		t.Fatalf("Expected an error, got %v", err)
+	}
+	if len(f.connections) != 0 {
+		t.Fatal("The failed connection should be deleted")
+	}
+	server.Close()
+	if _, err := runCommand(t, server, "ADD", "web", ""); err == nil || err.Code != errTryAgainLater {
+		t.Fatalf("An unreachable daemon should fail, got %v", err)
+	}
+}
+
+func TestCNIConfiguration(t *testing.T) {
+	args := &cniArgs{Command: "ADD", ContainerID: "c1", Netns: "/var/run/netns/c1"}
+	tests := []struct {
+		conf string
+		code uint
+	}{
+		{`{"cniVersion": "0.4.0"`, errDecodingFailure},
+		{`{"cniVersion": "0.1.0", "name": "web"}`, errIncompatibleVersion},
+		{`{"cniVersion": "0.4.0"}`, errInvalidConfig},
+	}
+	for _, test := range tests {
+		if _, err := run(args, strings.NewReader(test.conf)); err == nil || err.Code != test.code {
+			t.Fatalf("%s : expected error %d, got %v", test.conf, test.code, err)
+		}
+	}
+	args.ContainerID = ""
+	if _, err := run(args, strings.NewReader(`{"cniVersion": "0.4.0", "name": "web"}`)); err == nil || err.Code != errInvalidEnvironment {
+		t.Fatalf("A missing container ID should fail, got %v", err)
+	}
+}
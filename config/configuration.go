@@ -10,22 +10,149 @@ const (
 )
 
 type config struct {
-	Daemon DaemonCfg
-	// Add more Configs such as ClusterCfg, OvsCfg, etc.
+	Daemon  DaemonCfg
+	Cluster ClusterCfg
+	Etcd    EtcdCfg
+	Network NetworkCfg
+	IPAM    IPAMCfg
+	Tunnel  TunnelCfg
+	Monitor MonitorCfg
+	Docker  DockerCfg
+	// Add more Configs such as OvsCfg, etc.
 }
 
 type DaemonCfg struct {
 	Bootstrap bool
 	Debug     bool
+	Datastore string
+}
+
+// ClusterCfg holds the static clustering settings. Peers are joined on
+// startup, which is required where multicast (and hence Bonjour) is unavailable.
+type ClusterCfg struct {
+	Iface       string
+	Peers       []string
+	Bonjour     bool
+	ServiceName string `toml:"service_name"`
+	ServicePort int    `toml:"service_port"`
+	DataDir     string `toml:"data_dir"`
+}
+
+// EtcdCfg is used when the daemon datastore is set to etcd
+type EtcdCfg struct {
+	Endpoints []string
+	Prefix    string
+	TTL       int
+}
+
+// NetworkCfg holds the supernets that the subnets of networks created
+// without a subnet are carved from, and the default prefix length of these
+// subnets
+type NetworkCfg struct {
+	SubnetPool []string `toml:"subnet_pool"`
+	SubnetSize int      `toml:"subnet_size"`
+}
+
+// IPAMCfg selects the IPAM driver : "bitmap", the default, which keeps the
+// allocations in the datastore, or "http", which delegates them to the
+// external IPAM at URL
+type IPAMCfg struct {
+	Driver  string
+	URL     string `toml:"url"`
+	Timeout int
+}
+
+// TunnelCfg holds the encapsulation of the tunnels to the peers : "vxlan",
+// the default, "gre" or "geneve". DstPort and TTL are left to OVS when 0, as
+// is the DF bit of the outer header when DF is empty.
+type TunnelCfg struct {
+	Type    string
+	DstPort int    `toml:"dst_port"`
+	TTL     int    `toml:"ttl"`
+	DF      string `toml:"df_default"`
+}
+
+// MonitorCfg sets how often the underlay address of every peer is probed, in
+// seconds, how long a probe waits for its reply, in seconds, and after how
+// many lost probes in a row the tunnel to a peer is degraded. With PortDown
+// the port of a degraded tunnel is brought down until the peer replies
+// again. Peers are not probed when Interval is 0.
+type MonitorCfg struct {
+	Interval  int
+	Timeout   int
+	Threshold int
+	PortDown  bool `toml:"port_down"`
+}
+
+// DockerCfg sets whether the containers are attached by watching the events
+// of the Docker daemon listening on Socket. Events should be disabled when the
+// containers are attached through the Powerstrip adapter. The network driver
+// plugin API is served on the Plugin socket, if set. Both are off unless
+// enabled, since the plugin socket is not authenticated.
+type DockerCfg struct {
+	Events bool
+	Socket string
+	Plugin string
+}
+
+var defaultNetwork = NetworkCfg{
+	SubnetPool: []string{"10.100.0.0/14"},
+	SubnetSize: 24,
+}
+
+var defaultTunnel = TunnelCfg{
+	Type: "vxlan",
+}
+
+var defaultMonitor = MonitorCfg{
+	Interval:  10,
+	Timeout:   1,
+	Threshold: 3,
+}
+
+var defaultDocker = DockerCfg{
+	Socket: "unix:///var/run/docker.sock",
+}
+
+var defaultCluster = ClusterCfg{
+	Bonjour:     true,
+	ServiceName: "_docker._cluster",
+	ServicePort: 9999,
+	DataDir:     "/tmp/socketplane",
 }
 
 var spConfig config
 var Daemon DaemonCfg
+var Cluster = defaultCluster
+var Etcd EtcdCfg
+var Network = defaultNetwork
+var IPAM IPAMCfg
+var Tunnel = defaultTunnel
+var Monitor = defaultMonitor
+var Docker = defaultDocker
 
 func Parse(tomlCfgFile string) error {
+	// The decoder does not replace the elements of a non empty slice
+	spConfig = config{
+		Cluster: defaultCluster,
+		Network: NetworkCfg{SubnetSize: defaultNetwork.SubnetSize},
+		Tunnel:  defaultTunnel,
+		Monitor: defaultMonitor,
+		Docker:  defaultDocker,
+	}
 	if _, err := toml.DecodeFile(tomlCfgFile, &spConfig); err != nil {
 		return err
 	}
 	Daemon = spConfig.Daemon
+	Cluster = spConfig.Cluster
+	Etcd = spConfig.Etcd
+	Network = spConfig.Network
+	IPAM = spConfig.IPAM
+	Tunnel = spConfig.Tunnel
+	Monitor = spConfig.Monitor
+	Docker = spConfig.Docker
+	if len(Network.SubnetPool) == 0 {
+		Network.SubnetPool = defaultNetwork.SubnetPool
+	}
 	return nil
 }
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func parseString(t *testing.T, cfg string) {
+	f, err := ioutil.TempFile("", "socketplane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(cfg)
+	f.Close()
+	if err := Parse(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseClusterDefaults(t *testing.T) {
+	parseString(t, "[daemon]\nbootstrap = true\n")
+	if !Daemon.Bootstrap {
+		t.Fatal("daemon section not parsed")
+	}
+	if !reflect.DeepEqual(Cluster, defaultCluster) {
+		t.Fatalf("cluster defaults not applied : %+v", Cluster)
+	}
+}
+
+func TestParseCluster(t *testing.T) {
+	parseString(t, `
+[cluster]
+iface = "eth1"
+peers = ["10.0.0.1", "10.0.0.2"]
+bonjour = false
+service_name = "_sp._cluster"
+service_port = 8888
+data_dir = "/var/lib/socketplane/consul"
+`)
+	expected := ClusterCfg{
+		Iface:       "eth1",
+		Peers:       []string{"10.0.0.1", "10.0.0.2"},
+		Bonjour:     false,
+		ServiceName: "_sp._cluster",
+		ServicePort: 8888,
+		DataDir:     "/var/lib/socketplane/consul",
+	}
+	if !reflect.DeepEqual(Cluster, expected) {
+		t.Fatalf("Expected %+v\n\tReceived %+v", expected, Cluster)
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	parseString(t, "[daemon]\nbootstrap = true\n")
+	if !reflect.DeepEqual(Network, defaultNetwork) {
+		t.Fatalf("network defaults not applied : %+v", Network)
+	}
+	parseString(t, `
+[network]
+subnet_pool = ["10.200.0.0/16", "172.20.0.0/16"]
+subnet_size = 26
+`)
+	expected := NetworkCfg{
+		SubnetPool: []string{"10.200.0.0/16", "172.20.0.0/16"},
+		SubnetSize: 26,
+	}
+	if !reflect.DeepEqual(Network, expected) {
+		t.Fatalf("Expected %+v\n\tReceived %+v", expected, Network)
+	}
+}
+
+func TestParseIPAM(t *testing.T) {
+	parseString(t, `
+[ipam]
+driver = "http"
+url = "http://ipam.example.com/socketplane"
+timeout = 10
+`)
+	expected := IPAMCfg{Driver: "http", URL: "http://ipam.example.com/socketplane", Timeout: 10}
+	if !reflect.DeepEqual(IPAM, expected) {
+		t.Fatalf("Expected %+v\n\tReceived %+v", expected, IPAM)
+	}
+}
+
+func TestParseTunnel(t *testing.T) {
+	parseString(t, `
+[daemon]
+debug = true
+`)
+	if !reflect.DeepEqual(Tunnel, defaultTunnel) {
+		t.Fatalf("Expected the default tunnel %+v\n\tReceived %+v", defaultTunnel, Tunnel)
+	}
+	parseString(t, `
+[tunnel]
+type = "geneve"
+dst_port = 6082
+ttl = 64
+df_default = "false"
+`)
+	expected := TunnelCfg{Type: "geneve", DstPort: 6082, TTL: 64, DF: "false"}
+	if !reflect.DeepEqual(Tunnel, expected) {
+		t.Fatalf("Expected %+v\n\tReceived %+v", expected, Tunnel)
+	}
+}
+
+func TestParseMonitor(t *testing.T) {
+	parseString(t, `
+[daemon]
+debug = true
+`)
+	if !reflect.DeepEqual(Monitor, defaultMonitor) {
+		t.Fatalf("Expected the default monitor %+v\n\tReceived %+v", defaultMonitor, Monitor)
+	}
+	parseString(t, `
+[monitor]
+interval = 5
+port_down = true
+`)
+	expected := MonitorCfg{Interval: 5, Timeout: 1, Threshold: 3, PortDown: true}
+	if !reflect.DeepEqual(Monitor, expected) {
+		t.Fatalf("Expected %+v\n\tReceived %+v", expected, Monitor)
+	}
+}
+
+func TestParseDocker(t *testing.T) {
+	parseString(t, `
+[daemon]
+debug = true
+`)
+	if !reflect.DeepEqual(Docker, defaultDocker) {
+		t.Fatalf("Expected the default docker %+v\n\tReceived %+v", defaultDocker, Docker)
+	}
+	parseString(t, `
+[docker]
+events = true
+plugin = "/run/docker/plugins/socketplane.sock"
+`)
+	expected := DockerCfg{Events: true, Socket: "unix:///var/run/docker.sock", Plugin: "/run/docker/plugins/socketplane.sock"}
+	if !reflect.DeepEqual(Docker, expected) {
+		t.Fatalf("Expected %+v\n\tReceived %+v", expected, Docker)
+	}
+}
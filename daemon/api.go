@@ -2,10 +2,12 @@ package daemon
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/gorilla/mux"
@@ -25,13 +27,21 @@ type Configuration struct {
 	BridgeMTU  int    `json:"bridge_mtu"`
 }
 
+// Connection attaches a container to a network. The container is entered
+// through the network namespace of its PID, or through ContainerNetns, the
+// path of a namespace as CNI runtimes give it or the name of an ip netns one.
+// The port is named ContainerIfName in the namespace, if set, else it keeps
+// the name of its OVS port.
 type Connection struct {
 	ContainerID       string        `json:"container_id"`
 	ContainerName     string        `json:"container_name"`
 	ContainerPID      string        `json:"container_pid"`
+	ContainerNetns    string        `json:"container_netns,omitempty"`
+	ContainerIfName   string        `json:"container_ifname,omitempty"`
 	Network           string        `json:"network"`
 	OvsPortID         string        `json:"ovs_port_id"`
 	ConnectionDetails OvsConnection `json:"connection_details"`
+	RequestedIP       string        `json:"requested_ip,omitempty"`
 }
 
 type apiError struct {
@@ -66,11 +76,15 @@ func createRouter(d *Daemon) *mux.Router {
 	r := mux.NewRouter()
 	m := map[string]map[string]HttpApiFunc{
 		"GET": {
-			"/configuration":       getConfiguration,
-			"/connections":         getConnections,
-			"/connections/{id:.*}": getConnection,
-			"/networks":            getNetworks,
-			"/networks/{id:.*}":    getNetwork,
+			"/configuration":                   getConfiguration,
+			"/connections":                     getConnections,
+			"/connections/{id:.*}":             getConnection,
+			"/networks":                        getNetworks,
+			"/networks/{id:[^/]*}":             getNetwork,
+			"/networks/{id:[^/]*}/allocations": getNetworkAllocations,
+			"/cluster":                         getCluster,
+			"/cluster/members":                 getClusterMembers,
+			"/cluster/reachability":            getClusterReachability,
 		},
 		"POST": {
 			"/configuration": setConfiguration,
@@ -122,7 +136,7 @@ func setConfiguration(d *Daemon, w http.ResponseWriter, r *http.Request) *apiErr
 }
 
 func getConnections(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
-	data, _ := json.Marshal(d.Connections)
+	data, _ := json.Marshal(d.connectionsSnapshot())
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Write(data)
 	return nil
@@ -131,7 +145,7 @@ func getConnections(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError
 func getConnection(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	vars := mux.Vars(r)
 	containerID := vars["id"]
-	connection := d.Connections[containerID]
+	connection, _ := d.connection(containerID)
 
 	if connection == nil {
 		msg := fmt.Sprintf("Connection for container %v not found", containerID)
@@ -159,14 +173,32 @@ func createConnection(d *Daemon, w http.ResponseWriter, r *http.Request) *apiErr
 		cfg.Network = DefaultNetworkName
 	}
 
-	context := &ConnectionContext{
-		ConnectionAdd,
-		cfg,
-		make(chan *Connection),
-	}
-	d.cC <- context
+	// The container may already have been attached on its start event
+	attachLock.Lock()
+	result, ok := d.connection(cfg.ContainerID)
+	if !ok {
+		if cfg.RequestedIP != "" {
+			if err := reserveRequestedIP(cfg); err != nil {
+				attachLock.Unlock()
+				return requestedIPError(err)
+			}
+		}
 
-	result := <-context.Result
+		context := &ConnectionContext{
+			ConnectionAdd,
+			cfg,
+			make(chan *Connection),
+			nil,
+		}
+		d.cC <- context
+
+		result = <-context.Result
+		if context.Err != nil {
+			attachLock.Unlock()
+			return requestedIPError(context.Err)
+		}
+	}
+	attachLock.Unlock()
 
 	location := fmt.Sprintf("%s/%s", r.URL.String(), cfg.ContainerID)
 	data, _ := json.Marshal(result)
@@ -176,11 +208,21 @@ func createConnection(d *Daemon, w http.ResponseWriter, r *http.Request) *apiErr
 	return nil
 }
 
+func requestedIPError(err error) *apiError {
+	switch err {
+	case ErrAddressInUse, ErrAddressExcluded:
+		return &apiError{http.StatusConflict, err.Error()}
+	case ErrAddressNotInSubnet:
+		return &apiError{http.StatusBadRequest, err.Error()}
+	}
+	return &apiError{http.StatusInternalServerError, err.Error()}
+}
+
 func deleteConnection(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	vars := mux.Vars(r)
 	containerID := vars["id"]
 
-	connection, ok := d.Connections[containerID]
+	connection, ok := d.connection(containerID)
 	if !ok {
 		return &apiError{http.StatusNotFound, "Container Not Found"}
 	}
@@ -189,6 +231,7 @@ func deleteConnection(d *Daemon, w http.ResponseWriter, r *http.Request) *apiErr
 		ConnectionDelete,
 		connection,
 		make(chan *Connection),
+		nil,
 	}
 	d.cC <- context
 	<-context.Result
@@ -226,25 +269,103 @@ func getNetwork(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	return nil
 }
 
+func getNetworkAllocations(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
+	vars := mux.Vars(r)
+	networkID := vars["id"]
+
+	if _, err := GetNetwork(networkID); err != nil {
+		return &apiError{http.StatusNotFound, err.Error()}
+	}
+	allocations, err := GetAllocations(networkID)
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	data, err := json.Marshal(allocations)
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+// networkRequest is a network to create. The subnet of a network without a
+// subnet or a subnet6 is allocated with the given prefix length, or the
+// configured one.
+type networkRequest struct {
+	Network
+	PrefixLength int `json:"prefix_length,omitempty"`
+}
+
 func createNetwork(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	if r.Body == nil {
 		return &apiError{http.StatusBadRequest, "Request body is empty"}
 	}
-	networkRequest := &Network{}
+	request := &networkRequest{}
 	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(networkRequest)
+	err := decoder.Decode(request)
 	if err != nil {
 		return &apiError{http.StatusInternalServerError, err.Error()}
 	}
-	_, cidr, err := net.ParseCIDR(networkRequest.Subnet)
-	if err != nil {
-		return &apiError{http.StatusInternalServerError, err.Error()}
+	networkRequest := &request.Network
+	var cidr, cidr6 *net.IPNet
+	if networkRequest.Subnet != "" {
+		_, cidr, err = net.ParseCIDR(networkRequest.Subnet)
+		if err != nil {
+			return &apiError{http.StatusInternalServerError, err.Error()}
+		}
+	}
+	if networkRequest.Subnet6 != "" {
+		_, cidr6, err = net.ParseCIDR(networkRequest.Subnet6)
+		if err != nil || cidr6.IP.To4() != nil {
+			return &apiError{http.StatusBadRequest, "Invalid IPv6 subnet " + networkRequest.Subnet6}
+		}
 	}
 
-	newNetwork, err := CreateNetwork(networkRequest.ID, cidr)
+	if !validGatewayMode(networkRequest.GatewayMode) {
+		return &apiError{http.StatusBadRequest, "Invalid gateway mode " + networkRequest.GatewayMode}
+	}
+
+	// A network without a subnet gets one carved out of the subnet pool
+	var carved *net.IPNet
+	if cidr == nil && cidr6 == nil {
+		if _, err := GetNetwork(networkRequest.ID); err != nil {
+			if carved, err = AllocateSubnet(request.PrefixLength); err == ErrNoSubnetAvailable {
+				return &apiError{http.StatusServiceUnavailable, err.Error()}
+			} else if err != nil {
+				return &apiError{http.StatusBadRequest, err.Error()}
+			}
+			cidr = carved
+		}
+	}
+	release := func() {
+		if carved != nil {
+			ReleaseSubnet(carved)
+		}
+	}
+
+	pools, err := networkPools(networkRequest, cidr, cidr6)
 	if err != nil {
+		release()
+		return &apiError{http.StatusBadRequest, err.Error()}
+	}
+
+	newNetwork, err := CreateNetwork(networkRequest.ID, cidr, cidr6, nil, nil, networkRequest.GatewayMode, pools)
+	if conflict, ok := err.(*SubnetConflictError); ok {
+		release()
+		data, _ := json.Marshal(conflict)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(data)
+		return nil
+	} else if err != nil {
+		release()
 		return &apiError{http.StatusInternalServerError, err.Error()}
 	}
+	if carved != nil && newNetwork.Subnet != carved.String() {
+		// The network was created by another request in the meantime
+		release()
+	}
 
 	data, _ := json.Marshal(newNetwork)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -252,6 +373,43 @@ func createNetwork(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError
 	return nil
 }
 
+// networkPools returns the pools of the subnets of a network request
+func networkPools(networkRequest *Network, cidr *net.IPNet, cidr6 *net.IPNet) ([]*IPAMPool, error) {
+	pools := make([]*IPAMPool, 0)
+	if networkRequest.Pool != "" && cidr == nil {
+		return nil, errors.New("A pool needs a subnet")
+	}
+	if networkRequest.Pool6 != "" && cidr6 == nil {
+		return nil, errors.New("A pool6 needs a subnet6")
+	}
+	for _, value := range networkRequest.Exclude {
+		r, err := ParseIPAMRange(value)
+		if err != nil {
+			return nil, err
+		}
+		inSubnet := cidr != nil && cidr.Contains(r.Start) && cidr.Contains(r.End)
+		inSubnet6 := cidr6 != nil && cidr6.Contains(r.Start) && cidr6.Contains(r.End)
+		if !inSubnet && !inSubnet6 {
+			return nil, errors.New("Excluded range " + value + " is not in a subnet of the network")
+		}
+	}
+	if cidr != nil {
+		pool, err := NewIPAMPool(*cidr, networkRequest.Pool, networkRequest.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	if cidr6 != nil {
+		pool, err := NewIPAMPool(*cidr6, networkRequest.Pool6, networkRequest.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
 func deleteNetwork(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	vars := mux.Vars(r)
 	networkID := vars["id"]
@@ -263,6 +421,36 @@ func deleteNetwork(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError
 	return nil
 }
 
+func getCluster(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
+	data, err := json.Marshal(d.ClusterInfo())
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+func getClusterMembers(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
+	data, err := json.Marshal(clusterMembers.list())
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
+func getClusterReachability(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
+	data, err := json.Marshal(peerReachability.list())
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+	return nil
+}
+
 func clusterBind(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	if r.URL.RawQuery == "" {
 		return &apiError{http.StatusBadRequest, "Please provide the interface parameter"}
@@ -295,15 +483,67 @@ func clusterJoin(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	if !ok || addr[0] == "" {
 		return &apiError{http.StatusBadRequest, "Please provide the address parameter"}
 	}
+	tunnel, err := tunnelQuery(values)
+	if err != nil {
+		return &apiError{http.StatusBadRequest, err.Error()}
+	}
 	log.Debugf("Request Received. Join Cluster  %s", addr[0])
-	err = d.JoinCluster(addr[0])
+	err = d.JoinCluster(addr[0], tunnel)
 	if err != nil {
 		return &apiError{http.StatusInternalServerError, err.Error()}
 	}
 	return nil
 }
 
+// tunnelQuery parses the tunnel options of a peer from the tunnel, dst_port,
+// ttl and df_default query parameters
+func tunnelQuery(values url.Values) (TunnelOptions, error) {
+	tunnel := TunnelOptions{Type: values.Get("tunnel"), DF: values.Get("df_default")}
+	for key, value := range map[string]*int{"dst_port": &tunnel.DstPort, "ttl": &tunnel.TTL} {
+		if values.Get(key) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(values.Get(key))
+		if err != nil {
+			return tunnel, fmt.Errorf("Invalid %s %s", key, values.Get(key))
+		}
+		*value = n
+	}
+	return tunnel, tunnel.validate()
+}
+
+// clusterLeaveResponse reports what leaving the cluster tore down along with
+// the status
+type clusterLeaveResponse struct {
+	Response
+	*ClusterLeaveResult
+}
+
 func clusterLeave(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
-	//ToDo: Needs implementing
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return &apiError{http.StatusBadRequest, "Could not decode query parameters"}
+	}
+	force := values.Get("force") == "true"
+	log.Debugf("Request Received. Leave Cluster (force : %v)", force)
+	left, err := d.LeaveCluster(force)
+	if err == ErrConnectionsExist {
+		msg := fmt.Sprintf("%s. Remove the connections or use force=true", err.Error())
+		return &apiError{http.StatusConflict, msg}
+	}
+	if left == nil {
+		left = &ClusterLeaveResult{[]string{}, []string{}, []string{}, []string{}}
+	}
+	// A failed leave reports the steps that completed along with the error
+	response := &clusterLeaveResponse{Response{"OK", "Left the cluster"}, left}
+	code := http.StatusOK
+	if err != nil {
+		response.Response = Response{"Error", err.Error()}
+		code = http.StatusInternalServerError
+	}
+	data, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(data)
 	return nil
 }
@@ -3,7 +3,9 @@ package daemon
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -180,6 +182,29 @@ func TestCreateConnection(t *testing.T) {
 	}
 }
 
+func TestCreateConnectionAttached(t *testing.T) {
+	daemon := NewDaemon()
+	connection := &Connection{
+		ContainerID: "abc123",
+		Network:     "foo",
+		OvsPortID:   "ovs1234",
+	}
+	daemon.Connections["abc123"] = connection
+	data, _ := json.Marshal(&Connection{ContainerID: "abc123", Network: "foo"})
+	request, _ := http.NewRequest("POST", "/v0.1/connections", bytes.NewReader(data))
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v:\n\t%v", "200", response.Code, response.Body)
+	}
+	expected, _ := json.Marshal(connection)
+	if !bytes.Equal(expected, response.Body.Bytes()) {
+		t.Fatalf("The existing connection should be returned : %s", response.Body)
+	}
+}
+
 func TestCreateConnectionNoNetwork(t *testing.T) {
 	daemon := NewDaemon()
 	connection := &Connection{
@@ -325,6 +350,103 @@ func TestDeleteConnection(t *testing.T) {
 
 }
 
+func TestCreateConnectionRequestedIP(t *testing.T) {
+	defer useMemoryDatastore()()
+	network := &Network{ID: "foo", Subnet: "10.10.70.0/24", Gateway: "10.10.70.1", Vlan: uint(1)}
+	data, _ := json.Marshal(network)
+	datastore.Put(networkStore, network.ID, data, nil)
+
+	daemon := NewDaemon()
+	go func() {
+		for {
+			context := <-daemon.cC
+			if context.Connection.RequestedIP != "10.10.70.5" {
+				t.Error("requested ip is incorrect")
+			}
+			context.Result <- context.Connection
+		}
+	}()
+
+	tests := []struct {
+		ip   string
+		code int
+	}{
+		{"10.10.70.5", http.StatusOK},
+		{"10.10.70.5", http.StatusConflict},
+		{"10.10.71.5", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		connection := &Connection{
+			ContainerID: "abc123",
+			Network:     "foo",
+			RequestedIP: test.ip,
+		}
+		data, _ := json.Marshal(connection)
+		request, _ := http.NewRequest("POST", "/v0.1/connections", bytes.NewReader(data))
+		response := httptest.NewRecorder()
+
+		createRouter(daemon).ServeHTTP(response, request)
+
+		if response.Code != test.code {
+			t.Fatalf("Requesting %s expected %v:\n\tReceived: %v", test.ip, test.code, response.Code)
+		}
+	}
+
+	allocations, _ := GetAllocations("foo")
+	if len(allocations) != 1 || allocations[0].ContainerID != "abc123" {
+		t.Fatalf("Reserved address should be recorded : %+v", allocations)
+	}
+}
+
+func TestFailPostHook(t *testing.T) {
+	postResp := &adapterPostResponse{}
+	postResp.ModifiedServerResponse.Code = http.StatusNoContent
+	postResp.ModifiedServerResponse.ContentType = "application/json"
+
+	failPostHook(postResp, ErrAddressInUse)
+
+	if postResp.ModifiedServerResponse.Code != http.StatusConflict {
+		t.Fatalf("Expected %v:\n\tReceived: %v", http.StatusConflict, postResp.ModifiedServerResponse.Code)
+	}
+	if postResp.ModifiedServerResponse.Body != ErrAddressInUse.Error() {
+		t.Fatalf("The hook should fail with the reason, got %q", postResp.ModifiedServerResponse.Body)
+	}
+}
+
+func TestCreateConnectionFailure(t *testing.T) {
+	defer useMemoryDatastore()()
+	network := &Network{ID: "foo", Subnet: "10.10.70.0/24", Gateway: "10.10.70.1", Vlan: uint(1)}
+	data, _ := json.Marshal(network)
+	datastore.Put(networkStore, network.ID, data, nil)
+
+	daemon := NewDaemon()
+	go ConnectionRPCHandler(daemon)
+
+	// The container has no namespace to be connected into
+	connection := &Connection{
+		ContainerID:  "abc123",
+		ContainerPID: "none",
+		Network:      "foo",
+		RequestedIP:  "10.10.70.5",
+	}
+	data, _ = json.Marshal(connection)
+	request, _ := http.NewRequest("POST", "/v0.1/connections", bytes.NewReader(data))
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected %v:\n\tReceived: %v", http.StatusInternalServerError, response.Code)
+	}
+	if _, ok := daemon.connection("abc123"); ok {
+		t.Fatal("A failed connection should not be stored")
+	}
+	_, subnet, _ := net.ParseCIDR(network.Subnet)
+	if err := IPAMRequestAddress(net.ParseIP("10.10.70.5"), *subnet); err != nil {
+		t.Fatalf("The requested address should be released, got %v", err)
+	}
+}
+
 func TestGetNetworksApi(t *testing.T) {
 	t.Skip("unable to mock network store")
 	daemon := NewDaemon()
@@ -381,6 +503,100 @@ func TestSetNetworksApi(t *testing.T) {
 	}
 }
 
+func TestSetNetworksApiInvalidGatewayMode(t *testing.T) {
+	daemon := NewDaemon()
+	network := &Network{
+		ID:          "foo",
+		Subnet:      "10.10.10.0/24",
+		GatewayMode: "anywhere",
+	}
+	data, _ := json.Marshal(network)
+
+	request, _ := http.NewRequest("POST", "/v0.1/networks", bytes.NewReader(data))
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "400", response.Code)
+	}
+}
+
+func TestSetNetworksApiInvalidSubnet(t *testing.T) {
+	daemon := NewDaemon()
+	for _, network := range []*Network{
+		{ID: "foo", Subnet6: "10.10.10.0/24"},
+		{ID: "foo", Subnet: "10.10.10.0/24", Subnet6: "fd00::/129"},
+		{ID: "foo", Subnet: "10.10.10.0/24", Pool: "10.10.11.10-10.10.11.20"},
+		{ID: "foo", Subnet: "10.10.10.0/24", Pool: "10.10.10.20-10.10.10.10"},
+		{ID: "foo", Subnet: "10.10.10.0/24", Pool6: "fd00::10-fd00::20"},
+		{ID: "foo", Subnet: "10.10.10.0/24", Exclude: []string{"10.10.10.5", "bar"}},
+		{ID: "foo", Subnet: "10.10.10.0/24", Exclude: []string{"10.10.20.0/28"}},
+	} {
+		data, _ := json.Marshal(network)
+		request, _ := http.NewRequest("POST", "/v0.1/networks", bytes.NewReader(data))
+		response := httptest.NewRecorder()
+
+		createRouter(daemon).ServeHTTP(response, request)
+
+		if response.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v for %+v:\n\tReceived: %v", "400", network, response.Code)
+		}
+	}
+}
+
+func TestSetNetworksApiAllocatedSubnet(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations(nil)()
+	daemon := NewDaemon()
+	for _, test := range []struct {
+		body string
+		code int
+	}{
+		{`{"id": "foo", "prefix_length": 31}`, http.StatusBadRequest},
+		// The subnet is allocated, then released as OVS is not connected
+		{`{"id": "foo", "prefix_length": 24}`, http.StatusInternalServerError},
+	} {
+		request, _ := http.NewRequest("POST", "/v0.1/networks", bytes.NewReader([]byte(test.body)))
+		response := httptest.NewRecorder()
+
+		createRouter(daemon).ServeHTTP(response, request)
+
+		if response.Code != test.code {
+			t.Fatalf("Expected %v for %s:\n\tReceived: %v", test.code, test.body, response.Code)
+		}
+	}
+	subnet, err := AllocateSubnet(24)
+	if err != nil || subnet.String() != "10.100.0.0/24" {
+		t.Fatalf("subnet of the failed network was not released : %v %v", subnet, err)
+	}
+}
+
+func TestSetNetworksApiOverlap(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations(nil)()
+	daemon := NewDaemon()
+	data, _ := json.Marshal(&Network{ID: "bar", Subnet: "10.10.0.0/16"})
+	datastore.Put(networkStore, "bar", data, nil)
+
+	data, _ = json.Marshal(&Network{ID: "foo", Subnet: "10.10.5.0/24"})
+	request, _ := http.NewRequest("POST", "/v0.1/networks", bytes.NewReader(data))
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusConflict {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "409", response.Code)
+	}
+	conflict := &SubnetConflictError{}
+	if err := json.Unmarshal(response.Body.Bytes(), conflict); err != nil {
+		t.Fatal(err)
+	}
+	if conflict.Network != "bar" || conflict.NetworkSubnet != "10.10.0.0/16" || conflict.Subnet != "10.10.5.0/24" {
+		t.Fatalf("Incorrect conflict : %+v", conflict)
+	}
+}
+
 func TestDeleteNetworksApi(t *testing.T) {
 	t.Skip("unable to mock network store")
 	daemon := NewDaemon()
@@ -428,6 +644,46 @@ func TestDeleteNetworkNonExistentApi(t *testing.T) {
 	}
 }
 
+func TestGetNetworkAllocationsApi(t *testing.T) {
+	defer useMemoryDatastore()()
+	network := &Network{ID: "foo", Subnet: "10.10.50.0/24", Gateway: "10.10.50.1", Vlan: uint(1)}
+	data, _ := json.Marshal(network)
+	datastore.Put(networkStore, network.ID, data, nil)
+	_, ipNet, _ := net.ParseCIDR(network.Subnet)
+	recordAllocation(IPAMRequest(*ipNet), *ipNet, "foo", "")
+	recordAllocation(IPAMRequest(*ipNet), *ipNet, "foo", "c1")
+
+	daemon := NewDaemon()
+	request, _ := http.NewRequest("GET", "/v0.1/networks/foo/allocations", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+	allocations := []IPAMAllocation{}
+	if err := json.Unmarshal(response.Body.Bytes(), &allocations); err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 2 || allocations[1].Address != "10.10.50.2" || allocations[1].ContainerID != "c1" {
+		t.Fatalf("Incorrect allocations : %+v", allocations)
+	}
+}
+
+func TestGetNetworkAllocationsNonExistentApi(t *testing.T) {
+	defer useMemoryDatastore()()
+	daemon := NewDaemon()
+	request, _ := http.NewRequest("GET", "/v0.1/networks/abc123/allocations", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "404", response.Code)
+	}
+}
+
 func TestClusterJoin(t *testing.T) {
 	daemon := NewDaemon()
 	request, _ := http.NewRequest("POST", "/v0.1/cluster/join?address=1.1.1.1", nil)
@@ -444,6 +700,42 @@ func TestClusterJoin(t *testing.T) {
 	}
 }
 
+func TestClusterJoinTunnel(t *testing.T) {
+	defer peerTunnels.reset()
+	daemon := NewDaemon()
+	request, _ := http.NewRequest("POST", "/v0.1/cluster/join?address=1.1.1.1&tunnel=gre&ttl=64", nil)
+	response := httptest.NewRecorder()
+
+	go createRouter(daemon).ServeHTTP(response, request)
+	<-daemon.bindChan
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+	tunnel := peerTunnels.get("1.1.1.1")
+	if tunnel.Type != TunnelGre || tunnel.TTL != 64 || tunnel.DstPort != 0 {
+		t.Fatalf("Unexpected tunnel options %+v", tunnel)
+	}
+}
+
+func TestClusterJoinInvalidTunnel(t *testing.T) {
+	defer peerTunnels.reset()
+	daemon := NewDaemon()
+	for _, query := range []string{"tunnel=ipip", "tunnel=gre&dst_port=4789", "ttl=foo", "dst_port=70000", "df_default=maybe"} {
+		request, _ := http.NewRequest("POST", "/v0.1/cluster/join?address=1.1.1.1&"+query, nil)
+		response := httptest.NewRecorder()
+
+		createRouter(daemon).ServeHTTP(response, request)
+
+		if response.Code != http.StatusBadRequest {
+			t.Fatalf("%s : Expected %v:\n\tReceived: %v", query, "400", response.Code)
+		}
+	}
+	if tunnels := peerTunnels.list(); len(tunnels) != 0 {
+		t.Fatalf("Invalid options should not be recorded : %v", tunnels)
+	}
+}
+
 func TestClusterJoiniBadIp(t *testing.T) {
 	daemon := NewDaemon()
 	request, _ := http.NewRequest("POST", "/v0.1/cluster/join?address=bar", nil)
@@ -493,7 +785,98 @@ func TestClusterJoinBadParams2(t *testing.T) {
 }
 
 func TestClusterLeave(t *testing.T) {
-	t.Skip("Not implemented")
+	daemon := NewDaemon()
+	request, _ := http.NewRequest("POST", "/v0.1/cluster/leave?force=true", nil)
+	response := httptest.NewRecorder()
+
+	go func() {
+		context := <-daemon.bindChan
+		if context.Action != ClusterLeave || context.Param != "force" {
+			context.Result <- errors.New("unexpected context")
+			return
+		}
+		context.Left = &ClusterLeaveResult{Containers: []string{"abc123"}, Tunnels: []string{"10.0.0.2"}}
+		context.Result <- nil
+	}()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+	result := &clusterLeaveResponse{}
+	if err := json.Unmarshal(response.Body.Bytes(), result); err != nil || result.Status != "OK" {
+		t.Fatal("body is not correct")
+	}
+	if len(result.Containers) != 1 || result.Containers[0] != "abc123" || len(result.Tunnels) != 1 || result.Tunnels[0] != "10.0.0.2" {
+		t.Fatalf("The detached containers and removed tunnels should be reported, got %s", response.Body.String())
+	}
+}
+
+func TestClusterLeaveConnectionsExist(t *testing.T) {
+	daemon := NewDaemon()
+	daemon.Connections["abc123"] = &Connection{
+		ContainerID:   "abc123",
+		ContainerName: "test_container",
+		ContainerPID:  "1234",
+		Network:       "default",
+	}
+	go ClusterRPCHandler(daemon)
+	request, _ := http.NewRequest("POST", "/v0.1/cluster/leave", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusConflict {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "409", response.Code)
+	}
+	if _, ok := daemon.Connections["abc123"]; !ok {
+		t.Fatal("connection should not be removed")
+	}
+}
+
+func TestClusterLeaveEndpointsExist(t *testing.T) {
+	defer useMemoryDatastore()()
+	daemon := NewDaemon()
+	putEndpoint(&driverEndpoint{ID: "e1", Network: "web", Host: clusterAddress}, nil)
+	go ClusterRPCHandler(daemon)
+	request, _ := http.NewRequest("POST", "/v0.1/cluster/leave", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusConflict {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "409", response.Code)
+	}
+	if _, _, err := getEndpoint("e1"); err != nil {
+		t.Fatal("endpoint should not be removed")
+	}
+}
+
+func TestClusterLeaveError(t *testing.T) {
+	daemon := NewDaemon()
+	request, _ := http.NewRequest("POST", "/v0.1/cluster/leave", nil)
+	response := httptest.NewRecorder()
+
+	go func() {
+		context := <-daemon.bindChan
+		context.Left = &ClusterLeaveResult{[]string{"abc123"}, []string{}, []string{"web"}, []string{"10.0.0.2"}}
+		context.Result <- errors.New("OVS not connected")
+	}()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "500", response.Code)
+	}
+	result := &clusterLeaveResponse{}
+	if err := json.Unmarshal(response.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "Error" || result.Message != "OVS not connected" || result.ClusterLeaveResult == nil ||
+		!reflect.DeepEqual(result.Tunnels, []string{"10.0.0.2"}) || !reflect.DeepEqual(result.Networks, []string{"web"}) {
+		t.Fatalf("The completed steps should be reported with the error, got %s", response.Body.String())
+	}
 }
 
 func TestClusterBind(t *testing.T) {
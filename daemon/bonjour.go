@@ -5,6 +5,7 @@ import (
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/bonjour"
+	"github.com/socketplane/socketplane/config"
 )
 
 const DOCKER_CLUSTER_SERVICE = "_docker._cluster"
@@ -12,10 +13,18 @@ const DOCKER_CLUSTER_SERVICE_PORT = 9999 //TODO : fix this
 const DOCKER_CLUSTER_DOMAIN = "local"
 
 func Bonjour(intfName string) {
+	serviceName := config.Cluster.ServiceName
+	if serviceName == "" {
+		serviceName = DOCKER_CLUSTER_SERVICE
+	}
+	servicePort := config.Cluster.ServicePort
+	if servicePort == 0 {
+		servicePort = DOCKER_CLUSTER_SERVICE_PORT
+	}
 	b := bonjour.Bonjour{
-		ServiceName:   DOCKER_CLUSTER_SERVICE,
+		ServiceName:   serviceName,
 		ServiceDomain: DOCKER_CLUSTER_DOMAIN,
-		ServicePort:   DOCKER_CLUSTER_SERVICE_PORT,
+		ServicePort:   servicePort,
 		InterfaceName: intfName,
 		BindToIntf:    true,
 		Notify:        notify{},
@@ -27,7 +36,10 @@ type notify struct{}
 
 func (n notify) NewMember(addr net.IP) {
 	log.Info("New Member Added : ", addr)
-	JoinDatastore(addr.String())
+	if err := JoinDatastore(addr.String()); err != nil {
+		log.Errorf("Unable to join %s : %v", addr, err)
+		return
+	}
 	AddPeer(addr.String())
 }
 func (n notify) RemoveMember(addr net.IP) {
@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
@@ -102,7 +103,7 @@ func GetAvailableSubnet() (subnet *net.IPNet, err error) {
 		if err != nil {
 			return &net.IPNet{}, err
 		}
-		if err = CheckRouteOverlaps(dockerNetwork); err == nil {
+		if err = CheckSubnetOverlaps(DefaultNetworkName, dockerNetwork, false); err == nil {
 			return dockerNetwork, nil
 		}
 	}
@@ -131,7 +132,7 @@ func CreateBridge() error {
 			return errors.New("Error creating Bridge")
 		}
 	}
-	return nil
+	return createTunnelBridge()
 }
 
 func createBridgeIface(name string) error {
@@ -143,40 +144,82 @@ func createBridgeIface(name string) error {
 	return nil
 }
 
+// AddPeer creates the tunnel to a peer with the tunnel options of the peer.
+// A tunnel of another type is replaced and the options of an existing tunnel
+// are updated.
 func AddPeer(peerIp string) error {
 	if ovs == nil {
 		return errors.New("OVS not connected")
 	}
-	addVxlanPort(ovs, OvsBridge.Name, "vxlan-"+peerIp, peerIp)
-	return nil
+	tunnel := peerTunnels.get(peerIp)
+	name := tunnelPortName(tunnel.Type, peerIp)
+	options := tunnel.ovsOptions(peerIp)
+	for port, peer := range tunnelPorts() {
+		if peer == peerIp && port != name {
+			deletePort(ovs, tunnelBridgeName, port)
+		}
+	}
+	if portUuidForName(name) == "" {
+		return addTunnelPort(ovs, tunnelBridgeName, name, tunnel.Type, options)
+	}
+	if intf, ok := interfaceForName(name); ok && tunnelMatches(intf, tunnel.Type, options) {
+		return nil
+	}
+	return setTunnelOptions(ovs, name, tunnel.Type, options)
 }
 
+// DeletePeer removes the tunnels to a peer, whatever their type
 func DeletePeer(peerIp string) error {
 	if ovs == nil {
 		return errors.New("OVS not connected")
 	}
-	deletePort(ovs, OvsBridge.Name, "vxlan-"+peerIp)
+	for port, peer := range tunnelPorts() {
+		if peer == peerIp {
+			deletePort(ovs, tunnelBridgeName, port)
+		}
+	}
 	return nil
 }
 
+// DeleteAllPeers removes every tunnel port from the tunnel bridge and returns
+// the addresses of the peers that were removed
+func DeleteAllPeers() ([]string, error) {
+	if ovs == nil {
+		return nil, errors.New("OVS not connected")
+	}
+	peers := []string{}
+	for port, peer := range tunnelPorts() {
+		peers = append(peers, peer)
+		deletePort(ovs, tunnelBridgeName, port)
+	}
+	return peers, nil
+}
+
 type OvsConnection struct {
-	Name    string `json:"name"`
-	Ip      string `json:"ip"`
-	Subnet  string `json:"subnet"`
-	Mac     string `json:"mac"`
-	Gateway string `json:"gateway"`
+	Name     string `json:"name"`
+	Ip       string `json:"ip"`
+	Subnet   string `json:"subnet"`
+	Mac      string `json:"mac"`
+	Gateway  string `json:"gateway"`
+	Ip6      string `json:"ip6,omitempty"`
+	Subnet6  string `json:"subnet6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
 }
 
 const (
 	ConnectionAdd    = iota
 	ConnectionUpdate = iota
 	ConnectionDelete = iota
+	// Releases the addresses allocated to connections that no longer exist
+	ConnectionReconcile = iota
 )
 
 type ConnectionContext struct {
 	Action     int
 	Connection *Connection
 	Result     chan *Connection
+	// Err reports why the connection could not be added
+	Err error
 }
 
 func ConnectionRPCHandler(d *Daemon) {
@@ -185,24 +228,99 @@ func ConnectionRPCHandler(d *Daemon) {
 
 		switch c.Action {
 		case ConnectionAdd:
-			pid, _ := strconv.Atoi(c.Connection.ContainerPID)
-			connDetails, _ := AddConnection(pid, c.Connection.Network)
+			var connDetails OvsConnection
+			targetns, err := connectionNamespace(c.Connection)
+			if err == nil {
+				connDetails, err = AddConnection(targetns, c.Connection.Network, c.Connection.ContainerID, c.Connection.RequestedIP, c.Connection.ContainerIfName)
+				targetns.Close()
+			}
+			if err != nil {
+				log.Errorf("Unable to connect container %s. %v", c.Connection.ContainerID, err)
+				DeleteConnection(connDetails)
+				releaseRequestedIP(c.Connection, connDetails)
+				c.Err = err
+				c.Result <- nil
+				continue
+			}
 			c.Connection.OvsPortID = connDetails.Name
 			c.Connection.ConnectionDetails = connDetails
-			d.Connections[c.Connection.ContainerID] = c.Connection
+			d.setConnection(c.Connection)
 			// ToDo: We should deprecate this when we have a proper CLI
 			c.Result <- c.Connection
 		case ConnectionUpdate:
 			// noop
 		case ConnectionDelete:
 			DeleteConnection(c.Connection.ConnectionDetails)
-			delete(d.Connections, c.Connection.ContainerID)
+			removeNetnsLink(c.Connection)
+			d.removeConnection(c.Connection.ContainerID)
 			c.Result <- c.Connection
+		case ConnectionReconcile:
+			reconcileAllocations(endpointConnections(d.connectionsSnapshot()))
+			c.Result <- nil
 		}
 	}
 }
 
-func AddConnection(nspid int, networkName string) (ovsConnection OvsConnection, err error) {
+// netnsDir holds the named network namespaces, as ip netns creates them
+var netnsDir = "/var/run/netns"
+
+// Filesystem magics of the namespace files, which older kernels serve from
+// procfs
+const (
+	nsfsMagic      = 0x6e736673
+	procSuperMagic = 0x9fa0
+)
+
+// connectionNamespace opens the network namespace of a connection: the
+// namespace at its netns path, the named namespace of that name, or else the
+// namespace of its container PID. The namespace is opened directly, without
+// linking it into netnsDir.
+func connectionNamespace(connection *Connection) (netns.NsHandle, error) {
+	path := connection.ContainerNetns
+	if path == "" {
+		if _, err := strconv.Atoi(connection.ContainerPID); err != nil {
+			return netns.None(), errors.New("Invalid container PID " + connection.ContainerPID)
+		}
+		procfs := os.Getenv("PROCFS")
+		if procfs == "" {
+			procfs = "/proc"
+		}
+		path = filepath.Join(procfs, connection.ContainerPID, "ns/net")
+	} else if !strings.Contains(path, "/") {
+		path = filepath.Join(netnsDir, path)
+	}
+	fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return netns.None(), err
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &stat); err != nil || (stat.Type != nsfsMagic && stat.Type != procSuperMagic) {
+		syscall.Close(fd)
+		return netns.None(), errors.New(path + " is not a namespace")
+	}
+	return netns.NsHandle(fd), nil
+}
+
+// removeNetnsLink removes the link to the namespace of the container PID that
+// earlier releases created in netnsDir for every connection
+func removeNetnsLink(connection *Connection) {
+	if connection.ContainerPID == "" {
+		return
+	}
+	link := filepath.Join(netnsDir, connection.ContainerPID)
+	target, err := os.Readlink(link)
+	if err != nil || target != filepath.Join(os.Getenv("PROCFS"), connection.ContainerPID, "ns/net") {
+		return
+	}
+	if err := os.Remove(link); err != nil {
+		log.Errorf("Unable to remove %s. %v", link, err)
+	}
+}
+
+// AddConnection attaches a container to a network, moving its port into the
+// target namespace where it is renamed ifName, if set. A requested address
+// must have been reserved with reserveRequestedIP.
+func AddConnection(targetns netns.NsHandle, networkName string, containerID string, requestedIP string, ifName string) (ovsConnection OvsConnection, err error) {
 	var (
 		bridge = OvsBridge.Name
 		prefix = "ovs"
@@ -224,22 +342,48 @@ func AddConnection(nspid int, networkName string) (ovsConnection OvsConnection,
 		return ovsConnection, err
 	}
 
-	portName, err := createOvsInternalPort(prefix, bridge, bridgeNetwork.Vlan)
+	vlan, err := realizeSegment(bridgeNetwork)
+	if err != nil {
+		return ovsConnection, err
+	}
+	portName, err := createOvsInternalPort(prefix, bridge, bridgeNetwork.ID, vlan)
 	if err != nil {
 		return
 	}
-	// Add a dummy sleep to make sure the interface is seen by the subsequent calls.
-	time.Sleep(time.Second * 1)
-
-	_, subnet, _ := net.ParseCIDR(bridgeNetwork.Subnet)
-
-	ip := IPAMRequest(*subnet)
-	mac := generateMacAddr(ip).String()
-
-	subnetString := subnet.String()
-	subnetPrefix := subnetString[len(subnetString)-3 : len(subnetString)]
+	if err = waitForLink(portName); err != nil {
+		return
+	}
 
-	ovsConnection = OvsConnection{portName, ip.String(), subnetPrefix, mac, bridgeNetwork.Gateway}
+	requested := net.ParseIP(requestedIP)
+	var ip, ip6 net.IP
+	ovsConnection = OvsConnection{Name: portName}
+	if bridgeNetwork.Subnet != "" {
+		_, subnet, _ := net.ParseCIDR(bridgeNetwork.Subnet)
+		ip = connectionAddress(*subnet, requested, networkName, containerID)
+		if ip == nil {
+			err = errors.New("No address available in " + subnet.String())
+			return
+		}
+		ovsConnection.Ip = ip.String()
+		ovsConnection.Subnet = prefixLength(subnet)
+		ovsConnection.Gateway = bridgeNetwork.Gateway
+	}
+	if bridgeNetwork.Subnet6 != "" {
+		_, subnet6, _ := net.ParseCIDR(bridgeNetwork.Subnet6)
+		ip6 = connectionAddress(*subnet6, requested, networkName, containerID)
+		if ip6 == nil {
+			err = errors.New("No address available in " + subnet6.String())
+			return
+		}
+		ovsConnection.Ip6 = ip6.String()
+		ovsConnection.Subnet6 = prefixLength(subnet6)
+		ovsConnection.Gateway6 = bridgeNetwork.Gateway6
+	}
+	mac := generateMacAddr(ip6)
+	if ip != nil {
+		mac = generateMacAddr(ip)
+	}
+	ovsConnection.Mac = mac.String()
 
 	if err = SetMtu(portName, mtu); err != nil {
 		return
@@ -248,11 +392,6 @@ func AddConnection(nspid int, networkName string) (ovsConnection OvsConnection,
 		return
 	}
 
-	if err = os.Symlink(filepath.Join(os.Getenv("PROCFS"), strconv.Itoa(nspid), "ns/net"),
-		filepath.Join("/var/run/netns", strconv.Itoa(nspid))); err != nil {
-		return
-	}
-
 	// Lock the OS Thread so we don't accidentally switch namespaces
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -263,12 +402,6 @@ func AddConnection(nspid int, networkName string) (ovsConnection OvsConnection,
 	}
 	defer origns.Close()
 
-	targetns, err := netns.GetFromName(strconv.Itoa(nspid))
-	if err != nil {
-		return
-	}
-	defer targetns.Close()
-
 	if err = SetInterfaceInNamespaceFd(portName, uintptr(int(targetns))); err != nil {
 		return
 	}
@@ -282,33 +415,114 @@ func AddConnection(nspid int, networkName string) (ovsConnection OvsConnection,
 		return
 	}
 
-	/* TODO : Find a way to change the interface name to defaultDevice (eth0).
-	   Currently using the Randomly created OVS port as is.
-	   refer to veth.go where one end of the veth pair is renamed to eth0
-	*/
-	if err = ChangeInterfaceName(portName, portName); err != nil {
+	// The port keeps the name of the OVS port unless another one is given
+	if ifName == "" {
+		ifName = portName
+	}
+	if err = ChangeInterfaceName(portName, ifName); err != nil {
 		return
 	}
 
-	if err = SetInterfaceIp(portName, ip.String()+subnetPrefix); err != nil {
-		return
+	if ip != nil {
+		if err = SetInterfaceIp(ifName, ovsConnection.Ip+ovsConnection.Subnet); err != nil {
+			return
+		}
 	}
 
-	if err = SetInterfaceMac(portName, generateMacAddr(ip).String()); err != nil {
-		return
+	if ip6 != nil {
+		if err = SetInterfaceIp(ifName, ovsConnection.Ip6+ovsConnection.Subnet6); err != nil {
+			return
+		}
 	}
 
-	if err = InterfaceUp(portName); err != nil {
+	if err = SetInterfaceMac(ifName, ovsConnection.Mac); err != nil {
 		return
 	}
 
-	if err = SetDefaultGateway(bridgeNetwork.Gateway, portName); err != nil {
+	if err = InterfaceUp(ifName); err != nil {
 		return
 	}
 
+	if ip != nil {
+		if err = SetDefaultGateway(bridgeNetwork.Gateway, ifName); err != nil {
+			return
+		}
+	}
+
+	if ip6 != nil {
+		if err = SetDefaultGateway(bridgeNetwork.Gateway6, ifName); err != nil {
+			return
+		}
+	}
+
 	return ovsConnection, nil
 }
 
+// connectionAddress returns the requested address if it belongs to the
+// subnet, as it was reserved beforehand, else allocates one
+func connectionAddress(subnet net.IPNet, requested net.IP, network string, containerID string) net.IP {
+	if requested != nil && subnet.Contains(requested) {
+		return requested
+	}
+	ip := IPAMRequest(subnet)
+	if ip != nil {
+		recordAllocation(ip, subnet, network, containerID)
+	}
+	return ip
+}
+
+func prefixLength(subnet *net.IPNet) string {
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("/%d", ones)
+}
+
+// requestedIPSubnet returns the address requested by a connection and the
+// subnet of its network that it belongs to
+func requestedIPSubnet(connection *Connection) (net.IP, *net.IPNet, error) {
+	network, err := GetNetwork(connection.Network)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip := net.ParseIP(connection.RequestedIP)
+	cidr := network.Subnet
+	if ip != nil && ip.To4() == nil {
+		cidr = network.Subnet6
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, ErrAddressNotInSubnet
+	}
+	return ip, subnet, nil
+}
+
+// reserveRequestedIP reserves the address requested by a connection in the
+// subnet of its network
+func reserveRequestedIP(connection *Connection) error {
+	ip, subnet, err := requestedIPSubnet(connection)
+	if err != nil {
+		return err
+	}
+	if err := IPAMRequestAddress(ip, *subnet); err != nil {
+		return err
+	}
+	recordAllocation(ip, *subnet, connection.Network, connection.ContainerID)
+	return nil
+}
+
+// releaseRequestedIP releases the address reserved for a connection that
+// could not be added, unless its port was given the address, which
+// DeleteConnection releases
+func releaseRequestedIP(connection *Connection, details OvsConnection) {
+	if connection.RequestedIP == "" {
+		return
+	}
+	ip, subnet, err := requestedIPSubnet(connection)
+	if err != nil || ip == nil || ip.String() == details.Ip || ip.String() == details.Ip6 {
+		return
+	}
+	IPAMRelease(ip, *subnet)
+}
+
 func UpdateConnectionContext(ovsPort string, key string, context string) error {
 	return UpdatePortContext(ovs, ovsPort, key, context)
 }
@@ -331,20 +545,31 @@ func populateContextCache() {
 	}
 }
 
+// DeleteConnection deletes the port of a connection, if it has one, and
+// releases its addresses
 func DeleteConnection(connection OvsConnection) error {
-	if ovs == nil {
-		return errors.New("OVS not connected")
+	if connection.Name != "" {
+		if ovs == nil {
+			return errors.New("OVS not connected")
+		}
+		deletePort(ovs, OvsBridge.Name, connection.Name)
+	}
+	if connection.Ip != "" {
+		if ip, subnet, err := net.ParseCIDR(connection.Ip + connection.Subnet); err == nil {
+			IPAMRelease(ip, *subnet)
+		}
+	}
+	if connection.Ip6 != "" {
+		if ip6, subnet6, err := net.ParseCIDR(connection.Ip6 + connection.Subnet6); err == nil {
+			IPAMRelease(ip6, *subnet6)
+		}
 	}
-	deletePort(ovs, OvsBridge.Name, connection.Name)
-	ip := net.ParseIP(connection.Ip)
-	_, subnet, _ := net.ParseCIDR(connection.Ip + connection.Subnet)
-	IPAMRelease(ip, *subnet)
 	return nil
 }
 
 // createOvsInternalPort will generate a random name for the
 // the port and ensure that it has been created
-func createOvsInternalPort(prefix string, bridge string, tag uint) (port string, err error) {
+func createOvsInternalPort(prefix string, bridge string, network string, tag uint) (port string, err error) {
 	if port, err = GenerateRandomName(prefix, 7); err != nil {
 		return
 	}
@@ -355,6 +580,7 @@ func createOvsInternalPort(prefix string, bridge string, tag uint) (port string,
 	}
 
 	AddInternalPort(ovs, bridge, port, tag)
+	err = SetPortExternalIds(ovs, port, map[string]string{SEGMENT_KEY: network})
 	return
 }
 
@@ -384,7 +610,13 @@ func generateMacAddr(ip net.IP) net.HardwareAddr {
 
 	// Insert the IP address into the last 32 bits of the MAC address.
 	// This is a simple way to guarantee the address will be consistent and unique.
-	copy(hw[2:], ip.To4())
+	// IPv6 addresses use their last 32 bits in a separate OUI.
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(hw[2:], ip4)
+	} else {
+		hw[1] = 0x43
+		copy(hw[2:], ip.To16()[12:])
+	}
 
 	return hw
 }
@@ -402,9 +634,10 @@ func setupIPTables(bridgeName string, bridgeIP string) error {
 	*/
 
 	log.Debug("Setting up iptables")
+	cmd := iptablesCmd(bridgeIP)
 	natArgs := []string{"-s", bridgeIP, "!", "-o", bridgeName, "-j", "MASQUERADE"}
-	if !ruleExists("nat", "POSTROUTING", natArgs...) {
-		output, err := installRule(append([]string{
+	if !ruleExists(cmd, "nat", "POSTROUTING", natArgs...) {
+		output, err := installRule(cmd, append([]string{
 			"-t", "nat", "-A", "POSTROUTING"}, natArgs...)...)
 		if err != nil {
 			log.Debugf("Unable to enable network bridge NAT: %s", err)
@@ -417,8 +650,8 @@ func setupIPTables(bridgeName string, bridgeIP string) error {
 	}
 
 	outboundArgs := []string{"-i", bridgeName, "!", "-o", bridgeName, "-j", "ACCEPT"}
-	if !ruleExists("", "FORWARD", outboundArgs...) {
-		output, err := installRule(append([]string{
+	if !ruleExists(cmd, "", "FORWARD", outboundArgs...) {
+		output, err := installRule(cmd, append([]string{
 			"-A", "FORWARD"}, outboundArgs...)...)
 		if err != nil {
 			log.Debugf("Unable to enable network outbound forwarding: %s", err)
@@ -431,8 +664,8 @@ func setupIPTables(bridgeName string, bridgeIP string) error {
 	}
 
 	inboundArgs := []string{"-o", bridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}
-	if !ruleExists("", "FORWARD", inboundArgs...) {
-		output, err := installRule(append([]string{
+	if !ruleExists(cmd, "", "FORWARD", inboundArgs...) {
+		output, err := installRule(cmd, append([]string{
 			"-A", "FORWARD"}, inboundArgs...)...)
 		if err != nil {
 			log.Debugf("Unable to enable network inbound forwarding: %s", err)
@@ -446,8 +679,42 @@ func setupIPTables(bridgeName string, bridgeIP string) error {
 	return nil
 }
 
+// teardownIPTables removes the rules installed by setupIPTables
+func teardownIPTables(bridgeName string, bridgeIP string) error {
+	rules := []struct {
+		table string
+		chain string
+		args  []string
+	}{
+		{"nat", "POSTROUTING", []string{"-s", bridgeIP, "!", "-o", bridgeName, "-j", "MASQUERADE"}},
+		{"filter", "FORWARD", []string{"-i", bridgeName, "!", "-o", bridgeName, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-o", bridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	}
+
+	log.Debug("Removing iptables rules for ", bridgeName)
+	cmd := iptablesCmd(bridgeIP)
+	for _, rule := range rules {
+		if !ruleExists(cmd, rule.table, rule.chain, rule.args...) {
+			continue
+		}
+		if _, err := installRule(cmd, append([]string{
+			"-t", rule.table, "-D", rule.chain}, rule.args...)...); err != nil {
+			return fmt.Errorf("Unable to remove iptables rule: %s", err)
+		}
+	}
+	return nil
+}
+
+// iptablesCmd returns the iptables command for the family of a subnet
+func iptablesCmd(subnet string) string {
+	if ip, _, err := net.ParseCIDR(subnet); err == nil && ip.To4() == nil {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
 // Check if a rule exists
-func ruleExists(table string, chain string, rule ...string) bool {
+func ruleExists(cmd string, table string, chain string, rule ...string) bool {
 	if string(table) == "" {
 		table = "filter"
 	}
@@ -457,7 +724,7 @@ func ruleExists(table string, chain string, rule ...string) bool {
 
 	// try -C
 	// if exit status is 0 then return true, the rule exists
-	if _, err := installRule(append([]string{
+	if _, err := installRule(cmd, append([]string{
 		"-t", table, "-C", chain}, rule...)...); err == nil {
 		return true
 	}
@@ -467,20 +734,64 @@ func ruleExists(table string, chain string, rule ...string) bool {
 
 	ruleString := strings.Join(rule, " ")
 	args := []string{"-t", table, "-S", chain}
-	existingRules, _ := installRule(args...)
+	existingRules, _ := installRule(cmd, args...)
 
 	return strings.Contains(string(existingRules), ruleString)
 }
 
-func installRule(args ...string) ([]byte, error) {
-	path, err := exec.LookPath("iptables")
+func installRule(cmd string, args ...string) ([]byte, error) {
+	path, err := exec.LookPath(cmd)
+	if err != nil {
+		return nil, errors.New(cmd + " not found")
+	}
+
+	output, err := exec.Command(path, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s %v: %s (%s)", cmd, cmd, strings.Join(args, " "), output, err)
+	}
+
+	return output, err
+}
+
+// addGatewayFlows keeps the anycast gateway of a network local to each host.
+// Frames from remote hosts arrive from the tunnel bridge with the local VLAN
+// tag of the network, while the ones from local ports are untagged. Dropping
+// the tagged frames sourced by the gateway MAC and the tagged ARP requests for
+// the gateway address suppresses the cross-host gateway ARP and MAC learning.
+// The IPv6 neighbor solicitations for the gateway are dropped alike.
+func addGatewayFlows(bridgeName string, vlan uint, gateway net.IP, gateway6 net.IP, mac net.HardwareAddr) error {
+	cookie := fmt.Sprintf("cookie=%#x,priority=100,dl_vlan=%d", flowCookie(gatewayCookie, vlan), vlan)
+	flows := []string{
+		fmt.Sprintf("%s,dl_src=%s,actions=drop", cookie, mac.String()),
+	}
+	if gateway != nil {
+		flows = append(flows, fmt.Sprintf("%s,arp,arp_tpa=%s,actions=drop", cookie, gateway.String()))
+	}
+	if gateway6 != nil {
+		flows = append(flows, fmt.Sprintf("%s,icmp6,icmp_type=135,nd_target=%s,actions=drop", cookie, gateway6.String()))
+	}
+	for _, flow := range flows {
+		if _, err := ofctl("add-flow", bridgeName, flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteGatewayFlows(bridgeName string, vlan uint) error {
+	_, err := ofctl("del-flows", bridgeName, fmt.Sprintf("cookie=%#x/-1", flowCookie(gatewayCookie, vlan)))
+	return err
+}
+
+func ofctl(args ...string) ([]byte, error) {
+	path, err := exec.LookPath("ovs-ofctl")
 	if err != nil {
-		return nil, errors.New("iptables not found")
+		return nil, errors.New("ovs-ofctl not found")
 	}
 
 	output, err := exec.Command(path, args...).CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("iptables failed: iptables %v: %s (%s)", strings.Join(args, " "), output, err)
+		return nil, fmt.Errorf("ovs-ofctl failed: ovs-ofctl %v: %s (%s)", strings.Join(args, " "), output, err)
 	}
 
 	return output, err
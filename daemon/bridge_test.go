@@ -2,7 +2,11 @@ package daemon
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 )
 
@@ -107,3 +111,76 @@ func TestGenerateMacAddress(t *testing.T) {
 		t.Fatal("remaning bytes should be ipv4 address")
 	}
 }
+
+func TestGenerateMacAddressIPv6(t *testing.T) {
+	ip := net.ParseIP("fd00::a:b")
+	mac := generateMacAddr(ip)
+	if mac[0] != 0x02 || mac[1] != 0x43 {
+		t.Fatal("IPv6 addresses should use the 02:43 prefix")
+	}
+	if !bytes.Equal(mac[2:], ip[12:]) {
+		t.Fatal("remaning bytes should be the last 32 bits of the ipv6 address")
+	}
+}
+
+func withNetnsDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := netnsDir
+	netnsDir = dir
+	return dir, func() {
+		netnsDir = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConnectionNamespace(t *testing.T) {
+	dir, cleanup := withNetnsDir(t)
+	defer cleanup()
+	os.Symlink("/proc/self/ns/net", filepath.Join(dir, "web"))
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+
+	for _, connection := range []*Connection{
+		{ContainerNetns: "/proc/self/ns/net"},
+		{ContainerNetns: "web"},
+		{ContainerPID: strconv.Itoa(os.Getpid())},
+	} {
+		ns, err := connectionNamespace(connection)
+		if err != nil || !ns.IsOpen() {
+			t.Fatalf("%+v : the namespace should be opened. %v", connection, err)
+		}
+		ns.Close()
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Fatal("No namespace link should be created")
+	}
+	for _, connection := range []*Connection{
+		{ContainerNetns: "/proc/self/ns/none"},
+		{ContainerNetns: "db"},
+		{ContainerNetns: "file"},
+		{ContainerPID: "abc"},
+	} {
+		if _, err := connectionNamespace(connection); err == nil {
+			t.Fatalf("%+v : opening the namespace should fail", connection)
+		}
+	}
+}
+
+func TestRemoveNetnsLink(t *testing.T) {
+	dir, cleanup := withNetnsDir(t)
+	defer cleanup()
+	os.Symlink(filepath.Join(os.Getenv("PROCFS"), "1234", "ns/net"), filepath.Join(dir, "1234"))
+	os.Symlink("/proc/self/ns/net", filepath.Join(dir, "5678"))
+
+	removeNetnsLink(&Connection{ContainerPID: "1234"})
+	removeNetnsLink(&Connection{ContainerPID: "5678"})
+	removeNetnsLink(&Connection{ContainerNetns: "web"})
+	if _, err := os.Lstat(filepath.Join(dir, "1234")); !os.IsNotExist(err) {
+		t.Fatal("The link of the connection should be removed")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "5678")); err != nil {
+		t.Fatal("Other links should be kept")
+	}
+}
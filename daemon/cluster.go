@@ -0,0 +1,137 @@
+package daemon
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MemberAlive = "alive"
+	MemberLeft  = "left"
+)
+
+type ClusterInfo struct {
+	BindInterface    string               `json:"bind_interface"`
+	Bootstrap        bool                 `json:"bootstrap"`
+	Members          []ClusterMember      `json:"members"`
+	TunnelReconciler TunnelReconcileStats `json:"tunnel_reconciler"`
+}
+
+type ClusterMember struct {
+	Address    string       `json:"address"`
+	Status     string       `json:"status"`
+	LastUpdate time.Time    `json:"last_update"`
+	Tunnel     TunnelStatus `json:"tunnel"`
+}
+
+type TunnelStatus struct {
+	Port      string `json:"port"`
+	Exists    bool   `json:"exists"`
+	Healthy   bool   `json:"healthy"`
+	Degraded  bool   `json:"degraded"`
+	LinkState string `json:"link_state,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// memberList tracks the cluster membership as reported by the datastore
+// node updates
+type memberList struct {
+	sync.Mutex
+	members map[string]*ClusterMember
+}
+
+var clusterMembers = &memberList{members: make(map[string]*ClusterMember)}
+
+func (m *memberList) update(address string, status string) {
+	m.Lock()
+	defer m.Unlock()
+	m.members[address] = &ClusterMember{
+		Address:    address,
+		Status:     status,
+		LastUpdate: time.Now(),
+	}
+}
+
+func (m *memberList) reset() {
+	m.Lock()
+	m.members = make(map[string]*ClusterMember)
+	m.Unlock()
+}
+
+// list returns the members sorted by address along with the status of
+// the tunnel to each of them
+func (m *memberList) list() []ClusterMember {
+	m.Lock()
+	members := make([]ClusterMember, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	m.Unlock()
+
+	sort.Sort(byAddress(members))
+	for i := range members {
+		members[i].Tunnel = getTunnelStatus(members[i].Address)
+	}
+	return members
+}
+
+// alive returns the alive members other than address, by address
+func (m *memberList) alive(address string) []string {
+	m.Lock()
+	defer m.Unlock()
+	alive := []string{}
+	for _, member := range m.members {
+		if member.Status == MemberAlive && member.Address != address {
+			alive = append(alive, member.Address)
+		}
+	}
+	sort.Strings(alive)
+	return alive
+}
+
+// successor returns the first alive member other than address, by address
+func (m *memberList) successor(address string) (string, bool) {
+	alive := m.alive(address)
+	if len(alive) == 0 {
+		return "", false
+	}
+	return alive[0], true
+}
+
+type byAddress []ClusterMember
+
+func (b byAddress) Len() int           { return len(b) }
+func (b byAddress) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byAddress) Less(i, j int) bool { return b[i].Address < b[j].Address }
+
+func (d *Daemon) ClusterInfo() *ClusterInfo {
+	return &ClusterInfo{
+		BindInterface:    d.clusterListener,
+		Bootstrap:        d.bootstrapNode,
+		Members:          clusterMembers.list(),
+		TunnelReconciler: tunnelMetrics.get(),
+	}
+}
+
+// getTunnelStatus looks up the tunnel port for a peer in the OVS cache.
+// A tunnel is healthy when OVS reports no error, its link is not down and
+// the peer replies to the probes of its underlay address.
+func getTunnelStatus(peer string) TunnelStatus {
+	status := TunnelStatus{Port: tunnelPortForPeer(peer)}
+	if reachability, ok := peerReachability.get(peer); ok {
+		status.Degraded = reachability.Degraded
+	}
+	if portUuidForName(status.Port) == "" {
+		return status
+	}
+	status.Exists = true
+	intf, ok := interfaceForName(status.Port)
+	if !ok {
+		return status
+	}
+	status.LinkState = ovsStringField(intf, "link_state")
+	status.Error = ovsStringField(intf, "error")
+	status.Healthy = status.Error == "" && status.LinkState != "down" && !status.Degraded
+	return status
+}
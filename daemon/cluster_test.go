@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/libovsdb"
+)
+
+func withOvsCache(rows map[string]map[string]libovsdb.Row) func() {
+	orig := cache
+	cache = rows
+	return func() { cache = orig }
+}
+
+func tunnelCache() map[string]map[string]libovsdb.Row {
+	emptySet, _ := libovsdb.NewOvsSet([]string{})
+	return map[string]map[string]libovsdb.Row{
+		"Port": {
+			"p1": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.2"}},
+			"p2": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.3"}},
+		},
+		"Interface": {
+			"i1": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.2", "link_state": "up", "error": *emptySet}},
+			"i2": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.3", "link_state": "down", "error": *emptySet}},
+		},
+	}
+}
+
+func TestGetTunnelStatus(t *testing.T) {
+	defer withOvsCache(tunnelCache())()
+
+	status := getTunnelStatus("10.0.0.2")
+	if !status.Exists || !status.Healthy || status.LinkState != "up" {
+		t.Fatalf("tunnel should be up and healthy : %+v", status)
+	}
+	status = getTunnelStatus("10.0.0.3")
+	if !status.Exists || status.Healthy {
+		t.Fatalf("tunnel should exist and be unhealthy : %+v", status)
+	}
+	status = getTunnelStatus("10.0.0.4")
+	if status.Exists || status.Healthy || status.Port != "vxlan-10.0.0.4" {
+		t.Fatalf("tunnel should not exist : %+v", status)
+	}
+}
+
+func TestGetClusterApi(t *testing.T) {
+	defer withOvsCache(tunnelCache())()
+	defer clusterMembers.reset()
+
+	clusterMembers.update("10.0.0.3", MemberLeft)
+	clusterMembers.update("10.0.0.2", MemberAlive)
+
+	daemon := NewDaemon()
+	daemon.clusterListener = "eth1"
+	daemon.bootstrapNode = true
+	request, _ := http.NewRequest("GET", "/v0.1/cluster", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+	info := &ClusterInfo{}
+	if err := json.Unmarshal(response.Body.Bytes(), info); err != nil {
+		t.Fatal(err)
+	}
+	if info.BindInterface != "eth1" || !info.Bootstrap {
+		t.Fatal("cluster info is incorrect")
+	}
+	if len(info.Members) != 2 || info.Members[0].Address != "10.0.0.2" {
+		t.Fatal("members should be sorted by address")
+	}
+	if info.Members[0].Status != MemberAlive || !info.Members[0].Tunnel.Healthy {
+		t.Fatal("member 10.0.0.2 should be alive with a healthy tunnel")
+	}
+	if info.Members[1].Status != MemberLeft || info.Members[1].Tunnel.Healthy {
+		t.Fatal("member 10.0.0.3 should have left")
+	}
+}
+
+func TestGetClusterMembersApi(t *testing.T) {
+	defer withOvsCache(tunnelCache())()
+	defer clusterMembers.reset()
+
+	clusterMembers.update("10.0.0.2", MemberAlive)
+
+	daemon := NewDaemon()
+	request, _ := http.NewRequest("GET", "/v0.1/cluster/members", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+	members := []ClusterMember{}
+	if err := json.Unmarshal(response.Body.Bytes(), &members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Tunnel.Port != "vxlan-10.0.0.2" || !members[0].Tunnel.Exists {
+		t.Fatal("members are incorrect")
+	}
+}
@@ -3,10 +3,11 @@ package daemon
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
 	"time"
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
@@ -22,6 +23,7 @@ type Daemon struct {
 	clusterListener string
 	serialChan      chan bool
 	bootstrapNode   bool
+	stateFile       string
 }
 
 func NewDaemon() *Daemon {
@@ -33,6 +35,7 @@ func NewDaemon() *Daemon {
 		"",
 		make(chan bool),
 		false,
+		clusterStateFile,
 	}
 }
 
@@ -45,8 +48,23 @@ const (
 type ClusterContext struct {
 	Param  string
 	Action int
+	Result chan error
+	// Left reports what leaving the cluster tore down
+	Left *ClusterLeaveResult
 }
 
+// ClusterLeaveResult lists the containers detached, the Docker endpoints
+// deleted, the networks handed off to another host and the peers whose
+// tunnels were removed when this host left the cluster
+type ClusterLeaveResult struct {
+	Containers []string `json:"containers"`
+	Endpoints  []string `json:"endpoints"`
+	Networks   []string `json:"networks"`
+	Tunnels    []string `json:"tunnels"`
+}
+
+var ErrConnectionsExist = errors.New("Containers are still connected to this host")
+
 func Initialize() {
 	OvsInit()
 }
@@ -71,8 +89,32 @@ func (d *Daemon) Run(ctx *cli.Context) {
 	}
 	d.bootstrapNode = isBootstrapNode(ctx)
 
-	if err := os.Mkdir("/var/run/netns", 0777); err != nil {
-		fmt.Println("mkdir /var/run/netns failed", err)
+	ds, err := NewDatastore(config.Daemon.Datastore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetDatastore(ds)
+	ipam, err := NewIPAMDriver(config.IPAM.Driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetIPAMDriver(ipam)
+	// Every host converges its gateways with the networks in the datastore
+	datastore.WatchStore(networkStore, listener)
+	// and migrates the networks to VNIs as the last host is upgraded
+	datastore.WatchStore(vniHostStore, listener)
+	if config.Cluster.DataDir != "" {
+		dataDir = config.Cluster.DataDir
+	}
+
+	state, err := loadClusterState(d.stateFile)
+	if err != nil {
+		log.Errorf("Unable to load the cluster state from %s. %v", d.stateFile, err)
+		state = &ClusterState{}
+	}
+	if len(state.Peers) > 0 {
+		// This node had joined an existing cluster
+		d.bootstrapNode = false
 	}
 
 	go ServeAPI(d)
@@ -81,6 +123,7 @@ func (d *Daemon) Run(ctx *cli.Context) {
 		if ctx.String("iface") != "auto" {
 			bindInterface = ctx.String("iface")
 		} else {
+			d.clusterListener = restoredBindInterface(state, config.Cluster.Iface)
 			intf := d.identifyInterfaceToBind()
 			if intf != nil {
 				bindInterface = intf.Name
@@ -93,7 +136,14 @@ func (d *Daemon) Run(ctx *cli.Context) {
 			log.Errorf("Unable to identify any Interface to Bind to. Going with Defaults")
 		}
 		InitDatastore(bindInterface, d.bootstrapNode)
-		Bonjour(bindInterface)
+		for peer, tunnel := range state.Tunnels {
+			peerTunnels.set(peer, tunnel)
+		}
+		peers := append([]string{}, config.Cluster.Peers...)
+		d.joinPeers(append(peers, state.Peers...))
+		if len(state.Peers) == 0 && config.Cluster.Bonjour {
+			Bonjour(bindInterface)
+		}
 		if !d.bootstrapNode {
 			d.serialChan <- true
 		}
@@ -107,6 +157,9 @@ func (d *Daemon) Run(ctx *cli.Context) {
 			<-d.serialChan
 			log.Printf("Non-Bootstrap node admitted into cluster")
 		}
+		if err := migrateNetworkVnis(); err != nil {
+			log.Error(err)
+		}
 		err := CreateBridge()
 		if err != nil {
 			log.Error(err.Error)
@@ -116,6 +169,11 @@ func (d *Daemon) Run(ctx *cli.Context) {
 		if err != nil {
 			log.Error(err.Error)
 		}
+		go d.reconcileTunnels()
+		go d.monitorPeers()
+		go d.watchDockerEvents()
+		go d.servePlugin()
+		d.reconcileAllocations()
 	}()
 
 	go ConnectionRPCHandler(d)
@@ -141,17 +199,25 @@ func (d *Daemon) ConfigureClusterListenerPort(listen string) error {
 		return errors.New("Interface is down")
 	}
 	log.Debugf("Requesting to bind to %s", listen)
-	context := &ClusterContext{listen, ClusterBind}
+	context := &ClusterContext{listen, ClusterBind, nil, nil}
 	d.bindChan <- context
 	return nil
 }
 
-func (d *Daemon) JoinCluster(address string) error {
+// JoinCluster joins the cluster at address. Tunnel options, if any, replace
+// the cluster-wide tunnel options for the tunnel to this peer.
+func (d *Daemon) JoinCluster(address string, tunnel TunnelOptions) error {
 	if addr := net.ParseIP(address); addr == nil {
 		return errors.New("Invalid IP address")
 	}
+	if err := tunnel.validate(); err != nil {
+		return err
+	}
+	if !tunnel.empty() {
+		peerTunnels.set(address, tunnel)
+	}
 	log.Debugf("Requesting to join cluster %s", address)
-	context := &ClusterContext{address, ClusterJoin}
+	context := &ClusterContext{address, ClusterJoin, nil, nil}
 	d.bindChan <- context
 	return nil
 }
@@ -173,9 +239,13 @@ func ClusterRPCHandler(d *Daemon) {
 				break
 			}
 		case ClusterLeave:
-			if err := LeaveDatastore(); err != nil {
+			left, err := clusterLeaveRPC(d, context.Param == "force")
+			if err != nil {
 				log.Errorf("Error leaving cluster. %s", err.Error())
-				break
+			}
+			context.Left = left
+			if context.Result != nil {
+				context.Result <- err
 			}
 		}
 	}
@@ -197,6 +267,11 @@ func clusterBindRPC(d *Daemon, bindInterface string) error {
 	d.clusterListener = bindInterface
 	InitDatastore(d.clusterListener, d.bootstrapNode)
 
+	// Binding to a new interface leaves any previously joined cluster
+	if err := saveClusterState(d.stateFile, &ClusterState{BindInterface: bindInterface}); err != nil {
+		log.Errorf("Unable to save the cluster state. %v", err)
+	}
+
 	if !d.bootstrapNode && once {
 		d.serialChan <- true
 	}
@@ -219,10 +294,130 @@ func clusterJoinRPC(d *Daemon, joinAddress string) error {
 	}
 	if err = JoinDatastore(joinAddress); err != nil {
 		log.Errorf("Could not join cluster %s. %s", joinAddress, err.Error())
+		return nil
+	}
+	d.recordPeer(joinAddress)
+	// The peer may be a member already, in which case no event creates the
+	// tunnel with its new options
+	if _, ok := peerTunnels.list()[joinAddress]; ok {
+		if err := AddPeer(joinAddress); err != nil {
+			log.Errorf("Unable to update the tunnel to %s. %v", joinAddress, err)
+		}
 	}
 	return nil
 }
 
+func (d *Daemon) recordPeer(joinAddress string) {
+	state, err := loadClusterState(d.stateFile)
+	if err != nil {
+		log.Errorf("Unable to load the cluster state. %v", err)
+		state = &ClusterState{}
+	}
+	state.BindInterface = d.clusterListener
+	state.addPeer(joinAddress)
+	state.Tunnels = peerTunnels.list()
+	if err := saveClusterState(d.stateFile, state); err != nil {
+		log.Errorf("Unable to save the cluster state. %v", err)
+	}
+}
+
+// joinPeers joins the configured seed peers and the peers that were
+// recorded before a restart
+func (d *Daemon) joinPeers(peers []string) {
+	joined := make(map[string]bool)
+	for _, peer := range peers {
+		if joined[peer] {
+			continue
+		}
+		joined[peer] = true
+		log.Infof("Joining cluster peer %s", peer)
+		if err := JoinDatastore(peer); err != nil {
+			log.Errorf("Could not join cluster peer %s. %s", peer, err.Error())
+		}
+	}
+}
+
+func (d *Daemon) LeaveCluster(force bool) (*ClusterLeaveResult, error) {
+	param := ""
+	if force {
+		param = "force"
+	}
+	log.Debugf("Requesting to leave the cluster")
+	context := &ClusterContext{param, ClusterLeave, make(chan error), nil}
+	d.bindChan <- context
+	err := <-context.Result
+	return context.Left, err
+}
+
+// clusterLeaveRPC decommissions this host. Local connections and endpoints are
+// detached (releasing their IPAM allocations) only when force is set, else the
+// leave is refused. The networks that have their gateway on this host are
+// handed off to another member, and all the tunnels to the peers are removed
+// before leaving the datastore.
+func clusterLeaveRPC(d *Daemon, force bool) (*ClusterLeaveResult, error) {
+	connections := d.connectionsSnapshot()
+	endpoints := localEndpoints()
+	if (len(connections) > 0 || len(endpoints) > 0) && !force {
+		return nil, ErrConnectionsExist
+	}
+	left := &ClusterLeaveResult{[]string{}, []string{}, []string{}, []string{}}
+	for id, connection := range connections {
+		log.Debugf("Detaching container %s", id)
+		context := &ConnectionContext{
+			ConnectionDelete,
+			connection,
+			make(chan *Connection),
+			nil,
+		}
+		d.cC <- context
+		<-context.Result
+		left.Containers = append(left.Containers, id)
+	}
+	sort.Strings(left.Containers)
+	for _, endpoint := range endpoints {
+		log.Debugf("Deleting endpoint %s", endpoint.ID)
+		if err := deleteEndpoint(endpoint); err != nil {
+			return left, err
+		}
+		left.Endpoints = append(left.Endpoints, endpoint.ID)
+	}
+	if host, ok := clusterMembers.successor(clusterAddress); ok {
+		networks, err := handOffNetworks(host)
+		left.Networks = networks
+		if err != nil {
+			return left, err
+		}
+	}
+	peers, err := DeleteAllPeers()
+	if err != nil {
+		return left, err
+	}
+	sort.Strings(peers)
+	left.Tunnels = peers
+	log.Debugf("Removed tunnels to %v", peers)
+	if err := LeaveDatastore(); err != nil {
+		return left, err
+	}
+	d.clusterListener = ""
+	peerTunnels.reset()
+	return left, removeClusterState(d.stateFile)
+}
+
+// restoredBindInterface returns the interface the cluster was bound to before
+// a restart, or iface if there is none. An interface that was renamed or
+// removed since is not waited for but identified again.
+func restoredBindInterface(state *ClusterState, iface string) string {
+	if state.BindInterface == "" {
+		return iface
+	}
+	if _, err := net.InterfaceByName(state.BindInterface); err != nil {
+		log.Warnf("Cluster bind interface %s no longer exists. %v", state.BindInterface, err)
+		return iface
+	}
+	log.Infof("Restoring cluster bind interface %s", state.BindInterface)
+	return state.BindInterface
+}
+
 func (d *Daemon) identifyInterfaceToBind() *net.Interface {
 	// If the user isnt binding an interface using --iface option and let the daemon to
 	// identify the interface, the daemon will try its best to identify the best interface
@@ -246,7 +441,48 @@ func (d *Daemon) identifyInterfaceToBind() *net.Interface {
 	return nil
 }
 
+// reconcileAllocations periodically releases the addresses leaked by
+// connections that were not cleaned up, e.g. after a crash
+func (d *Daemon) reconcileAllocations() {
+	for {
+		context := &ConnectionContext{
+			ConnectionReconcile,
+			nil,
+			make(chan *Connection),
+			nil,
+		}
+		d.cC <- context
+		<-context.Result
+		time.Sleep(ipamReconcileInterval)
+	}
+}
+
+// reconcileTunnels periodically makes the tunnels match the cluster members,
+// e.g. after membership events were missed during a restart
+func (d *Daemon) reconcileTunnels() {
+	for {
+		time.Sleep(tunnelReconcileInterval)
+		runTunnelReconcile()
+	}
+}
+
+// monitorPeers periodically probes the underlay address of the peers
+func (d *Daemon) monitorPeers() {
+	if config.Monitor.Interval <= 0 {
+		log.Info("Peer reachability monitoring disabled")
+		return
+	}
+	for {
+		time.Sleep(time.Duration(config.Monitor.Interval) * time.Second)
+		if err := probePeers(); err != nil {
+			log.Errorf("Unable to probe the peers. %v", err)
+		}
+	}
+}
+
 func (d *Daemon) populateConnections() {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
 	for key, val := range ContextCache {
 		connection := &Connection{}
 		err := json.Unmarshal([]byte(val), connection)
@@ -255,3 +491,38 @@ func (d *Daemon) populateConnections() {
 		}
 	}
 }
+
+// connectionsLock guards the connections of the daemon. They are written by
+// ConnectionRPCHandler but read by the API, the plugins and the watchers.
+var connectionsLock sync.Mutex
+
+// connection returns the connection of a container
+func (d *Daemon) connection(containerID string) (*Connection, bool) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	connection, ok := d.Connections[containerID]
+	return connection, ok
+}
+
+// connectionsSnapshot returns a copy of the connections of the daemon
+func (d *Daemon) connectionsSnapshot() map[string]*Connection {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	connections := make(map[string]*Connection, len(d.Connections))
+	for id, connection := range d.Connections {
+		connections[id] = connection
+	}
+	return connections
+}
+
+func (d *Daemon) setConnection(connection *Connection) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	d.Connections[connection.ContainerID] = connection
+}
+
+func (d *Daemon) removeConnection(containerID string) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	delete(d.Connections, containerID)
+}
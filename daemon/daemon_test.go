@@ -2,7 +2,11 @@ package daemon
 
 import (
 	"flag"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -49,6 +53,8 @@ func TestDaemonRun(t *testing.T) {
 
 func TestClusterBindRPC(t *testing.T) {
 	d := NewDaemon()
+	d.stateFile = testStateFile(t)
+	defer os.RemoveAll(filepath.Dir(d.stateFile))
 	d.clusterListener = "foo1"
 	err := clusterBindRPC(d, "foo1")
 	if err == nil {
@@ -62,11 +68,17 @@ func TestClusterBindRPC(t *testing.T) {
 	if d.clusterListener != "eth0" {
 		t.Fatal("field not updated")
 	}
+	state, err := loadClusterState(d.stateFile)
+	if err != nil || state.BindInterface != "eth0" {
+		t.Fatal("bind interface not saved")
+	}
 	LeaveDatastore()
 }
 
 func TestClusterJoinRPC(t *testing.T) {
 	d := NewDaemon()
+	d.stateFile = testStateFile(t)
+	defer os.RemoveAll(filepath.Dir(d.stateFile))
 	err := clusterJoinRPC(d, "foobar")
 	if err == nil {
 		t.Fatal("this should not work")
@@ -81,6 +93,65 @@ func TestClusterJoinRPC(t *testing.T) {
 	LeaveDatastore()
 }
 
+func testStateFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "socketplane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "cluster.json")
+}
+
+func TestClusterState(t *testing.T) {
+	path := testStateFile(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	state, err := loadClusterState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.BindInterface != "" || len(state.Peers) != 0 {
+		t.Fatal("missing state file should load an empty state")
+	}
+
+	state.BindInterface = "eth1"
+	state.addPeer("10.0.0.1")
+	state.addPeer("10.0.0.2")
+	state.addPeer("10.0.0.1")
+	if err := saveClusterState(path, state); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = loadClusterState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.BindInterface != "eth1" {
+		t.Fatal("bind interface not restored")
+	}
+	if !reflect.DeepEqual(state.Peers, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("peers not restored correctly : %v", state.Peers)
+	}
+
+	if err := removeClusterState(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("state file should be removed")
+	}
+}
+
+func TestRestoredBindInterface(t *testing.T) {
+	if iface := restoredBindInterface(&ClusterState{}, "eth1"); iface != "eth1" {
+		t.Fatalf("Expected the configured interface eth1, got %q", iface)
+	}
+	if iface := restoredBindInterface(&ClusterState{BindInterface: "lo"}, "eth1"); iface != "lo" {
+		t.Fatalf("Expected the restored interface lo, got %q", iface)
+	}
+	if iface := restoredBindInterface(&ClusterState{BindInterface: "nosuchiface0"}, ""); iface != "" {
+		t.Fatalf("A missing restored interface should be identified again, got %q", iface)
+	}
+}
+
 //ToDo: @mavenugo to write this test
 func TestPopulateConnection(t *testing.T) {
 	t.Skip("")
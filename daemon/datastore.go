@@ -1,54 +1,130 @@
 package daemon
 
 import (
-	"os"
+	"errors"
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
-	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/ecc"
+	"github.com/socketplane/socketplane/config"
 )
 
-const dataDir = "/tmp/socketplane"
+// dataDir is the local data directory of the embedded datastore. It is set
+// from the cluster configuration when the daemon starts.
+var dataDir = "/tmp/socketplane"
 
-var listener eccListener
+const (
+	NotifyUpdateAdd = iota
+	NotifyUpdateModify
+	NotifyUpdateDelete
+)
+
+type NotifyUpdateType int
+
+var ErrDatastoreOutdated = errors.New("Datastore value is outdated")
+var ErrMembershipUnavailable = errors.New("Datastore does not track the cluster membership")
+
+// Datastore is the distributed Key-Value store that holds the cluster wide
+// state (networks, vlans and ipam). Values are organized in stores, each of
+// which is a flat namespace of keys.
+type Datastore interface {
+	Start(bindInterface string, bootstrap bool) error
+	Join(address string) error
+	Leave() error
+	Get(store string, key string) ([]byte, bool)
+	GetAll(store string) ([][]byte, bool)
+	// Put is a compare-and-swap operation. The value is updated only if the
+	// currently stored value matches oldValue, else ErrDatastoreOutdated is
+	// returned and the caller is expected to retry with a fresh value.
+	Put(store string, key string, value []byte, oldValue []byte) error
+	Delete(store string, key string) error
+	// Members returns the addresses of the other hosts of the cluster
+	Members() ([]string, error)
+	WatchNodes(listener DatastoreListener)
+	WatchStore(store string, listener DatastoreListener)
+}
+
+// DatastoreListener receives cluster membership updates and snapshots of
+// watched stores keyed by the key name.
+type DatastoreListener interface {
+	NotifyNodeUpdate(nType NotifyUpdateType, nodeAddress string)
+	NotifyStoreUpdate(store string, data map[string][]byte)
+}
+
+var datastore Datastore = &eccDatastore{}
+var listener datastoreListener
+
+func NewDatastore(name string) (Datastore, error) {
+	switch name {
+	case "", "ecc", "consul":
+		return &eccDatastore{}, nil
+	case "etcd":
+		return NewEtcdDatastore(config.Etcd.Endpoints, config.Etcd.Prefix, config.Etcd.TTL), nil
+	case "memory":
+		return NewMemoryDatastore(), nil
+	}
+	return nil, errors.New("Unknown datastore " + name)
+}
+
+func SetDatastore(ds Datastore) {
+	datastore = ds
+	ipamHints.reset()
+}
+
+// clusterAddress is the address of this host in the cluster. It is recorded
+// as the owner of the networks created here.
+var clusterAddress string
 
 func InitDatastore(bindInterface string, bootstrap bool) error {
-	err := ecc.Start(bootstrap, bootstrap, bindInterface, dataDir)
+	if addr, err := GetIfaceAddr(bindInterface); err == nil {
+		clusterAddress = addr.IP.String()
+	}
+	err := datastore.Start(bindInterface, bootstrap)
 	if err == nil {
-		go ecc.RegisterForNodeUpdates(listener)
+		go datastore.WatchNodes(listener)
 	}
 	return err
 }
 
 func JoinDatastore(address string) error {
-	return ecc.Join(address)
+	return datastore.Join(address)
 }
 
 func LeaveDatastore() error {
-	if err := ecc.Leave(); err != nil {
+	if err := datastore.Leave(); err != nil {
 		log.Error(err)
 		return err
 	}
-	if err := os.RemoveAll(dataDir); err != nil {
-		log.Errorf("Error deleting data directory %s", err)
-		return err
-	}
+	clusterMembers.reset()
+	peerReachability.reset()
+	ipamHints.reset()
 	return nil
 }
 
-type eccListener struct {
+type datastoreListener struct {
 }
 
-func (e eccListener) NotifyNodeUpdate(nType ecc.NotifyUpdateType, nodeAddress string) {
-	if nType == ecc.NOTIFY_UPDATE_ADD {
+func (e datastoreListener) NotifyNodeUpdate(nType NotifyUpdateType, nodeAddress string) {
+	if nType == NotifyUpdateAdd {
 		log.Infof("New Node joined the cluster : %s", nodeAddress)
+		clusterMembers.update(nodeAddress, MemberAlive)
 		AddPeer(nodeAddress)
-	} else if nType == ecc.NOTIFY_UPDATE_DELETE {
+	} else if nType == NotifyUpdateDelete {
 		log.Infof("Node left the cluster : %s", nodeAddress)
+		clusterMembers.update(nodeAddress, MemberLeft)
 		DeletePeer(nodeAddress)
+		// The node may have been the last one to run an earlier version
+		if err := migrateNetworkVnis(); err != nil {
+			log.Errorf("Unable to migrate the networks to VNIs. %v", err)
+		}
 	}
 }
 
-func (e eccListener) NotifyKeyUpdate(nType ecc.NotifyUpdateType, key string, data []byte) {
-}
-func (e eccListener) NotifyStoreUpdate(nType ecc.NotifyUpdateType, store string, data map[string][]byte) {
+func (e datastoreListener) NotifyStoreUpdate(store string, data map[string][]byte) {
+	switch store {
+	case networkStore:
+		realizeNetworks(data)
+	case vniHostStore:
+		if err := migrateNetworkVnis(); err != nil {
+			log.Errorf("Unable to migrate the networks to VNIs. %v", err)
+		}
+	}
 }
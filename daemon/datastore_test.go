@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+type testStoreListener struct {
+	updates chan map[string][]byte
+}
+
+func (l testStoreListener) NotifyNodeUpdate(nType NotifyUpdateType, nodeAddress string) {
+}
+
+func (l testStoreListener) NotifyStoreUpdate(store string, data map[string][]byte) {
+	l.updates <- data
+}
+
+func useMemoryDatastore() func() {
+	orig := datastore
+	SetDatastore(NewMemoryDatastore())
+	return func() { SetDatastore(orig) }
+}
+
+func TestNewDatastore(t *testing.T) {
+	for _, name := range []string{"", "ecc", "memory"} {
+		if _, err := NewDatastore(name); err != nil {
+			t.Fatalf("datastore %q should be supported: %v", name, err)
+		}
+	}
+	if _, err := NewDatastore("foo"); err == nil {
+		t.Fatal("unknown datastore should return an error")
+	}
+}
+
+func TestMemoryDatastorePut(t *testing.T) {
+	ds := NewMemoryDatastore()
+	if _, ok := ds.Get("test", "foo"); ok {
+		t.Fatal("key should not exist")
+	}
+	if err := ds.Put("test", "foo", []byte("bar"), nil); err != nil {
+		t.Fatal(err)
+	}
+	value, ok := ds.Get("test", "foo")
+	if !ok || !bytes.Equal(value, []byte("bar")) {
+		t.Fatal("value not stored")
+	}
+	if err := ds.Put("test", "foo", []byte("baz"), []byte("qux")); err != ErrDatastoreOutdated {
+		t.Fatal("compare-and-swap with a stale value should be outdated")
+	}
+	if err := ds.Put("test", "foo", []byte("baz"), []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	values, ok := ds.GetAll("test")
+	if !ok || len(values) != 1 || !bytes.Equal(values[0], []byte("baz")) {
+		t.Fatal("GetAll returned incorrect values")
+	}
+	if err := ds.Delete("test", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.Get("test", "foo"); ok {
+		t.Fatal("key should have been deleted")
+	}
+}
+
+func TestMemoryDatastoreWatchStore(t *testing.T) {
+	ds := NewMemoryDatastore()
+	l := testStoreListener{make(chan map[string][]byte, 2)}
+	ds.WatchStore("test", l)
+
+	ds.Put("test", "foo", []byte("bar"), nil)
+	snapshot := <-l.updates
+	if !bytes.Equal(snapshot["foo"], []byte("bar")) {
+		t.Fatal("watch did not deliver the update")
+	}
+	ds.Delete("test", "foo")
+	snapshot = <-l.updates
+	if _, ok := snapshot["foo"]; ok {
+		t.Fatal("watch did not deliver the delete")
+	}
+}
+
+func TestAllocateVlanMemoryDatastore(t *testing.T) {
+	defer useMemoryDatastore()()
+	for i := 1; i <= 5; i++ {
+		vlan, err := allocateVlan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vlan != uint(i) {
+			t.Fatalf("Expected vlan %d, got %d", i, vlan)
+		}
+	}
+	releaseVlan(2)
+	vlan, _ := allocateVlan()
+	if vlan != 2 {
+		t.Fatalf("Expected released vlan 2 to be reused, got %d", vlan)
+	}
+}
+
+func TestIPAMRequestMemoryDatastore(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.10.10.0/24")
+	for i := 1; i < 10; i++ {
+		address := IPAMRequest(*ipNet).To4()
+		if int(address[3]) != i {
+			t.Fatal(address.String())
+		}
+	}
+	IPAMRelease(net.ParseIP("10.10.10.4"), *ipNet)
+	if address := IPAMRequest(*ipNet).To4(); int(address[3]) != 4 {
+		t.Fatal(address.String())
+	}
+}
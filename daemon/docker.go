@@ -0,0 +1,220 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/samalba/dockerclient"
+	"github.com/socketplane/socketplane/config"
+)
+
+// The containers are attached as Docker starts them and detached as they die,
+// which the Powerstrip adapter did by proxying the Docker API. A container is
+// attached only when it asks for a network with the SP_NETWORK environment
+// variable or label, so containers run with --net=none stay off the network.
+// SP_IP requests its address. Labels take precedence over the environment.
+
+const (
+	networkEnv = "SP_NETWORK"
+	ipEnv      = "SP_IP"
+)
+
+const dockerRetryInterval = 5 * time.Second
+
+// dockerContainer is the part of the inspection of a container that attaching
+// it needs. The vendored client does not know about the labels.
+type dockerContainer struct {
+	Id    string
+	Name  string
+	State struct {
+		Running bool
+		Pid     int
+	}
+	Config struct {
+		Env    []string
+		Labels map[string]string
+	}
+	HostConfig struct {
+		NetworkMode string
+	}
+}
+
+// connection returns the connection of a container, and false if the
+// container is not to be attached
+func (c *dockerContainer) connection() (*Connection, bool) {
+	mode := c.HostConfig.NetworkMode
+	if mode == "host" || strings.HasPrefix(mode, "container:") {
+		return nil, false
+	}
+	settings := make(map[string]string)
+	for _, env := range c.Config.Env {
+		val := strings.SplitN(env, "=", 2)
+		if len(val) == 2 && (val[0] == networkEnv || val[0] == ipEnv) {
+			settings[val[0]] = strings.Trim(val[1], " ")
+		}
+	}
+	for _, key := range []string{networkEnv, ipEnv} {
+		if label, ok := c.Config.Labels[key]; ok {
+			settings[key] = strings.Trim(label, " ")
+		}
+	}
+	if settings[networkEnv] == "" {
+		return nil, false
+	}
+	return &Connection{
+		ContainerID:   c.Id,
+		ContainerName: c.Name,
+		ContainerPID:  fmt.Sprint(c.State.Pid),
+		Network:       settings[networkEnv],
+		RequestedIP:   settings[ipEnv],
+	}, true
+}
+
+// attachLock serializes the attachments of the watcher and of the API, which
+// both attach the containers started by "socketplane run"
+var attachLock sync.Mutex
+
+// dockerWatcher attaches and detaches the containers on the events of a
+// Docker daemon
+type dockerWatcher struct {
+	d      *Daemon
+	client *dockerclient.DockerClient
+}
+
+func newDockerWatcher(d *Daemon, socket string) (*dockerWatcher, error) {
+	client, err := dockerclient.NewDockerClient(socket, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerWatcher{d: d, client: client}, nil
+}
+
+func (w *dockerWatcher) inspect(id string) (*dockerContainer, error) {
+	uri := fmt.Sprintf("%s/%s/containers/%s/json", w.client.URL.String(), dockerclient.APIVersion, id)
+	resp, err := w.client.HTTPClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, dockerclient.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to inspect container %s : %s", id, resp.Status)
+	}
+	container := &dockerContainer{}
+	if err := json.NewDecoder(resp.Body).Decode(container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// watch attaches the running containers and then follows the events until
+// the stream fails
+func (w *dockerWatcher) watch() error {
+	ec := make(chan error, 1)
+	w.client.StartMonitorEvents(w.handleEvent, ec)
+	defer w.client.StopAllMonitorEvents()
+	// Containers may have been started while the events were not watched
+	containers, err := w.client.ListContainers(false, false, "")
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		w.attach(container.Id)
+	}
+	return <-ec
+}
+
+func (w *dockerWatcher) handleEvent(event *dockerclient.Event, ec chan error, args ...interface{}) {
+	switch event.Status {
+	case "start":
+		w.attach(event.Id)
+	case "die", "destroy":
+		w.detach(event.Id)
+	}
+}
+
+// attach connects a container to its network, unless it is already
+// connected or does not ask for a network
+func (w *dockerWatcher) attach(id string) {
+	attachLock.Lock()
+	defer attachLock.Unlock()
+	if _, ok := w.d.connection(id); ok {
+		return
+	}
+	container, err := w.inspect(id)
+	if err != nil {
+		log.Errorf("Unable to inspect container %s. %v", id, err)
+		return
+	}
+	if !container.State.Running {
+		return
+	}
+	cfg, ok := container.connection()
+	if !ok {
+		log.Debugf("Container %s does not ask for a network", id)
+		return
+	}
+	if cfg.RequestedIP != "" {
+		if err := reserveRequestedIP(cfg); err != nil {
+			log.Errorf("Unable to reserve %s for container %s. %v", cfg.RequestedIP, id, err)
+			return
+		}
+	}
+	context := &ConnectionContext{
+		ConnectionAdd,
+		cfg,
+		make(chan *Connection),
+		nil,
+	}
+	w.d.cC <- context
+	if <-context.Result == nil {
+		log.Errorf("Unable to attach container %s to network %s. %v", id, cfg.Network, context.Err)
+		return
+	}
+	log.Infof("Container %s attached to network %s", id, cfg.Network)
+}
+
+// detach disconnects a container from its network
+func (w *dockerWatcher) detach(id string) {
+	attachLock.Lock()
+	defer attachLock.Unlock()
+	connection, ok := w.d.connection(id)
+	if !ok {
+		return
+	}
+	context := &ConnectionContext{
+		ConnectionDelete,
+		connection,
+		make(chan *Connection),
+		nil,
+	}
+	w.d.cC <- context
+	<-context.Result
+	log.Infof("Container %s detached from network %s", id, connection.Network)
+}
+
+// watchDockerEvents attaches the containers on the events of the Docker
+// daemon, reconnecting to the daemon whenever the events stream fails
+func (d *Daemon) watchDockerEvents() {
+	if !config.Docker.Events {
+		log.Info("Docker events watcher disabled")
+		return
+	}
+	for {
+		watcher, err := newDockerWatcher(d, config.Docker.Socket)
+		if err != nil {
+			log.Errorf("Invalid Docker socket %s. %v", config.Docker.Socket, err)
+			return
+		}
+		err = watcher.watch()
+		log.Errorf("Docker events watcher stopped. %v", err)
+		time.Sleep(dockerRetryInterval)
+	}
+}
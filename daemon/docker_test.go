@@ -0,0 +1,206 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/samalba/dockerclient"
+)
+
+// fakeDocker serves the events and the containers of a Docker daemon on a
+// unix socket
+type fakeDocker struct {
+	sync.Mutex
+	dir        string
+	listener   net.Listener
+	events     chan dockerclient.Event
+	containers map[string]*dockerContainer
+}
+
+func newFakeDocker(t *testing.T, containers ...*dockerContainer) *fakeDocker {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", path.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDocker{
+		dir:        dir,
+		listener:   listener,
+		events:     make(chan dockerclient.Event),
+		containers: make(map[string]*dockerContainer),
+	}
+	for _, container := range containers {
+		f.containers[container.Id] = container
+	}
+	go http.Serve(listener, f)
+	return f
+}
+
+func (f *fakeDocker) socket() string {
+	return "unix://" + path.Join(f.dir, "docker.sock")
+}
+
+func (f *fakeDocker) close() {
+	f.listener.Close()
+	os.RemoveAll(f.dir)
+}
+
+func (f *fakeDocker) setRunning(id string, running bool) {
+	f.Lock()
+	f.containers[id].State.Running = running
+	f.Unlock()
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/" + dockerclient.APIVersion
+	if r.URL.Path != prefix+"/events" {
+		f.Lock()
+		defer f.Unlock()
+	}
+	switch {
+	case r.URL.Path == prefix+"/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for event := range f.events {
+			json.NewEncoder(w).Encode(event)
+			w.(http.Flusher).Flush()
+		}
+	case r.URL.Path == prefix+"/containers/json":
+		containers := []dockerclient.Container{}
+		for id, container := range f.containers {
+			if container.State.Running {
+				containers = append(containers, dockerclient.Container{Id: id})
+			}
+		}
+		json.NewEncoder(w).Encode(containers)
+	case strings.HasPrefix(r.URL.Path, prefix+"/containers/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix+"/containers/"), "/json")
+		container, ok := f.containers[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(container)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newDockerContainer(id string, mode string, env []string, labels map[string]string) *dockerContainer {
+	container := &dockerContainer{Id: id, Name: "/" + id}
+	container.State.Running = true
+	container.State.Pid = 42
+	container.HostConfig.NetworkMode = mode
+	container.Config.Env = env
+	container.Config.Labels = labels
+	return container
+}
+
+// serveConnections records the connections of the daemon without wiring them
+func serveConnections(d *Daemon, actions chan string) {
+	for c := range d.cC {
+		switch c.Action {
+		case ConnectionAdd:
+			d.setConnection(c.Connection)
+		case ConnectionDelete:
+			d.removeConnection(c.Connection.ContainerID)
+		}
+		c.Result <- c.Connection
+		actions <- fmt.Sprintf("%d %s %s", c.Action, c.Connection.ContainerID, c.Connection.Network)
+	}
+}
+
+func TestDockerContainerConnection(t *testing.T) {
+	tests := []struct {
+		container *dockerContainer
+		network   string
+		ip        string
+	}{
+		{newDockerContainer("none", "none", nil, nil), "", ""},
+		{newDockerContainer("default", "none", []string{"SP_NETWORK=" + DefaultNetworkName}, nil), DefaultNetworkName, ""},
+		{newDockerContainer("bridge", "bridge", nil, nil), "", ""},
+		{newDockerContainer("env", "", []string{"PATH=/bin", "SP_NETWORK=web", "SP_IP=10.1.0.5"}, nil), "web", "10.1.0.5"},
+		{newDockerContainer("label", "none", []string{"SP_NETWORK=web"}, map[string]string{"SP_NETWORK": "db"}), "db", ""},
+		{newDockerContainer("host", "host", []string{"SP_NETWORK=web"}, nil), "", ""},
+		{newDockerContainer("shared", "container:web", nil, map[string]string{"SP_NETWORK": "web"}), "", ""},
+	}
+	for _, test := range tests {
+		cfg, ok := test.container.connection()
+		if ok != (test.network != "") {
+			t.Fatalf("%s : expected to be attached %v, got %v", test.container.Id, test.network != "", ok)
+		}
+		if !ok {
+			continue
+		}
+		if cfg.Network != test.network || cfg.RequestedIP != test.ip || cfg.ContainerPID != "42" {
+			t.Fatalf("%s : unexpected connection %+v", test.container.Id, cfg)
+		}
+	}
+}
+
+func TestDockerWatcher(t *testing.T) {
+	running := newDockerContainer("running", "none", nil, map[string]string{"SP_NETWORK": DefaultNetworkName})
+	unattached := newDockerContainer("unattached", "none", nil, nil)
+	web := newDockerContainer("web", "", nil, map[string]string{"SP_NETWORK": "web"})
+	bridged := newDockerContainer("bridged", "bridge", nil, nil)
+	docker := newFakeDocker(t, running, web, bridged, unattached)
+	defer docker.close()
+	docker.setRunning("web", false)
+
+	d := NewDaemon()
+	actions := make(chan string, 10)
+	go serveConnections(d, actions)
+	watcher, err := newDockerWatcher(d, docker.socket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error)
+	go func() { errs <- watcher.watch() }()
+
+	expect := func(expected string) {
+		select {
+		case action := <-actions:
+			if action != expected {
+				t.Fatalf("Expected %q, got %q", expected, action)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %q", expected)
+		}
+	}
+	// The containers running before the events are watched are attached
+	expect(fmt.Sprintf("%d running %s", ConnectionAdd, DefaultNetworkName))
+
+	docker.setRunning("web", true)
+	docker.events <- dockerclient.Event{Id: "bridged", Status: "start"}
+	docker.events <- dockerclient.Event{Id: "unattached", Status: "start"}
+	docker.events <- dockerclient.Event{Id: "web", Status: "start"}
+	expect(fmt.Sprintf("%d web web", ConnectionAdd))
+	docker.events <- dockerclient.Event{Id: "web", Status: "start"}
+	docker.events <- dockerclient.Event{Id: "web", Status: "die"}
+	expect(fmt.Sprintf("%d web web", ConnectionDelete))
+	docker.events <- dockerclient.Event{Id: "web", Status: "destroy"}
+	docker.events <- dockerclient.Event{Id: "running", Status: "destroy"}
+	expect(fmt.Sprintf("%d running %s", ConnectionDelete, DefaultNetworkName))
+
+	close(docker.events)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The watcher should stop with the events stream")
+	}
+	if len(d.Connections) != 0 || len(actions) != 0 {
+		t.Fatalf("Unexpected connections %v", d.Connections)
+	}
+}
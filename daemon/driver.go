@@ -0,0 +1,656 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/socketplane/socketplane/config"
+)
+
+// SocketPlane is a remote network driver of Docker, which activates it with
+// the plugin socket. Docker networks map onto SocketPlane networks and their
+// endpoints onto OVS ports that Docker moves into the containers.
+//
+// docker_network : Key = Docker network ID, Value = JSON dockerNetwork
+// docker_endpoint: Key = Docker endpoint ID, Value = JSON driverEndpoint
+
+const dockerNetworkStore = "docker_network"
+const dockerEndpointStore = "docker_endpoint"
+
+const pluginContentType = "application/vnd.docker.plugins.v1+json"
+
+// networkOption names the SocketPlane network of a Docker network, as in
+// docker network create -d socketplane -o socketplane.network=web
+const networkOption = "socketplane.network"
+
+const genericOptions = "com.docker.network.generic"
+
+var ErrUnknownDockerNetwork = errors.New("Unknown Docker network")
+var ErrUnknownEndpoint = errors.New("Unknown endpoint")
+var ErrEndpointJoined = errors.New("Endpoint already joined")
+
+// dockerNetwork is the SocketPlane network of a Docker network. Networks
+// named with the network option outlive the Docker network.
+type dockerNetwork struct {
+	Network string `json:"network"`
+	Owned   bool   `json:"owned,omitempty"`
+}
+
+// driverEndpoint is an endpoint of a Docker network on a host. The name of
+// its connection is the OVS port of the endpoint while it is joined. The
+// adopted addresses were allocated by Docker through the IPAM driver, which
+// releases them.
+type driverEndpoint struct {
+	ID         string        `json:"id"`
+	Network    string        `json:"network"`
+	Host       string        `json:"host"`
+	Connection OvsConnection `json:"connection"`
+	Adopted    []string      `json:"adopted,omitempty"`
+}
+
+// owned returns the connection of an endpoint without the adopted addresses
+func (e *driverEndpoint) owned() OvsConnection {
+	connection := e.Connection
+	for _, address := range e.Adopted {
+		if address == connection.Ip {
+			connection.Ip = ""
+		}
+		if address == connection.Ip6 {
+			connection.Ip6 = ""
+		}
+	}
+	return connection
+}
+
+type driverIPAMData struct {
+	AddressSpace string
+	Pool         string
+	Gateway      string
+}
+
+type driverCreateNetworkRequest struct {
+	NetworkID string
+	Options   map[string]interface{}
+	IPv4Data  []driverIPAMData
+	IPv6Data  []driverIPAMData
+}
+
+type driverNetworkRequest struct {
+	NetworkID string
+}
+
+type driverInterface struct {
+	Address     string `json:",omitempty"`
+	AddressIPv6 string `json:",omitempty"`
+	MacAddress  string `json:",omitempty"`
+}
+
+type driverCreateEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+	Interface  *driverInterface
+	Options    map[string]interface{}
+}
+
+type driverCreateEndpointResponse struct {
+	Interface *driverInterface `json:",omitempty"`
+}
+
+type driverEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+type driverJoinRequest struct {
+	NetworkID  string
+	EndpointID string
+	SandboxKey string
+	Options    map[string]interface{}
+}
+
+type driverInterfaceName struct {
+	SrcName   string
+	DstPrefix string
+}
+
+type driverJoinResponse struct {
+	InterfaceName driverInterfaceName
+	Gateway       string `json:",omitempty"`
+	GatewayIPv6   string `json:",omitempty"`
+}
+
+type pluginError struct {
+	Err string
+}
+
+type PluginFunc func(d *Daemon, body []byte) (interface{}, error)
+
+type pluginHandler struct {
+	*Daemon
+	h PluginFunc
+}
+
+func (ph pluginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	var response interface{}
+	if err == nil {
+		response, err = ph.h(ph.Daemon, body)
+	}
+	w.Header().Set("Content-Type", pluginContentType)
+	if err != nil {
+		log.Errorf("%s failed. %v", r.URL.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		response = &pluginError{err.Error()}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// ServePlugin serves the plugin API of Docker on a unix socket
+func ServePlugin(d *Daemon, socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	// A socket left by a previous run refuses the connections
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	log.Infof("Serving the Docker plugin API on %s", socket)
+	return http.Serve(listener, createPluginRouter(d))
+}
+
+func createPluginRouter(d *Daemon) *mux.Router {
+	r := mux.NewRouter()
+	m := map[string]PluginFunc{
+		"/Plugin.Activate":                           pluginActivate,
+		"/NetworkDriver.GetCapabilities":             driverGetCapabilities,
+		"/NetworkDriver.CreateNetwork":               driverCreateNetwork,
+		"/NetworkDriver.DeleteNetwork":               driverDeleteNetwork,
+		"/NetworkDriver.CreateEndpoint":              driverCreateEndpoint,
+		"/NetworkDriver.EndpointOperInfo":            driverEndpointOperInfo,
+		"/NetworkDriver.DeleteEndpoint":              driverDeleteEndpoint,
+		"/NetworkDriver.Join":                        driverJoin,
+		"/NetworkDriver.Leave":                       driverLeave,
+		"/NetworkDriver.DiscoverNew":                 pluginNoop,
+		"/NetworkDriver.DiscoverDelete":              pluginNoop,
+		"/NetworkDriver.ProgramExternalConnectivity": pluginNoop,
+		"/NetworkDriver.RevokeExternalConnectivity":  pluginNoop,
+		"/IpamDriver.GetCapabilities":                ipamGetCapabilities,
+		"/IpamDriver.GetDefaultAddressSpaces":        ipamGetDefaultAddressSpaces,
+		"/IpamDriver.RequestPool":                    ipamRequestPool,
+		"/IpamDriver.ReleasePool":                    ipamReleasePool,
+		"/IpamDriver.RequestAddress":                 ipamRequestAddress,
+		"/IpamDriver.ReleaseAddress":                 ipamReleaseAddress,
+	}
+	for route, fct := range m {
+		r.Path(route).Methods("POST").Handler(pluginHandler{d, fct})
+	}
+	return r
+}
+
+func pluginActivate(d *Daemon, body []byte) (interface{}, error) {
+	return map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}}, nil
+}
+
+func pluginNoop(d *Daemon, body []byte) (interface{}, error) {
+	return map[string]string{}, nil
+}
+
+// The networks are known to every host of the cluster
+func driverGetCapabilities(d *Daemon, body []byte) (interface{}, error) {
+	return map[string]string{"Scope": "global"}, nil
+}
+
+// dockerNetworkName returns the SocketPlane network of a new Docker network,
+// and whether the network belongs to the Docker network. Network names are
+// interface names, hence the short ID.
+func dockerNetworkName(request *driverCreateNetworkRequest) (string, bool) {
+	if generic, ok := request.Options[genericOptions].(map[string]interface{}); ok {
+		if name, ok := generic[networkOption].(string); ok && name != "" {
+			return name, false
+		}
+	}
+	id := request.NetworkID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id, true
+}
+
+func getDockerNetwork(networkID string) (*dockerNetwork, error) {
+	data, ok := datastore.Get(dockerNetworkStore, networkID)
+	if !ok {
+		return nil, ErrUnknownDockerNetwork
+	}
+	network := &dockerNetwork{}
+	if err := json.Unmarshal(data, network); err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+// driverIPAMSubnet returns the subnet and the gateway that Docker assigned to
+// a new network, if any
+func driverIPAMSubnet(data driverIPAMData) (*net.IPNet, net.IP, error) {
+	var subnet *net.IPNet
+	var gateway net.IP
+	var err error
+	if data.Pool != "" {
+		if _, subnet, err = net.ParseCIDR(data.Pool); err != nil {
+			return nil, nil, err
+		}
+	}
+	if data.Gateway != "" {
+		if gateway, _, err = net.ParseCIDR(data.Gateway); err != nil {
+			return nil, nil, err
+		}
+		if subnet == nil || !subnet.Contains(gateway) {
+			return nil, nil, ErrAddressNotInSubnet
+		}
+	}
+	return subnet, gateway, nil
+}
+
+// checkDockerIPAM makes sure that the subnets and the gateways that Docker
+// assigned to a network are the ones of an existing network, since Docker
+// hands out the addresses of its endpoints in them
+func checkDockerIPAM(network *Network, subnet *net.IPNet, gateway net.IP, subnet6 *net.IPNet, gateway6 net.IP) error {
+	if subnet != nil && subnet.String() != network.Subnet {
+		return fmt.Errorf("Network %s has the subnet %q, not %s", network.ID, network.Subnet, subnet)
+	}
+	if gateway != nil && gateway.String() != network.Gateway {
+		return fmt.Errorf("Network %s has the gateway %q, not %s", network.ID, network.Gateway, gateway)
+	}
+	if subnet6 != nil && subnet6.String() != network.Subnet6 {
+		return fmt.Errorf("Network %s has the IPv6 subnet %q, not %s", network.ID, network.Subnet6, subnet6)
+	}
+	if gateway6 != nil && gateway6.String() != network.Gateway6 {
+		return fmt.Errorf("Network %s has the IPv6 gateway %q, not %s", network.ID, network.Gateway6, gateway6)
+	}
+	return nil
+}
+
+func driverCreateNetwork(d *Daemon, body []byte) (interface{}, error) {
+	request := &driverCreateNetworkRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	// Every host creates the networks of the global scope
+	if _, err := getDockerNetwork(request.NetworkID); err == nil {
+		return map[string]string{}, nil
+	}
+	id, owned := dockerNetworkName(request)
+	var subnet, subnet6 *net.IPNet
+	var gateway, gateway6 net.IP
+	var err error
+	if len(request.IPv4Data) > 0 {
+		if subnet, gateway, err = driverIPAMSubnet(request.IPv4Data[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(request.IPv6Data) > 0 {
+		if subnet6, gateway6, err = driverIPAMSubnet(request.IPv6Data[0]); err != nil {
+			return nil, err
+		}
+	}
+	var carved *net.IPNet
+	if existing, err := GetNetwork(id); err == nil {
+		if err := checkDockerIPAM(existing, subnet, gateway, subnet6, gateway6); err != nil {
+			return nil, err
+		}
+	} else if subnet == nil && subnet6 == nil {
+		if carved, err = AllocateSubnet(0); err != nil {
+			return nil, err
+		}
+		subnet = carved
+	}
+	pools := append(dockerPoolIPAM(subnet), dockerPoolIPAM(subnet6)...)
+	network, err := CreateNetwork(id, subnet, subnet6, gateway, gateway6, "", pools)
+	if carved != nil && (err != nil || network.Subnet != carved.String()) {
+		ReleaseSubnet(carved)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The network may have been created by another host in the meantime
+	if err := checkDockerIPAM(network, subnet, gateway, subnet6, gateway6); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&dockerNetwork{Network: id, Owned: owned})
+	if err != nil {
+		return nil, err
+	}
+	if err := datastore.Put(dockerNetworkStore, request.NetworkID, data, nil); err != nil && err != ErrDatastoreOutdated {
+		return nil, err
+	}
+	log.Infof("Docker network %s created as network %s", request.NetworkID, id)
+	return map[string]string{}, nil
+}
+
+func driverDeleteNetwork(d *Daemon, body []byte) (interface{}, error) {
+	request := &driverNetworkRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	network, err := getDockerNetwork(request.NetworkID)
+	if err == ErrUnknownDockerNetwork {
+		// Deleted by another host
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if network.Owned {
+		if _, err := GetNetwork(network.Network); err == nil {
+			if err := DeleteNetwork(network.Network); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := datastore.Delete(dockerNetworkStore, request.NetworkID); err != nil {
+		return nil, err
+	}
+	log.Infof("Docker network %s deleted", request.NetworkID)
+	return map[string]string{}, nil
+}
+
+func getEndpoint(id string) (*driverEndpoint, []byte, error) {
+	data, ok := datastore.Get(dockerEndpointStore, id)
+	if !ok {
+		return nil, nil, ErrUnknownEndpoint
+	}
+	endpoint := &driverEndpoint{}
+	if err := json.Unmarshal(data, endpoint); err != nil {
+		return nil, nil, err
+	}
+	return endpoint, data, nil
+}
+
+func putEndpoint(endpoint *driverEndpoint, oldValue []byte) error {
+	data, err := json.Marshal(endpoint)
+	if err != nil {
+		return err
+	}
+	return datastore.Put(dockerEndpointStore, endpoint.ID, data, oldValue)
+}
+
+// endpointAddress reserves the address that Docker assigned to an endpoint in
+// a subnet of its network, or allocates one if Docker did not. An address that
+// Docker allocated through the IPAM driver is adopted.
+func endpointAddress(network string, cidr string, assigned string, endpointID string) (net.IP, *net.IPNet, bool, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if assigned == "" {
+		ip := connectionAddress(*subnet, nil, network, endpointID)
+		if ip == nil {
+			return nil, nil, false, errors.New("No address available in " + subnet.String())
+		}
+		return ip, subnet, false, nil
+	}
+	ip, _, err := net.ParseCIDR(assigned)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if !subnet.Contains(ip) {
+		return nil, nil, false, ErrAddressNotInSubnet
+	}
+	adopted := false
+	if err := IPAMRequestAddress(ip, *subnet); err == ErrAddressInUse && dockerAllocated(ip, subnet) {
+		adopted = true
+	} else if err != nil {
+		return nil, nil, false, err
+	}
+	recordAllocation(ip, *subnet, network, endpointID)
+	return ip, subnet, adopted, nil
+}
+
+func driverCreateEndpoint(d *Daemon, body []byte) (interface{}, error) {
+	request := &driverCreateEndpointRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	dockerNet, err := getDockerNetwork(request.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	network, err := GetNetwork(dockerNet.Network)
+	if err != nil {
+		return nil, err
+	}
+	assigned := request.Interface
+	if assigned == nil {
+		assigned = &driverInterface{}
+	}
+	docker := assigned.Address != "" || assigned.AddressIPv6 != ""
+	if !docker && network.Subnet == "" && network.Subnet6 == "" {
+		return nil, errors.New("Network " + network.ID + " has no subnet")
+	}
+
+	endpoint := &driverEndpoint{ID: request.EndpointID, Network: network.ID, Host: clusterAddress}
+	connection := &endpoint.Connection
+	var ip, ip6 net.IP
+	if network.Subnet != "" && (!docker || assigned.Address != "") {
+		var subnet *net.IPNet
+		var adopted bool
+		if ip, subnet, adopted, err = endpointAddress(network.ID, network.Subnet, assigned.Address, endpoint.ID); err != nil {
+			return nil, err
+		}
+		if adopted {
+			endpoint.Adopted = append(endpoint.Adopted, ip.String())
+		}
+		connection.Ip = ip.String()
+		connection.Subnet = prefixLength(subnet)
+		connection.Gateway = network.Gateway
+	}
+	if network.Subnet6 != "" && (!docker || assigned.AddressIPv6 != "") {
+		var subnet6 *net.IPNet
+		var adopted bool
+		if ip6, subnet6, adopted, err = endpointAddress(network.ID, network.Subnet6, assigned.AddressIPv6, endpoint.ID); err != nil {
+			DeleteConnection(endpoint.owned())
+			return nil, err
+		}
+		if adopted {
+			endpoint.Adopted = append(endpoint.Adopted, ip6.String())
+		}
+		connection.Ip6 = ip6.String()
+		connection.Subnet6 = prefixLength(subnet6)
+		connection.Gateway6 = network.Gateway6
+	}
+	if docker && connection.Ip == "" && connection.Ip6 == "" {
+		return nil, errors.New("Docker assigned no address of network " + network.ID)
+	}
+	connection.Mac = assigned.MacAddress
+	if connection.Mac == "" && ip != nil {
+		connection.Mac = generateMacAddr(ip).String()
+	} else if connection.Mac == "" {
+		connection.Mac = generateMacAddr(ip6).String()
+	}
+	if err := putEndpoint(endpoint, nil); err != nil {
+		DeleteConnection(endpoint.owned())
+		return nil, err
+	}
+
+	// Docker only accepts the interface of an endpoint it did not address
+	response := &driverCreateEndpointResponse{}
+	if !docker {
+		response.Interface = &driverInterface{MacAddress: connection.Mac}
+		if ip != nil {
+			response.Interface.Address = connection.Ip + connection.Subnet
+		}
+		if ip6 != nil {
+			response.Interface.AddressIPv6 = connection.Ip6 + connection.Subnet6
+		}
+	}
+	return response, nil
+}
+
+func driverEndpointOperInfo(d *Daemon, body []byte) (interface{}, error) {
+	request := &driverEndpointRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	endpoint, _, err := getEndpoint(request.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"Value": endpoint.Connection}, nil
+}
+
+func driverDeleteEndpoint(d *Daemon, body []byte) (interface{}, error) {
+	request := &driverEndpointRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	endpoint, _, err := getEndpoint(request.EndpointID)
+	if err == ErrUnknownEndpoint {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := deleteEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
+
+// deleteEndpoint releases the addresses of an endpoint, but the adopted ones,
+// and forgets it. The port is deleted as well if the endpoint was not left.
+func deleteEndpoint(endpoint *driverEndpoint) error {
+	if err := DeleteConnection(endpoint.owned()); err != nil {
+		return err
+	}
+	return datastore.Delete(dockerEndpointStore, endpoint.ID)
+}
+
+// driverJoin creates the port of an endpoint, which Docker moves into the
+// container and addresses
+func driverJoin(d *Daemon, body []byte) (interface{}, error) {
+	request := &driverJoinRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	endpoint, oldValue, err := getEndpoint(request.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Connection.Name != "" {
+		return nil, ErrEndpointJoined
+	}
+	network, err := GetNetwork(endpoint.Network)
+	if err != nil {
+		return nil, err
+	}
+	if OvsBridge.Name == "" {
+		return nil, errors.New("bridge is not available")
+	}
+	vlan, err := realizeSegment(network)
+	if err != nil {
+		return nil, err
+	}
+	portName, err := createOvsInternalPort("ovs", OvsBridge.Name, network.ID, vlan)
+	if err != nil {
+		return nil, err
+	}
+	port := OvsConnection{Name: portName}
+	if err := waitForLink(portName); err != nil {
+		DeleteConnection(port)
+		return nil, err
+	}
+	if err := SetMtu(portName, mtu); err != nil {
+		DeleteConnection(port)
+		return nil, err
+	}
+	if err := SetInterfaceMac(portName, endpoint.Connection.Mac); err != nil {
+		DeleteConnection(port)
+		return nil, err
+	}
+	endpoint.Connection.Name = portName
+	if err := putEndpoint(endpoint, oldValue); err != nil {
+		DeleteConnection(port)
+		return nil, err
+	}
+	return &driverJoinResponse{
+		InterfaceName: driverInterfaceName{SrcName: portName, DstPrefix: "eth"},
+		Gateway:       endpoint.Connection.Gateway,
+		GatewayIPv6:   endpoint.Connection.Gateway6,
+	}, nil
+}
+
+func driverLeave(d *Daemon, body []byte) (interface{}, error) {
+	request := &driverEndpointRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	endpoint, oldValue, err := getEndpoint(request.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Connection.Name == "" {
+		return map[string]string{}, nil
+	}
+	// Only the port goes, the addresses belong to the endpoint
+	if err := DeleteConnection(OvsConnection{Name: endpoint.Connection.Name}); err != nil {
+		return nil, err
+	}
+	endpoint.Connection.Name = ""
+	if err := putEndpoint(endpoint, oldValue); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
+
+// endpointConnections adds the endpoints of this host to the connections, so
+// that the reconciliation of the allocations keeps their addresses
+func endpointConnections(connections map[string]*Connection) map[string]*Connection {
+	endpoints := localEndpoints()
+	all := make(map[string]*Connection, len(connections)+len(endpoints))
+	for id, connection := range connections {
+		all[id] = connection
+	}
+	for _, endpoint := range endpoints {
+		all[endpoint.ID] = &Connection{
+			ContainerID:       endpoint.ID,
+			Network:           endpoint.Network,
+			OvsPortID:         endpoint.Connection.Name,
+			ConnectionDetails: endpoint.Connection,
+		}
+	}
+	return all
+}
+
+// localEndpoints returns the endpoints of the Docker networks on this host
+func localEndpoints() []*driverEndpoint {
+	endpoints := []*driverEndpoint{}
+	values, ok := datastore.GetAll(dockerEndpointStore)
+	if !ok {
+		return endpoints
+	}
+	for _, data := range values {
+		endpoint := &driverEndpoint{}
+		if err := json.Unmarshal(data, endpoint); err != nil || endpoint.Host != clusterAddress {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// servePlugin serves the plugin API of Docker, if configured
+func (d *Daemon) servePlugin() {
+	if config.Docker.Plugin == "" {
+		return
+	}
+	if err := ServePlugin(d, config.Docker.Plugin); err != nil {
+		log.Errorf("Unable to serve the Docker plugin API on %s. %v", config.Docker.Plugin, err)
+	}
+}
@@ -0,0 +1,340 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// SocketPlane is also an IPAM driver of Docker, so that the networks of any
+// driver get their subnets and addresses from the cluster-wide IPAM. The ID
+// of a pool is its subnet. A pool requested with the subnet of a network is
+// the pool of the network. The driver has no pool options.
+//
+// docker_pool: Key = subnet, Value = JSON dockerPool
+
+const dockerPoolStore = "docker_pool"
+
+const ipamAddressSpace = "socketplane"
+
+var ErrUnknownPool = errors.New("Unknown pool")
+
+// dockerPool is a subnet requested by Docker. A carved subnet is released
+// with the pool.
+type dockerPool struct {
+	Pool    string `json:"pool"`
+	SubPool string `json:"sub_pool,omitempty"`
+	Carved  bool   `json:"carved,omitempty"`
+}
+
+type ipamRequestPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Options      map[string]string
+	V6           bool
+}
+
+type ipamRequestPoolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+type ipamReleasePoolRequest struct {
+	PoolID string
+}
+
+type ipamRequestAddressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type ipamRequestAddressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+type ipamReleaseAddressRequest struct {
+	PoolID  string
+	Address string
+}
+
+func ipamGetCapabilities(d *Daemon, body []byte) (interface{}, error) {
+	return map[string]bool{"RequiresMACAddress": false}, nil
+}
+
+func ipamGetDefaultAddressSpaces(d *Daemon, body []byte) (interface{}, error) {
+	return map[string]string{
+		"LocalDefaultAddressSpace":  ipamAddressSpace,
+		"GlobalDefaultAddressSpace": ipamAddressSpace,
+	}, nil
+}
+
+func getDockerPool(poolID string) (*dockerPool, *net.IPNet, error) {
+	data, ok := datastore.Get(dockerPoolStore, poolID)
+	if !ok {
+		return nil, nil, ErrUnknownPool
+	}
+	pool := &dockerPool{}
+	if err := json.Unmarshal(data, pool); err != nil {
+		return nil, nil, err
+	}
+	_, subnet, err := net.ParseCIDR(pool.Pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pool, subnet, nil
+}
+
+// checkPoolOverlaps checks that a subnet overlaps no network, route or other
+// pool, as GetAvailableSubnet does
+func checkPoolOverlaps(subnet *net.IPNet) error {
+	if err := CheckSubnetOverlaps("", subnet, false); err != nil {
+		return err
+	}
+	values, _ := datastore.GetAll(dockerPoolStore)
+	for _, value := range values {
+		pool := &dockerPool{}
+		if err := json.Unmarshal(value, pool); err != nil {
+			continue
+		}
+		if _, other, err := net.ParseCIDR(pool.Pool); err == nil && NetworkOverlaps(subnet, other) {
+			return &SubnetConflictError{
+				Message: "Subnet " + subnet.String() + " overlaps the pool " + other.String(),
+				Subnet:  subnet.String(),
+			}
+		}
+	}
+	return nil
+}
+
+func ipamRequestPool(d *Daemon, body []byte) (interface{}, error) {
+	request := &ipamRequestPoolRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	if len(request.Options) > 0 {
+		return nil, fmt.Errorf("Unsupported pool options %v", request.Options)
+	}
+	pool := &dockerPool{SubPool: request.SubPool}
+	var subnet *net.IPNet
+	var network string
+	var err error
+	if request.Pool != "" {
+		if _, subnet, err = net.ParseCIDR(request.Pool); err != nil {
+			return nil, err
+		}
+		if (subnet.IP.To4() == nil) != request.V6 {
+			return nil, errors.New("Invalid pool " + request.Pool)
+		}
+		// Every host requests the pools of the networks of the global scope
+		if existing, _, err := getDockerPool(subnet.String()); err == nil && existing.SubPool == request.SubPool {
+			return &ipamRequestPoolResponse{PoolID: subnet.String(), Pool: subnet.String()}, nil
+		}
+		if network = subnetNetwork(subnet); network == "" {
+			if err := checkPoolOverlaps(subnet); err != nil {
+				return nil, err
+			}
+		}
+	} else if request.V6 {
+		return nil, errors.New("IPv6 pools must be requested with a subnet")
+	} else {
+		if subnet, err = AllocateSubnet(0); err != nil {
+			return nil, err
+		}
+		pool.Carved = true
+	}
+	pool.Pool = subnet.String()
+	release := func() {
+		if pool.Carved {
+			ReleaseSubnet(subnet)
+		}
+	}
+
+	ipamPool, err := NewIPAMPool(*subnet, request.SubPool, nil)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if network != "" {
+		if err := checkNetworkSubPool(network, ipamPool); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(pool)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := datastore.Put(dockerPoolStore, pool.Pool, data, nil); err != nil {
+		release()
+		if err == ErrDatastoreOutdated {
+			return nil, errors.New("Pool " + pool.Pool + " is already requested")
+		}
+		return nil, err
+	}
+	// The pool of a network is left to the network
+	if network != "" {
+		log.Infof("Docker pool %s requested for network %s", pool.Pool, network)
+		return &ipamRequestPoolResponse{PoolID: pool.Pool, Pool: pool.Pool}, nil
+	}
+	if err := SetIPAMPool(ipamPool); err != nil {
+		datastore.Delete(dockerPoolStore, pool.Pool)
+		release()
+		return nil, err
+	}
+	log.Infof("Docker pool %s requested", pool.Pool)
+	return &ipamRequestPoolResponse{PoolID: pool.Pool, Pool: pool.Pool}, nil
+}
+
+// checkNetworkSubPool makes sure that the range requested in the subnet of a
+// network, if any, is the pool of the network
+func checkNetworkSubPool(id string, ipamPool *IPAMPool) error {
+	if ipamPool.Pool == nil {
+		return nil
+	}
+	network, err := GetNetwork(id)
+	if err != nil {
+		return err
+	}
+	poolRange := network.Pool
+	if ipamPool.Subnet == network.Subnet6 {
+		poolRange = network.Pool6
+	}
+	if ipamPool.Pool.String() != poolRange {
+		return fmt.Errorf("Network %s has the range %q, not %s", id, poolRange, ipamPool.Pool.String())
+	}
+	return nil
+}
+
+// ipamReleasePool releases a pool. The pool of the subnet of a network is left
+// to the network, which releases it when it is deleted.
+func ipamReleasePool(d *Daemon, body []byte) (interface{}, error) {
+	request := &ipamReleasePoolRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	pool, subnet, err := getDockerPool(request.PoolID)
+	if err == ErrUnknownPool {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if network := subnetNetwork(subnet); network == "" {
+		if err := DeleteIPAMPool(pool.Pool); err != nil {
+			return nil, err
+		}
+		if pool.Carved {
+			if err := ReleaseSubnet(subnet); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := datastore.Delete(dockerPoolStore, pool.Pool); err != nil {
+		return nil, err
+	}
+	log.Infof("Docker pool %s released", pool.Pool)
+	return map[string]string{}, nil
+}
+
+// subnetNetwork returns the network of a subnet, "" if there is none
+func subnetNetwork(subnet *net.IPNet) string {
+	networks, err := GetNetworks()
+	if err != nil {
+		return ""
+	}
+	for _, network := range networks {
+		if network.Subnet == subnet.String() || network.Subnet6 == subnet.String() {
+			return network.ID
+		}
+	}
+	return ""
+}
+
+// ipamRequestAddress allocates an address of a pool, or reserves the address
+// requested. The allocations have no container, the addresses being released
+// by Docker rather than reconciled.
+func ipamRequestAddress(d *Daemon, body []byte) (interface{}, error) {
+	request := &ipamRequestAddressRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	_, subnet, err := getDockerPool(request.PoolID)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	if request.Address != "" {
+		if ip = net.ParseIP(request.Address); ip == nil || !subnet.Contains(ip) {
+			return nil, ErrAddressNotInSubnet
+		}
+		if err := IPAMRequestAddress(ip, *subnet); err != nil {
+			return nil, err
+		}
+	} else if ip = IPAMRequest(*subnet); ip == nil {
+		return nil, errors.New("No address available in " + subnet.String())
+	}
+	recordAllocation(ip, *subnet, subnetNetwork(subnet), "")
+	return &ipamRequestAddressResponse{Address: ip.String() + prefixLength(subnet)}, nil
+}
+
+func ipamReleaseAddress(d *Daemon, body []byte) (interface{}, error) {
+	request := &ipamReleaseAddressRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	_, subnet, err := getDockerPool(request.PoolID)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(request.Address)
+	if ip == nil {
+		return nil, errors.New("Invalid address " + request.Address)
+	}
+	IPAMRelease(ip, *subnet)
+	return map[string]string{}, nil
+}
+
+// dockerPoolIPAM returns the IPAM pool of a subnet requested by Docker, so
+// that the network created in it keeps the requested range
+func dockerPoolIPAM(subnet *net.IPNet) []*IPAMPool {
+	if subnet == nil {
+		return nil
+	}
+	if _, _, err := getDockerPool(subnet.String()); err != nil {
+		return nil
+	}
+	pool, err := GetIPAMPool(*subnet)
+	if err != nil {
+		return nil
+	}
+	return []*IPAMPool{pool}
+}
+
+// dockerAllocated reports whether an address was allocated by Docker through
+// the IPAM driver, rather than for a container or as the gateway of a network
+func dockerAllocated(ip net.IP, subnet *net.IPNet) bool {
+	if _, _, err := getDockerPool(subnet.String()); err != nil {
+		return false
+	}
+	data, ok := datastore.Get(ipamAllocationStore, ip.String())
+	if !ok {
+		return false
+	}
+	allocation := &IPAMAllocation{}
+	if err := json.Unmarshal(data, allocation); err != nil {
+		return false
+	}
+	if allocation.Subnet != subnet.String() || allocation.ContainerID != "" {
+		return false
+	}
+	if network, err := GetNetwork(allocation.Network); err == nil {
+		return network.Gateway != ip.String() && network.Gateway6 != ip.String()
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestIPAMDefaultAddressSpaces(t *testing.T) {
+	d := NewDaemon()
+	spaces := map[string]string{}
+	if code := pluginCall(t, d, "IpamDriver.GetDefaultAddressSpaces", nil, &spaces); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if spaces["LocalDefaultAddressSpace"] != ipamAddressSpace || spaces["GlobalDefaultAddressSpace"] != ipamAddressSpace {
+		t.Fatalf("Unexpected address spaces %v", spaces)
+	}
+}
+
+func TestIPAMDriverRequestPool(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withSubnetPool([]string{"10.100.0.0/16"}, 24)()
+	defer withRouteDestinations([]string{"192.168.1.0/24"})()
+	d := NewDaemon()
+
+	response := &ipamRequestPoolResponse{}
+	if code := pluginCall(t, d, "IpamDriver.RequestPool", &ipamRequestPoolRequest{}, response); code != http.StatusOK || response.PoolID != "10.100.0.0/24" {
+		t.Fatalf("Expected a pool carved out of the subnet pool, got %d %+v", code, response)
+	}
+	request := &ipamRequestPoolRequest{Pool: "10.2.0.0/24", SubPool: "10.2.0.128/25"}
+	for i := 0; i < 2; i++ {
+		response = &ipamRequestPoolResponse{}
+		if code := pluginCall(t, d, "IpamDriver.RequestPool", request, response); code != http.StatusOK || response.Pool != "10.2.0.0/24" {
+			t.Fatalf("Expected the requested pool, got %d %+v", code, response)
+		}
+	}
+	for _, pool := range []string{"10.2.0.0/16", "10.100.0.0/25", "192.168.1.0/24"} {
+		if code := pluginCall(t, d, "IpamDriver.RequestPool", &ipamRequestPoolRequest{Pool: pool}, nil); code != http.StatusInternalServerError {
+			t.Fatalf("%s : an overlapping pool should be refused, got %d", pool, code)
+		}
+	}
+	if code := pluginCall(t, d, "IpamDriver.RequestPool", &ipamRequestPoolRequest{V6: true}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("An IPv6 pool without subnet should be refused, got %d", code)
+	}
+
+	address := &ipamRequestAddressResponse{}
+	pluginCall(t, d, "IpamDriver.RequestAddress", &ipamRequestAddressRequest{PoolID: "10.2.0.0/24"}, address)
+	ip, _, err := net.ParseCIDR(address.Address)
+	_, subPool, _ := net.ParseCIDR("10.2.0.128/25")
+	if err != nil || !subPool.Contains(ip) {
+		t.Fatalf("Expected an address of the sub pool, got %q", address.Address)
+	}
+	requested := &ipamRequestAddressRequest{PoolID: "10.2.0.0/24", Address: "10.2.0.200"}
+	if code := pluginCall(t, d, "IpamDriver.RequestAddress", requested, address); code != http.StatusOK || address.Address != "10.2.0.200/24" {
+		t.Fatalf("Expected the requested address, got %d %+v", code, address)
+	}
+	if code := pluginCall(t, d, "IpamDriver.RequestAddress", requested, nil); code != http.StatusInternalServerError {
+		t.Fatalf("An address in use should be refused, got %d", code)
+	}
+	pluginCall(t, d, "IpamDriver.ReleaseAddress", &ipamReleaseAddressRequest{PoolID: "10.2.0.0/24", Address: "10.2.0.200"}, nil)
+	if code := pluginCall(t, d, "IpamDriver.RequestAddress", requested, nil); code != http.StatusOK {
+		t.Fatalf("A released address should be available, got %d", code)
+	}
+	if code := pluginCall(t, d, "IpamDriver.RequestAddress", &ipamRequestAddressRequest{PoolID: "10.3.0.0/24"}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("An unknown pool should be refused, got %d", code)
+	}
+
+	pluginCall(t, d, "IpamDriver.ReleasePool", &ipamReleasePoolRequest{"10.100.0.0/24"}, nil)
+	if _, _, err := getDockerPool("10.100.0.0/24"); err != ErrUnknownPool {
+		t.Fatal("The pool should be released")
+	}
+	if subnet, err := AllocateSubnet(0); err != nil || subnet.String() != "10.100.0.0/24" {
+		t.Fatalf("The carved subnet should be released, got %v %v", subnet, err)
+	}
+}
+
+func TestDriverAdoptsIPAMAddresses(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations(nil)()
+	d := NewDaemon()
+	pluginCall(t, d, "IpamDriver.RequestPool", &ipamRequestPoolRequest{Pool: "10.3.0.0/24"}, nil)
+	putNetwork(t, &Network{ID: "web", Subnet: "10.3.0.0/24", Gateway: "10.3.0.1", VNI: 1})
+	putDockerNetwork(t, "n1", "web")
+	_, subnet, _ := net.ParseCIDR("10.3.0.0/24")
+	IPAMRequestAddress(net.ParseIP("10.3.0.1"), *subnet)
+	recordAllocation(net.ParseIP("10.3.0.1"), *subnet, "web", "")
+
+	address := &ipamRequestAddressResponse{}
+	pluginCall(t, d, "IpamDriver.RequestAddress", &ipamRequestAddressRequest{PoolID: "10.3.0.0/24"}, address)
+	if address.Address != "10.3.0.2/24" {
+		t.Fatalf("Unexpected address %+v", address)
+	}
+	request := &driverCreateEndpointRequest{NetworkID: "n1", EndpointID: "e1", Interface: &driverInterface{Address: address.Address}}
+	if code := pluginCall(t, d, "NetworkDriver.CreateEndpoint", request, nil); code != http.StatusOK {
+		t.Fatalf("The address allocated by Docker should be adopted, got %d", code)
+	}
+	if endpoint, _, err := getEndpoint("e1"); err != nil || len(endpoint.Adopted) != 1 {
+		t.Fatalf("Unexpected endpoint %+v %v", endpoint, err)
+	}
+	request = &driverCreateEndpointRequest{NetworkID: "n1", EndpointID: "e2", Interface: &driverInterface{Address: "10.3.0.1/24"}}
+	if code := pluginCall(t, d, "NetworkDriver.CreateEndpoint", request, nil); code != http.StatusInternalServerError {
+		t.Fatalf("The gateway should not be adopted, got %d", code)
+	}
+
+	// Docker releases the adopted addresses
+	pluginCall(t, d, "NetworkDriver.DeleteEndpoint", &driverEndpointRequest{"n1", "e1"}, nil)
+	if err := IPAMRequestAddress(net.ParseIP("10.3.0.2"), *subnet); err != ErrAddressInUse {
+		t.Fatalf("The adopted address should not be released with the endpoint. %v", err)
+	}
+	pluginCall(t, d, "IpamDriver.ReleaseAddress", &ipamReleaseAddressRequest{PoolID: "10.3.0.0/24", Address: "10.3.0.2"}, nil)
+	if err := IPAMRequestAddress(net.ParseIP("10.3.0.2"), *subnet); err != nil {
+		t.Fatalf("The address should be released by Docker. %v", err)
+	}
+}
+
+func TestIPAMDriverRequestNetworkPool(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations(nil)()
+	putNetwork(t, &Network{ID: "web", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", VNI: 1, Pool: "10.1.0.128-10.1.0.255"})
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/24")
+	pool, _ := NewIPAMPool(*subnet, "10.1.0.128-10.1.0.255", nil)
+	SetIPAMPool(pool)
+	d := NewDaemon()
+
+	response := &ipamRequestPoolResponse{}
+	if code := pluginCall(t, d, "IpamDriver.RequestPool", &ipamRequestPoolRequest{Pool: "10.1.0.0/24"}, response); code != http.StatusOK || response.PoolID != "10.1.0.0/24" {
+		t.Fatalf("The subnet of a network should map onto its pool, got %d %+v", code, response)
+	}
+	if current, _ := GetIPAMPool(*subnet); current.Pool == nil || current.Pool.String() != "10.1.0.128-10.1.0.255" {
+		t.Fatalf("The pool of the network should be kept, got %+v", current)
+	}
+	pluginCall(t, d, "IpamDriver.ReleasePool", &ipamReleasePoolRequest{"10.1.0.0/24"}, nil)
+	if current, _ := GetIPAMPool(*subnet); current == nil || current.Pool == nil {
+		t.Fatal("The pool of the network should be left to the network")
+	}
+
+	for _, request := range []*ipamRequestPoolRequest{
+		{Pool: "10.1.0.0/24", SubPool: "10.1.0.0/25"},
+		{Pool: "10.1.0.0/25"},
+		{Pool: "10.2.0.0/24", Options: map[string]string{"foo": "bar"}},
+	} {
+		if code := pluginCall(t, d, "IpamDriver.RequestPool", request, nil); code != http.StatusInternalServerError {
+			t.Fatalf("%+v should be refused, got %d", request, code)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// pluginCall posts a request to the plugin API and decodes its response
+func pluginCall(t *testing.T, d *Daemon, method string, request interface{}, response interface{}) int {
+	data, _ := json.Marshal(request)
+	r, _ := http.NewRequest("POST", "/"+method, bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	createPluginRouter(d).ServeHTTP(w, r)
+	if w.HeaderMap.Get("Content-Type") != pluginContentType {
+		t.Fatalf("%s : unexpected content type %q", method, w.HeaderMap.Get("Content-Type"))
+	}
+	if response != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Fatalf("%s : %v", method, err)
+		}
+	}
+	return w.Code
+}
+
+func putDockerNetwork(t *testing.T, networkID string, network string) {
+	data, _ := json.Marshal(&dockerNetwork{Network: network, Owned: true})
+	if err := datastore.Put(dockerNetworkStore, networkID, data, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPluginActivate(t *testing.T) {
+	d := NewDaemon()
+	activation := map[string][]string{}
+	if code := pluginCall(t, d, "Plugin.Activate", nil, &activation); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if !reflect.DeepEqual(activation["Implements"], []string{"NetworkDriver", "IpamDriver"}) {
+		t.Fatalf("Unexpected activation %v", activation)
+	}
+	capabilities := map[string]string{}
+	pluginCall(t, d, "NetworkDriver.GetCapabilities", nil, &capabilities)
+	if capabilities["Scope"] != "global" {
+		t.Fatalf("Unexpected capabilities %v", capabilities)
+	}
+}
+
+func TestDockerNetworkName(t *testing.T) {
+	request := &driverCreateNetworkRequest{NetworkID: "0123456789abcdef0123"}
+	if name, owned := dockerNetworkName(request); name != "0123456789ab" || !owned {
+		t.Fatalf("Expected the short ID, got %s %v", name, owned)
+	}
+	request.Options = map[string]interface{}{
+		genericOptions: map[string]interface{}{networkOption: "web"},
+	}
+	if name, owned := dockerNetworkName(request); name != "web" || owned {
+		t.Fatalf("Expected the named network, got %s %v", name, owned)
+	}
+}
+
+func TestDriverIPAMSubnet(t *testing.T) {
+	subnet, gateway, err := driverIPAMSubnet(driverIPAMData{Pool: "10.3.0.0/24", Gateway: "10.3.0.254/24"})
+	if err != nil || subnet.String() != "10.3.0.0/24" || gateway.String() != "10.3.0.254" {
+		t.Fatalf("Expected the requested gateway, got %v %v %v", subnet, gateway, err)
+	}
+	if _, gateway, err := driverIPAMSubnet(driverIPAMData{Pool: "10.3.0.0/24"}); gateway != nil || err != nil {
+		t.Fatalf("Expected no gateway, got %v %v", gateway, err)
+	}
+	if _, _, err := driverIPAMSubnet(driverIPAMData{Pool: "10.3.0.0/24", Gateway: "10.4.0.1/24"}); err != ErrAddressNotInSubnet {
+		t.Fatalf("A gateway out of the subnet should be refused, got %v", err)
+	}
+}
+
+func TestDriverDeleteUnknown(t *testing.T) {
+	defer useMemoryDatastore()()
+	d := NewDaemon()
+	if code := pluginCall(t, d, "NetworkDriver.DeleteNetwork", &driverNetworkRequest{"n1"}, nil); code != http.StatusOK {
+		t.Fatalf("Deleting an unknown network should succeed, got %d", code)
+	}
+	if code := pluginCall(t, d, "NetworkDriver.DeleteEndpoint", &driverEndpointRequest{"n1", "e1"}, nil); code != http.StatusOK {
+		t.Fatalf("Deleting an unknown endpoint should succeed, got %d", code)
+	}
+	pluginErr := &pluginError{}
+	if code := pluginCall(t, d, "NetworkDriver.Join", &driverJoinRequest{NetworkID: "n1", EndpointID: "e1"}, pluginErr); code != http.StatusInternalServerError || pluginErr.Err != ErrUnknownEndpoint.Error() {
+		t.Fatalf("Joining an unknown endpoint should fail, got %d %+v", code, pluginErr)
+	}
+}
+
+func TestDriverEndpoint(t *testing.T) {
+	defer useMemoryDatastore()()
+	putNetwork(t, &Network{ID: "web", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", VNI: 1})
+	putDockerNetwork(t, "n1", "web")
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/24")
+	IPAMRequestAddress(net.ParseIP("10.1.0.1"), *subnet)
+	d := NewDaemon()
+
+	response := &driverCreateEndpointResponse{}
+	request := &driverCreateEndpointRequest{NetworkID: "n1", EndpointID: "e1"}
+	if code := pluginCall(t, d, "NetworkDriver.CreateEndpoint", request, response); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	expected := &driverInterface{Address: "10.1.0.2/24", MacAddress: generateMacAddr(net.ParseIP("10.1.0.2")).String()}
+	if !reflect.DeepEqual(response.Interface, expected) {
+		t.Fatalf("Expected interface %+v, got %+v", expected, response.Interface)
+	}
+
+	// The addresses assigned by Docker are reserved, and not returned
+	response = &driverCreateEndpointResponse{}
+	request = &driverCreateEndpointRequest{NetworkID: "n1", EndpointID: "e2", Interface: &driverInterface{Address: "10.1.0.9/24"}}
+	if code := pluginCall(t, d, "NetworkDriver.CreateEndpoint", request, response); code != http.StatusOK || response.Interface != nil {
+		t.Fatalf("Expected no interface, got %d %+v", code, response.Interface)
+	}
+	request = &driverCreateEndpointRequest{NetworkID: "n1", EndpointID: "e3", Interface: &driverInterface{Address: "10.1.0.9/24"}}
+	if code := pluginCall(t, d, "NetworkDriver.CreateEndpoint", request, nil); code != http.StatusInternalServerError {
+		t.Fatalf("An address in use should be refused, got %d", code)
+	}
+	allocations, _ := GetAllocations("web")
+	if len(allocations) != 2 || allocations[0].ContainerID != "e1" || allocations[1].ContainerID != "e2" {
+		t.Fatalf("Unexpected allocations %+v", allocations)
+	}
+	connections := endpointConnections(map[string]*Connection{})
+	if len(connections) != 2 || connections["e2"].ConnectionDetails.Ip != "10.1.0.9" {
+		t.Fatalf("The endpoints should be kept by the reconciliation : %v", connections)
+	}
+
+	info := map[string]OvsConnection{}
+	pluginCall(t, d, "NetworkDriver.EndpointOperInfo", &driverEndpointRequest{"n1", "e2"}, &info)
+	if info["Value"].Ip != "10.1.0.9" || info["Value"].Gateway != "10.1.0.1" {
+		t.Fatalf("Unexpected endpoint info %+v", info)
+	}
+	if code := pluginCall(t, d, "NetworkDriver.Leave", &driverEndpointRequest{"n1", "e2"}, nil); code != http.StatusOK {
+		t.Fatalf("Leaving an endpoint without port should succeed, got %d", code)
+	}
+	if code := pluginCall(t, d, "NetworkDriver.DeleteEndpoint", &driverEndpointRequest{"n1", "e2"}, nil); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if _, _, err := getEndpoint("e2"); err != ErrUnknownEndpoint {
+		t.Fatal("The endpoint should be deleted")
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.1.0.9"), *subnet); err != nil {
+		t.Fatalf("The address of the endpoint should be released. %v", err)
+	}
+}
+
+func TestDriverCreateNetworkExisting(t *testing.T) {
+	defer useMemoryDatastore()()
+	putNetwork(t, &Network{ID: "web", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", VNI: 1})
+	d := NewDaemon()
+
+	request := &driverCreateNetworkRequest{
+		NetworkID: "n1",
+		Options: map[string]interface{}{
+			genericOptions: map[string]interface{}{networkOption: "web"},
+		},
+		IPv4Data: []driverIPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+	}
+	if code := pluginCall(t, d, "NetworkDriver.CreateNetwork", request, nil); code != http.StatusOK {
+		t.Fatalf("The subnet of the network should be accepted, got %d", code)
+	}
+	for i, data := range []driverIPAMData{{Pool: "10.2.0.0/24"}, {Pool: "10.1.0.0/24", Gateway: "10.1.0.254/24"}} {
+		request.NetworkID = fmt.Sprintf("n%d", i+2)
+		request.IPv4Data = []driverIPAMData{data}
+		if code := pluginCall(t, d, "NetworkDriver.CreateNetwork", request, nil); code != http.StatusInternalServerError {
+			t.Fatalf("%+v differs from the network and should be refused, got %d", data, code)
+		}
+		if _, err := getDockerNetwork(request.NetworkID); err != ErrUnknownDockerNetwork {
+			t.Fatalf("%+v should not be recorded", data)
+		}
+	}
+}
+
+func TestDriverJoinTwice(t *testing.T) {
+	defer useMemoryDatastore()()
+	endpoint := &driverEndpoint{ID: "e1", Network: "web", Connection: OvsConnection{Name: "ovs1234567"}}
+	if err := putEndpoint(endpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon()
+	pluginErr := &pluginError{}
+	if code := pluginCall(t, d, "NetworkDriver.Join", &driverJoinRequest{NetworkID: "n1", EndpointID: "e1"}, pluginErr); code != http.StatusInternalServerError || pluginErr.Err != ErrEndpointJoined.Error() {
+		t.Fatalf("Joining a joined endpoint should fail, got %d %+v", code, pluginErr)
+	}
+}
@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/hashicorp/consul/api"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/hashicorp/consul/watch"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/hashicorp/serf/serf"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/ecc"
+)
+
+const consulAgentAddress = "127.0.0.1:8500"
+
+// eccDatastore backs the Datastore with the embedded Consul agent
+type eccDatastore struct {
+	sync.Mutex
+	running    bool
+	watchPlans []*watch.WatchPlan
+	stores     map[string][]DatastoreListener
+}
+
+func (e *eccDatastore) Start(bindInterface string, bootstrap bool) error {
+	if err := ecc.Start(bootstrap, bootstrap, bindInterface, dataDir); err != nil {
+		return err
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.running = true
+	for store := range e.stores {
+		e.watchStore(store)
+	}
+	return nil
+}
+
+func (e *eccDatastore) Join(address string) error {
+	return ecc.Join(address)
+}
+
+func (e *eccDatastore) Leave() error {
+	e.Lock()
+	e.running = false
+	for _, wp := range e.watchPlans {
+		wp.Stop()
+	}
+	e.watchPlans = nil
+	e.Unlock()
+
+	if err := ecc.Leave(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dataDir); err != nil {
+		log.Errorf("Error deleting data directory %s", err)
+		return err
+	}
+	return nil
+}
+
+func (e *eccDatastore) Get(store string, key string) ([]byte, bool) {
+	value, _, ok := ecc.Get(store, key)
+	return value, ok
+}
+
+func (e *eccDatastore) GetAll(store string) ([][]byte, bool) {
+	values, _, ok := ecc.GetAll(store)
+	return values, ok
+}
+
+func (e *eccDatastore) Put(store string, key string, value []byte, oldValue []byte) error {
+	switch ecc.Put(store, key, value, oldValue) {
+	case ecc.OK:
+		return nil
+	case ecc.OUTDATED:
+		return ErrDatastoreOutdated
+	}
+	return errors.New("Error updating " + store + "/" + key)
+}
+
+func (e *eccDatastore) Delete(store string, key string) error {
+	if ecc.Delete(store, key) != ecc.OK {
+		return errors.New("Error deleting " + store + "/" + key)
+	}
+	return nil
+}
+
+// Members returns the alive members of the Serf LAN pool. The Consul catalog
+// keeps the failed nodes until they are reaped, which would keep their
+// tunnels around.
+func (e *eccDatastore) Members() ([]string, error) {
+	e.Lock()
+	running := e.running
+	e.Unlock()
+	if !running {
+		return nil, errors.New("Datastore not started")
+	}
+	client, err := api.NewClient(&api.Config{Address: consulAgentAddress})
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := client.Agent().Members(false)
+	if err != nil {
+		return nil, err
+	}
+	members := []string{}
+	for _, node := range nodes {
+		if node.Status == int(serf.StatusAlive) && node.Addr != clusterAddress {
+			members = append(members, node.Addr)
+		}
+	}
+	return members, nil
+}
+
+func (e *eccDatastore) WatchNodes(listener DatastoreListener) {
+	ecc.RegisterForNodeUpdates(eccListener{listener})
+}
+
+func (e *eccDatastore) WatchStore(store string, listener DatastoreListener) {
+	e.Lock()
+	defer e.Unlock()
+	if e.stores == nil {
+		e.stores = make(map[string][]DatastoreListener)
+	}
+	listeners, ok := e.stores[store]
+	e.stores[store] = append(listeners, listener)
+	if !ok && e.running {
+		e.watchStore(store)
+	}
+}
+
+// watchStore runs a Consul keyprefix watch for the store. ecc does not
+// deliver store updates to its listeners, hence the watch plan is managed here.
+func (e *eccDatastore) watchStore(store string) {
+	params := make(map[string]interface{})
+	params["type"] = "keyprefix"
+	params["prefix"] = store + "/"
+	wp, err := watch.Parse(params)
+	if err != nil {
+		log.Errorf("Unable to watch store %s : %v", store, err)
+		return
+	}
+	wp.Handler = func(idx uint64, data interface{}) {
+		snapshot := make(map[string][]byte)
+		if pairs, ok := data.(api.KVPairs); ok {
+			for _, pair := range pairs {
+				snapshot[strings.TrimPrefix(pair.Key, store+"/")] = pair.Value
+			}
+		}
+		e.Lock()
+		listeners := e.stores[store]
+		e.Unlock()
+		for _, l := range listeners {
+			l.NotifyStoreUpdate(store, snapshot)
+		}
+	}
+	e.watchPlans = append(e.watchPlans, wp)
+	go func() {
+		if err := wp.Run(consulAgentAddress); err != nil {
+			log.Errorf("Error watching store %s : %v", store, err)
+		}
+	}()
+}
+
+// eccListener adapts a DatastoreListener to ecc.Listener
+type eccListener struct {
+	listener DatastoreListener
+}
+
+func (e eccListener) NotifyNodeUpdate(nType ecc.NotifyUpdateType, nodeAddress string) {
+	switch nType {
+	case ecc.NOTIFY_UPDATE_ADD:
+		e.listener.NotifyNodeUpdate(NotifyUpdateAdd, nodeAddress)
+	case ecc.NOTIFY_UPDATE_MODIFY:
+		e.listener.NotifyNodeUpdate(NotifyUpdateModify, nodeAddress)
+	case ecc.NOTIFY_UPDATE_DELETE:
+		e.listener.NotifyNodeUpdate(NotifyUpdateDelete, nodeAddress)
+	}
+}
+
+func (e eccListener) NotifyKeyUpdate(nType ecc.NotifyUpdateType, key string, data []byte) {
+}
+func (e eccListener) NotifyStoreUpdate(nType ecc.NotifyUpdateType, store string, data map[string][]byte) {
+}
@@ -0,0 +1,448 @@
+package daemon
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// etcd v2 keys API error codes
+const (
+	etcdKeyNotFound    = 100
+	etcdCompareFailed  = 101
+	etcdNodeExist      = 105
+	etcdIndexCleared   = 401
+	etcdNodesDir       = "nodes"
+	etcdDefaultTTL     = 30
+	etcdWatchTimeout   = 60 * time.Second
+	etcdRetryInterval  = 5 * time.Second
+	etcdDefaultPrefix  = "socketplane"
+	etcdDefaultAddress = "http://127.0.0.1:2379"
+)
+
+type etcdNode struct {
+	Key           string      `json:"key"`
+	Value         string      `json:"value,omitempty"`
+	Dir           bool        `json:"dir,omitempty"`
+	Nodes         []*etcdNode `json:"nodes,omitempty"`
+	ModifiedIndex uint64      `json:"modifiedIndex,omitempty"`
+}
+
+type etcdResponse struct {
+	Action    string    `json:"action,omitempty"`
+	Node      *etcdNode `json:"node,omitempty"`
+	ErrorCode int       `json:"errorCode,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Index     uint64    `json:"index,omitempty"`
+}
+
+// etcdDatastore backs the Datastore with an external etcd cluster using the
+// v2 keys API. Values are base64 encoded as etcd only stores strings.
+// Cluster membership is maintained by every daemon registering its address
+// under the nodes directory with a TTL.
+type etcdDatastore struct {
+	sync.Mutex
+	endpoints   []string
+	prefix      string
+	ttl         int
+	client      *http.Client
+	watchClient *http.Client
+	nodeAddress string
+	running     bool
+	stopCh      chan bool
+	stores      map[string][]DatastoreListener
+	nodes       []DatastoreListener
+}
+
+func NewEtcdDatastore(endpoints []string, prefix string, ttl int) Datastore {
+	if len(endpoints) == 0 {
+		endpoints = []string{etcdDefaultAddress}
+	}
+	if prefix == "" {
+		prefix = etcdDefaultPrefix
+	}
+	if ttl <= 0 {
+		ttl = etcdDefaultTTL
+	}
+	return &etcdDatastore{
+		endpoints:   endpoints,
+		prefix:      strings.Trim(prefix, "/"),
+		ttl:         ttl,
+		client:      &http.Client{Timeout: etcdRetryInterval},
+		watchClient: &http.Client{Timeout: etcdWatchTimeout},
+		stores:      make(map[string][]DatastoreListener),
+	}
+}
+
+func (e *etcdDatastore) Start(bindInterface string, bootstrap bool) error {
+	address := ""
+	if bindInterface != "" {
+		addr, err := GetIfaceAddr(bindInterface)
+		if err != nil {
+			return err
+		}
+		address = addr.IP.String()
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if e.running {
+		return errors.New("etcd datastore is already started")
+	}
+	e.nodeAddress = address
+	e.running = true
+	e.stopCh = make(chan bool)
+
+	if address != "" {
+		if err := e.register(); err != nil {
+			log.Errorf("Unable to register %s with etcd : %v", address, err)
+		}
+		go e.refresh(e.stopCh)
+	}
+	for store := range e.stores {
+		go e.watch(store, e.stopCh, e.storeHandler(store))
+	}
+	if len(e.nodes) > 0 {
+		go e.watch(etcdNodesDir, e.stopCh, e.nodeHandler())
+	}
+	return nil
+}
+
+// Join is a noop as etcd membership is handled by the etcd cluster itself.
+func (e *etcdDatastore) Join(address string) error {
+	log.Debugf("Ignoring join to %s. Membership is managed through etcd", address)
+	return nil
+}
+
+func (e *etcdDatastore) Leave() error {
+	e.Lock()
+	if !e.running {
+		e.Unlock()
+		return nil
+	}
+	e.running = false
+	close(e.stopCh)
+	address := e.nodeAddress
+	e.Unlock()
+
+	if address != "" {
+		if err := e.Delete(etcdNodesDir, address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *etcdDatastore) Get(store string, key string) ([]byte, bool) {
+	resp, _, err := e.request(e.client, "GET", e.key(store, key), nil)
+	if err != nil || resp.ErrorCode != 0 || resp.Node == nil {
+		return nil, false
+	}
+	value, err := b64.StdEncoding.DecodeString(resp.Node.Value)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (e *etcdDatastore) GetAll(store string) ([][]byte, bool) {
+	snapshot, _, ok := e.snapshot(store)
+	if !ok {
+		return nil, false
+	}
+	values := make([][]byte, 0, len(snapshot))
+	for _, value := range snapshot {
+		values = append(values, value)
+	}
+	return values, true
+}
+
+// Put follows the same semantics as ecc.Put. If the key exists and does not
+// match oldValue the update is rejected, else the write is guarded by the
+// modifiedIndex (or by prevExist=false) so that concurrent writers lose.
+func (e *etcdDatastore) Put(store string, key string, value []byte, oldValue []byte) error {
+	params := url.Values{}
+	resp, _, err := e.request(e.client, "GET", e.key(store, key), nil)
+	if err != nil {
+		return err
+	}
+	if resp.ErrorCode == etcdKeyNotFound {
+		params.Set("prevExist", "false")
+	} else if resp.ErrorCode != 0 || resp.Node == nil {
+		return fmt.Errorf("Error reading %s/%s : %s", store, key, resp.Message)
+	} else {
+		existing, _ := b64.StdEncoding.DecodeString(resp.Node.Value)
+		if string(existing) != string(oldValue) {
+			return ErrDatastoreOutdated
+		}
+		params.Set("prevIndex", strconv.FormatUint(resp.Node.ModifiedIndex, 10))
+	}
+	params.Set("value", b64.StdEncoding.EncodeToString(value))
+	resp, _, err = e.request(e.client, "PUT", e.key(store, key), params)
+	if err != nil {
+		return err
+	}
+	switch resp.ErrorCode {
+	case 0:
+		return nil
+	case etcdCompareFailed, etcdNodeExist:
+		return ErrDatastoreOutdated
+	}
+	return fmt.Errorf("Error updating %s/%s : %s", store, key, resp.Message)
+}
+
+func (e *etcdDatastore) Delete(store string, key string) error {
+	resp, _, err := e.request(e.client, "DELETE", e.key(store, key), nil)
+	if err != nil {
+		return err
+	}
+	if resp.ErrorCode != 0 && resp.ErrorCode != etcdKeyNotFound {
+		return fmt.Errorf("Error deleting %s/%s : %s", store, key, resp.Message)
+	}
+	return nil
+}
+
+func (e *etcdDatastore) Members() ([]string, error) {
+	e.Lock()
+	running := e.running
+	self := e.nodeAddress
+	e.Unlock()
+	if !running {
+		return nil, errors.New("Datastore not started")
+	}
+	snapshot, _, ok := e.snapshot(etcdNodesDir)
+	if !ok {
+		return nil, errors.New("Unable to list the nodes")
+	}
+	members := []string{}
+	for address := range snapshot {
+		if address != self {
+			members = append(members, address)
+		}
+	}
+	return members, nil
+}
+
+func (e *etcdDatastore) WatchNodes(listener DatastoreListener) {
+	e.Lock()
+	defer e.Unlock()
+	e.nodes = append(e.nodes, listener)
+	if len(e.nodes) == 1 && e.running {
+		go e.watch(etcdNodesDir, e.stopCh, e.nodeHandler())
+	}
+}
+
+func (e *etcdDatastore) WatchStore(store string, listener DatastoreListener) {
+	e.Lock()
+	defer e.Unlock()
+	listeners, ok := e.stores[store]
+	e.stores[store] = append(listeners, listener)
+	if !ok && e.running {
+		go e.watch(store, e.stopCh, e.storeHandler(store))
+	}
+}
+
+func (e *etcdDatastore) storeHandler(store string) func(map[string][]byte) {
+	return func(snapshot map[string][]byte) {
+		e.Lock()
+		listeners := e.stores[store]
+		e.Unlock()
+		for _, l := range listeners {
+			l.NotifyStoreUpdate(store, snapshot)
+		}
+	}
+}
+
+// nodeHandler converts snapshots of the nodes directory in to node add and
+// delete notifications, similar to the Consul nodes watch used by ecc.
+func (e *etcdDatastore) nodeHandler() func(map[string][]byte) {
+	members := make(map[string]bool)
+	return func(snapshot map[string][]byte) {
+		e.Lock()
+		listeners := e.nodes
+		self := e.nodeAddress
+		e.Unlock()
+		for address := range members {
+			if _, ok := snapshot[address]; !ok {
+				delete(members, address)
+				for _, l := range listeners {
+					l.NotifyNodeUpdate(NotifyUpdateDelete, address)
+				}
+			}
+		}
+		for address := range snapshot {
+			if address == self || members[address] {
+				continue
+			}
+			members[address] = true
+			for _, l := range listeners {
+				l.NotifyNodeUpdate(NotifyUpdateAdd, address)
+			}
+		}
+	}
+}
+
+// watch delivers a snapshot of the directory to the handler every time
+// any key under the directory changes, until stopCh is closed.
+func (e *etcdDatastore) watch(dir string, stopCh chan bool, handler func(map[string][]byte)) {
+	for {
+		snapshot, index, ok := e.snapshot(dir)
+		if !ok {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(etcdRetryInterval):
+				continue
+			}
+		}
+		handler(snapshot)
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			params := url.Values{}
+			params.Set("wait", "true")
+			params.Set("recursive", "true")
+			params.Set("waitIndex", strconv.FormatUint(index+1, 10))
+			resp, _, err := e.request(e.watchClient, "GET", e.key(dir, ""), params)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				log.Debugf("Error watching %s : %v", dir, err)
+				time.Sleep(etcdRetryInterval)
+			} else if resp.ErrorCode != 0 && resp.ErrorCode != etcdIndexCleared {
+				log.Debugf("Error watching %s : %s", dir, resp.Message)
+				time.Sleep(etcdRetryInterval)
+			}
+			break
+		}
+	}
+}
+
+// snapshot returns the decoded leaf values under dir keyed by their path
+// relative to dir, along with the etcd index the snapshot was taken at.
+func (e *etcdDatastore) snapshot(dir string) (map[string][]byte, uint64, bool) {
+	params := url.Values{}
+	params.Set("recursive", "true")
+	resp, index, err := e.request(e.client, "GET", e.key(dir, ""), params)
+	if err != nil {
+		return nil, 0, false
+	}
+	snapshot := make(map[string][]byte)
+	if resp.ErrorCode == etcdKeyNotFound {
+		return snapshot, index, true
+	}
+	if resp.ErrorCode != 0 || resp.Node == nil {
+		return nil, 0, false
+	}
+	base := "/" + path.Join(e.prefix, dir) + "/"
+	var flatten func(node *etcdNode)
+	flatten = func(node *etcdNode) {
+		if node.Dir {
+			for _, child := range node.Nodes {
+				flatten(child)
+			}
+			return
+		}
+		if value, err := b64.StdEncoding.DecodeString(node.Value); err == nil {
+			snapshot[strings.TrimPrefix(node.Key, base)] = value
+		}
+	}
+	flatten(resp.Node)
+	return snapshot, index, true
+}
+
+func (e *etcdDatastore) register() error {
+	params := url.Values{}
+	params.Set("value", b64.StdEncoding.EncodeToString([]byte(e.nodeAddress)))
+	params.Set("ttl", strconv.Itoa(e.ttl))
+	resp, _, err := e.request(e.client, "PUT", e.key(etcdNodesDir, e.nodeAddress), params)
+	if err != nil {
+		return err
+	}
+	if resp.ErrorCode != 0 {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
+
+// refresh keeps the node registration alive until stopCh is closed
+func (e *etcdDatastore) refresh(stopCh chan bool) {
+	interval := time.Duration(e.ttl) * time.Second / 3
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+			if err := e.register(); err != nil {
+				log.Errorf("Unable to refresh etcd registration : %v", err)
+			}
+		}
+	}
+}
+
+func (e *etcdDatastore) key(store string, key string) string {
+	return "/v2/keys/" + path.Join(e.prefix, store, key)
+}
+
+// request tries each of the configured endpoints in turn and returns the
+// decoded response of the first one that is reachable along with the
+// X-Etcd-Index header.
+func (e *etcdDatastore) request(client *http.Client, method string, key string, params url.Values) (*etcdResponse, uint64, error) {
+	var err error
+	for _, endpoint := range e.endpoints {
+		var req *http.Request
+		if method == "PUT" {
+			req, err = http.NewRequest(method, endpoint+key, strings.NewReader(params.Encode()))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+		} else {
+			u := endpoint + key
+			if len(params) > 0 {
+				u += "?" + params.Encode()
+			}
+			req, err = http.NewRequest(method, u, nil)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, 0, err
+			}
+			log.Debugf("Error (%v) connecting to etcd at %s", err, endpoint)
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		etcdResp := &etcdResponse{}
+		if err = json.Unmarshal(body, etcdResp); err != nil {
+			return nil, 0, err
+		}
+		index, _ := strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+		return etcdResp, index, nil
+	}
+	return nil, 0, err
+}
@@ -0,0 +1,263 @@
+package daemon
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is a minimal stand-in for the etcd v2 keys API
+type fakeEtcd struct {
+	sync.Mutex
+	index  uint64
+	keys   map[string]*etcdNode
+	events []*etcdNode
+}
+
+func newFakeEtcd() *httptest.Server {
+	return httptest.NewServer(&fakeEtcd{keys: make(map[string]*etcdNode)})
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	r.ParseForm()
+	if r.Method == "GET" && r.Form.Get("wait") == "true" {
+		waitIndex, _ := strconv.ParseUint(r.Form.Get("waitIndex"), 10, 64)
+		for {
+			f.Lock()
+			for _, event := range f.events {
+				if event.ModifiedIndex >= waitIndex && strings.HasPrefix(event.Key, key) {
+					f.reply(w, http.StatusOK, &etcdResponse{Action: "set", Node: event})
+					f.Unlock()
+					return
+				}
+			}
+			f.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	switch r.Method {
+	case "GET":
+		if node, ok := f.keys[key]; ok {
+			f.reply(w, http.StatusOK, &etcdResponse{Action: "get", Node: node})
+			return
+		}
+		dir := &etcdNode{Key: key, Dir: true}
+		for k, node := range f.keys {
+			if strings.HasPrefix(k, key+"/") {
+				dir.Nodes = append(dir.Nodes, node)
+			}
+		}
+		if len(dir.Nodes) == 0 {
+			f.reply(w, http.StatusNotFound, &etcdResponse{ErrorCode: etcdKeyNotFound, Message: "Key not found"})
+			return
+		}
+		f.reply(w, http.StatusOK, &etcdResponse{Action: "get", Node: dir})
+	case "PUT":
+		existing, ok := f.keys[key]
+		if r.Form.Get("prevExist") == "false" && ok {
+			f.reply(w, http.StatusPreconditionFailed, &etcdResponse{ErrorCode: etcdNodeExist, Message: "Key already exists"})
+			return
+		}
+		if prevIndex := r.Form.Get("prevIndex"); prevIndex != "" {
+			if !ok || strconv.FormatUint(existing.ModifiedIndex, 10) != prevIndex {
+				f.reply(w, http.StatusPreconditionFailed, &etcdResponse{ErrorCode: etcdCompareFailed, Message: "Compare failed"})
+				return
+			}
+		}
+		f.index++
+		node := &etcdNode{Key: key, Value: r.Form.Get("value"), ModifiedIndex: f.index}
+		f.keys[key] = node
+		f.events = append(f.events, node)
+		f.reply(w, http.StatusOK, &etcdResponse{Action: "set", Node: node})
+	case "DELETE":
+		if _, ok := f.keys[key]; !ok {
+			f.reply(w, http.StatusNotFound, &etcdResponse{ErrorCode: etcdKeyNotFound, Message: "Key not found"})
+			return
+		}
+		delete(f.keys, key)
+		f.index++
+		node := &etcdNode{Key: key, ModifiedIndex: f.index}
+		f.events = append(f.events, node)
+		f.reply(w, http.StatusOK, &etcdResponse{Action: "delete", Node: node})
+	}
+}
+
+func (f *fakeEtcd) reply(w http.ResponseWriter, code int, resp *etcdResponse) {
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+	w.WriteHeader(code)
+	data, _ := json.Marshal(resp)
+	w.Write(data)
+}
+
+type testNodeListener struct {
+	added   chan string
+	deleted chan string
+}
+
+func (l testNodeListener) NotifyNodeUpdate(nType NotifyUpdateType, nodeAddress string) {
+	if nType == NotifyUpdateAdd {
+		l.added <- nodeAddress
+	} else if nType == NotifyUpdateDelete {
+		l.deleted <- nodeAddress
+	}
+}
+
+func (l testNodeListener) NotifyStoreUpdate(store string, data map[string][]byte) {
+}
+
+func TestEtcdDatastorePut(t *testing.T) {
+	server := newFakeEtcd()
+	defer server.Close()
+	ds := NewEtcdDatastore([]string{server.URL}, "", 0)
+
+	if _, ok := ds.Get("test", "foo"); ok {
+		t.Fatal("key should not exist")
+	}
+	if err := ds.Put("test", "foo", []byte{0, 1, 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	value, ok := ds.Get("test", "foo")
+	if !ok || !bytes.Equal(value, []byte{0, 1, 2}) {
+		t.Fatal("value not stored")
+	}
+	if err := ds.Put("test", "foo", []byte{3}, []byte{4}); err != ErrDatastoreOutdated {
+		t.Fatal("compare-and-swap with a stale value should be outdated")
+	}
+	if err := ds.Put("test", "foo", []byte{3}, []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Put("test", "10.1.0.0/16", []byte{5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	values, ok := ds.GetAll("test")
+	if !ok || len(values) != 2 {
+		t.Fatal("GetAll returned incorrect values")
+	}
+	if err := ds.Delete("test", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.Get("test", "foo"); ok {
+		t.Fatal("key should have been deleted")
+	}
+}
+
+func TestEtcdDatastoreConcurrentCreate(t *testing.T) {
+	server := newFakeEtcd()
+	defer server.Close()
+	ds := NewEtcdDatastore([]string{server.URL}, "", 0)
+	other := NewEtcdDatastore([]string{server.URL}, "", 0)
+
+	if err := other.Put("test", "foo", []byte("other"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// A writer that believes the key does not exist must lose
+	if err := ds.Put("test", "foo", []byte("mine"), nil); err != ErrDatastoreOutdated {
+		t.Fatal("creating an existing key should be outdated")
+	}
+}
+
+func TestEtcdDatastoreUnreachableEndpoint(t *testing.T) {
+	server := newFakeEtcd()
+	defer server.Close()
+	ds := NewEtcdDatastore([]string{"http://127.0.0.1:1", server.URL}, "", 0)
+	if err := ds.Put("test", "foo", []byte("bar"), nil); err != nil {
+		t.Fatal("should fall back to the next endpoint : ", err)
+	}
+}
+
+func TestEtcdDatastoreWatchStore(t *testing.T) {
+	server := newFakeEtcd()
+	defer server.Close()
+	ds := NewEtcdDatastore([]string{server.URL}, "", 0)
+	l := testStoreListener{make(chan map[string][]byte, 10)}
+	ds.WatchStore("test", l)
+	if err := ds.Start("", true); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Leave()
+
+	if snapshot := <-l.updates; len(snapshot) != 0 {
+		t.Fatal("initial snapshot should be empty")
+	}
+	ds.Put("test", "foo", []byte("bar"), nil)
+	select {
+	case snapshot := <-l.updates:
+		if !bytes.Equal(snapshot["foo"], []byte("bar")) {
+			t.Fatal("watch did not deliver the update")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for store update")
+	}
+}
+
+func TestEtcdDatastoreWatchNodes(t *testing.T) {
+	server := newFakeEtcd()
+	defer server.Close()
+	ds := NewEtcdDatastore([]string{server.URL}, "", 0)
+	l := testNodeListener{make(chan string, 10), make(chan string, 10)}
+	ds.WatchNodes(l)
+	if err := ds.Start("lo", true); err != nil {
+		t.Skip("Unable to bind to lo : ", err)
+	}
+	defer ds.Leave()
+
+	// Emulate another daemon registering itself
+	peer := NewEtcdDatastore([]string{server.URL}, "", 0)
+	peer.Put(etcdNodesDir, "10.0.0.2", []byte("10.0.0.2"), nil)
+	select {
+	case address := <-l.added:
+		if address != "10.0.0.2" {
+			t.Fatalf("Expected 10.0.0.2 to be added, got %s", address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for node add")
+	}
+
+	peer.Delete(etcdNodesDir, "10.0.0.2")
+	select {
+	case address := <-l.deleted:
+		if address != "10.0.0.2" {
+			t.Fatalf("Expected 10.0.0.2 to be deleted, got %s", address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for node delete")
+	}
+
+	select {
+	case address := <-l.added:
+		t.Fatalf("Unexpected node add for %s", address)
+	default:
+	}
+}
+
+func TestIPAMRequestEtcdDatastore(t *testing.T) {
+	server := newFakeEtcd()
+	defer server.Close()
+	orig := datastore
+	SetDatastore(NewEtcdDatastore([]string{server.URL}, "", 0))
+	defer SetDatastore(orig)
+
+	_, ipNet, _ := net.ParseCIDR("10.10.20.0/24")
+	for i := 1; i < 5; i++ {
+		address := IPAMRequest(*ipNet).To4()
+		if int(address[3]) != i {
+			t.Fatal(address.String())
+		}
+	}
+	raw, ok := datastore.Get(ipamStore, ipNet.String())
+	if !ok || b64.StdEncoding.EncodeToString(raw) == "" {
+		t.Fatal("ipam bitmap not stored")
+	}
+}
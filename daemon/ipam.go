@@ -1,53 +1,480 @@
 package daemon
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"math/rand"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/ecc"
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 )
 
-// Simple IPv4 IPAM solution using Consul Distributed KV store
+// Simple IPv4 IPAM solution using the Distributed KV store
 // Key = subnet, Value = Bit Array of available ip-addresses in a given subnet
+// Subnets larger than ipamChunkBits addresses are split into chunks so that
+// an allocation only rewrites a small value and allocations in different
+// chunks do not conflict. The first chunk keeps the subnet key, chunk n is
+// stored under "<subnet>-<n>".
 
-const dataStore = "ipam"
+const ipamStore = "ipam"
+const ipamChunkBits = 1024
 
-func IPAMRequest(subnet net.IPNet) net.IP {
-	bits := bitCount(subnet)
-	bc := int(bits / 8)
-	partial := int(math.Mod(bits, float64(8)))
+// Updates that keep losing the compare-and-swap to other hosts are retried
+// with an exponential backoff, then given up
+const ipamMaxRetries = 8
+const ipamRetryBackoff = time.Millisecond * 5
 
-	if partial != 0 {
-		bc += 1
+// Every allocation is recorded with its owner so that leaked addresses can be
+// traced and reclaimed.
+// Key = address, Value = IPAMAllocation
+const ipamAllocationStore = "ipam_allocation"
+
+// Allocations younger than the grace period are never reclaimed as their
+// connection may still be in progress
+const ipamReconcileGrace = time.Minute
+const ipamReconcileInterval = time.Minute * 5
+
+var (
+	ErrAddressNotInSubnet  = errors.New("Requested address is not a host address of the network subnet")
+	ErrAddressInUse        = errors.New("Requested address is already in use")
+	ErrIPAMContention      = errors.New("Too many concurrent updates of the address pool")
+	ErrPoolExhausted       = errors.New("No address available in the pool")
+	ErrAddressNotAllocated = errors.New("Address is not allocated")
+)
+
+// IPAMAllocation records who holds an address. Gateway addresses have no
+// container.
+type IPAMAllocation struct {
+	Address     string    `json:"address"`
+	Subnet      string    `json:"subnet"`
+	Network     string    `json:"network"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Host        string    `json:"host"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// bitmapIPAM is the default IPAMDriver. It keeps the allocations, pools and
+// carved subnets in the datastore.
+type bitmapIPAM struct{}
+
+// Request allocates the first free address of the pool of the subnet,
+// skipping the excluded addresses. The network and broadcast addresses are
+// never allocated.
+func (b *bitmapIPAM) Request(subnet net.IPNet) (net.IP, error) {
+	if subnet.IP.To4() == nil {
+		return ipam6Request(subnet)
+	}
+	if err := migrateIPAMBitmap(subnet); err != nil {
+		return nil, err
+	}
+	pool, err := getIPAMPool(subnet)
+	if err != nil {
+		return nil, err
+	}
+	// Bit n of the bitmap is the address at offset n+1
+	first, last := pool.bounds(subnet, 1, ipamHostCount(subnet))
+	if first > last {
+		return nil, ErrPoolExhausted
+	}
+	excluded := pool.excluded(subnet)
+	firstChunk, lastChunk := int((first-1)/ipamChunkBits), int((last-1)/ipamChunkBits)
+	count := lastChunk - firstChunk + 1
+	var address net.IP
+	err = retryIPAM(func() error {
+		address = nil
+		hint := ipamHints.get(subnet)
+		if hint < firstChunk || hint > lastChunk {
+			hint = firstChunk
+		}
+		for i := 0; i < count; i++ {
+			chunk := firstChunk + (hint-firstChunk+i)%count
+			base := uint64(chunk * ipamChunkBits)
+			from, to := uint64(0), uint64(ipamChunkLength(subnet, chunk))-1
+			if first-1 > base {
+				from = first - 1 - base
+			}
+			if last-1-base < to {
+				to = last - 1 - base
+			}
+			bitmap, oldValue := getIpamChunk(subnet, chunk)
+			bit, ok := firstClearBit(bitmap, uint(from), uint(to), func(bit uint) bool {
+				_, ok := excludedRange(excluded, base+uint64(bit)+1)
+				return ok
+			})
+			if !ok {
+				continue
+			}
+			setBit(bitmap, bit)
+			if err := datastore.Put(ipamStore, ipamChunkKey(subnet, chunk), bitmap, oldValue); err != nil {
+				return err
+			}
+			ipamHints.set(subnet, chunk)
+			address = getIP(subnet, uint(base)+bit+1)
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if address == nil {
+		return nil, ErrPoolExhausted
+	}
+	return address, nil
+}
+
+// RequestAddress reserves a specific address of the subnet. Addresses outside
+// of the pool of the subnet may be reserved, excluded ones may not.
+func (b *bitmapIPAM) RequestAddress(address net.IP, subnet net.IPNet) error {
+	if address == nil || !subnet.Contains(address) {
+		return ErrAddressNotInSubnet
+	}
+	pool, err := getIPAMPool(subnet)
+	if err != nil {
+		return err
+	}
+	if pool != nil && pool.excludes(address) {
+		return ErrAddressExcluded
+	}
+	if subnet.IP.To4() == nil {
+		return ipam6RequestAddress(address, subnet)
+	}
+	pos := getBitPosition(address, subnet)
+	if pos == 0 || uint64(pos) > ipamHostCount(subnet) {
+		return ErrAddressNotInSubnet
+	}
+	if err := migrateIPAMBitmap(subnet); err != nil {
+		return err
+	}
+	chunk, bit := int((pos-1)/ipamChunkBits), (pos-1)%ipamChunkBits
+	return retryIPAM(func() error {
+		bitmap, oldValue := getIpamChunk(subnet, chunk)
+		if testBit(bitmap, bit) {
+			return ErrAddressInUse
+		}
+		setBit(bitmap, bit)
+		return datastore.Put(ipamStore, ipamChunkKey(subnet, chunk), bitmap, oldValue)
+	})
+}
+
+func (b *bitmapIPAM) Release(address net.IP, subnet net.IPNet) error {
+	if subnet.IP.To4() == nil {
+		return ipam6Release(address, subnet)
+	}
+	if address == nil || !subnet.Contains(address) {
+		return ErrAddressNotInSubnet
+	}
+	pos := getBitPosition(address, subnet)
+	if pos == 0 || pos > uint(bitCount(subnet)) {
+		return ErrAddressNotInSubnet
+	}
+	if err := migrateIPAMBitmap(subnet); err != nil {
+		return err
+	}
+	chunk, bit := int((pos-1)/ipamChunkBits), (pos-1)%ipamChunkBits
+	found := true
+	err := retryIPAM(func() error {
+		bitmap, oldValue := getIpamChunk(subnet, chunk)
+		if oldValue == nil {
+			found = false
+			return nil
+		}
+		clearBit(bitmap, bit)
+		return datastore.Put(ipamStore, ipamChunkKey(subnet, chunk), bitmap, oldValue)
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrAddressNotAllocated
+	}
+	ipamHints.lower(subnet, chunk)
+	return nil
+}
+
+func (b *bitmapIPAM) GetPool(subnet net.IPNet) (*IPAMPool, error) {
+	return getIPAMPool(subnet)
+}
+
+func (b *bitmapIPAM) SetPool(pool *IPAMPool) error {
+	return setIPAMPool(pool)
+}
+
+func (b *bitmapIPAM) DeletePool(subnet string) error {
+	return deleteIPAMPool(subnet)
+}
+
+func (b *bitmapIPAM) RequestSubnet(prefixLength int) (*net.IPNet, error) {
+	return allocateSubnet(prefixLength)
+}
+
+func (b *bitmapIPAM) ReleaseSubnet(subnet *net.IPNet) error {
+	return releaseSubnet(subnet)
+}
+
+// retryIPAM runs an update until it no longer loses the compare-and-swap,
+// backing off exponentially between the attempts
+func retryIPAM(update func() error) error {
+	backoff := ipamRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := update()
+		if err != ErrDatastoreOutdated {
+			return err
+		}
+		if attempt == ipamMaxRetries {
+			return ErrIPAMContention
+		}
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+}
+
+func ipamChunkCount(subnet net.IPNet) int {
+	return (int(bitCount(subnet)) + ipamChunkBits - 1) / ipamChunkBits
+}
+
+// ipamChunkLength returns the number of addresses in a chunk
+func ipamChunkLength(subnet net.IPNet, chunk int) uint {
+	bits := int(bitCount(subnet)) - chunk*ipamChunkBits
+	if bits > ipamChunkBits {
+		bits = ipamChunkBits
+	}
+	return uint(bits)
+}
+
+func ipamChunkKey(subnet net.IPNet, chunk int) string {
+	if chunk == 0 {
+		return subnet.String()
 	}
-	addrArray, _, ok := ecc.Get(dataStore, subnet.String())
-	currVal := make([]byte, len(addrArray))
-	copy(currVal, addrArray)
+	return fmt.Sprintf("%s-%d", subnet.String(), chunk)
+}
+
+// getIpamChunk returns a writable bitmap of the chunk along with the stored
+// value to compare against. The stored value is nil for a new chunk.
+func getIpamChunk(subnet net.IPNet, chunk int) ([]byte, []byte) {
+	bitmap := make([]byte, (ipamChunkLength(subnet, chunk)+7)/8)
+	value, ok := datastore.Get(ipamStore, ipamChunkKey(subnet, chunk))
+	if !ok {
+		return bitmap, nil
+	}
+	copy(bitmap, value)
+	return bitmap, value
+}
+
+// migrateIPAMBitmap splits a bitmap stored as a single value into chunks
+func migrateIPAMBitmap(subnet net.IPNet) error {
+	if ipamHints.migrated(subnet) {
+		return nil
+	}
+	err := retryIPAM(func() error {
+		value, ok := datastore.Get(ipamStore, subnet.String())
+		size := len(value)
+		if !ok || size <= ipamChunkBits/8 {
+			return nil
+		}
+		for chunk := 1; chunk < ipamChunkCount(subnet) && chunk*ipamChunkBits/8 < size; chunk++ {
+			start := chunk * ipamChunkBits / 8
+			end := start + ipamChunkBits/8
+			if end > size {
+				end = size
+			}
+			// A chunk that already exists was migrated by another host
+			err := datastore.Put(ipamStore, ipamChunkKey(subnet, chunk), value[start:end], nil)
+			if err != nil && err != ErrDatastoreOutdated {
+				return err
+			}
+		}
+		return datastore.Put(ipamStore, subnet.String(), value[:ipamChunkBits/8], value)
+	})
+	if err == nil {
+		ipamHints.setMigrated(subnet)
+	}
+	return err
+}
+
+// firstClearBit returns the first clear bit from bit from up to bit to,
+// included, that is not skipped
+func firstClearBit(a []byte, from uint, to uint, skip func(uint) bool) (uint, bool) {
+	for k := from; k <= to; k++ {
+		if k%8 == 0 && a[k/8] == 0xFF {
+			k += 7
+			continue
+		}
+		if !testBit(a, k) && !skip(k) {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// ipamHostCount returns the number of host addresses of an IPv4 subnet, that
+// is all of its addresses but the network and broadcast addresses
+func ipamHostCount(subnet net.IPNet) uint64 {
+	bits := uint64(bitCount(subnet))
+	if bits < 4 {
+		return 0
+	}
+	return bits - 2
+}
+
+// ipamHintList remembers the first chunk of every subnet that may have a free
+// address, so that allocations in a busy subnet do not read every full chunk.
+// Chunks freed by other hosts are still found when the search wraps around.
+type ipamHintList struct {
+	sync.Mutex
+	chunks   map[string]int
+	upgraded map[string]bool
+}
+
+var ipamHints = &ipamHintList{chunks: make(map[string]int), upgraded: make(map[string]bool)}
+
+func (h *ipamHintList) get(subnet net.IPNet) int {
+	h.Lock()
+	defer h.Unlock()
+	return h.chunks[subnet.String()]
+}
+
+func (h *ipamHintList) set(subnet net.IPNet, chunk int) {
+	h.Lock()
+	defer h.Unlock()
+	h.chunks[subnet.String()] = chunk
+}
+
+func (h *ipamHintList) lower(subnet net.IPNet, chunk int) {
+	h.Lock()
+	defer h.Unlock()
+	if chunk < h.chunks[subnet.String()] {
+		h.chunks[subnet.String()] = chunk
+	}
+}
+
+func (h *ipamHintList) migrated(subnet net.IPNet) bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.upgraded[subnet.String()]
+}
+
+func (h *ipamHintList) setMigrated(subnet net.IPNet) {
+	h.Lock()
+	defer h.Unlock()
+	h.upgraded[subnet.String()] = true
+}
+
+func (h *ipamHintList) reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.chunks = make(map[string]int)
+	h.upgraded = make(map[string]bool)
+}
+
+func recordAllocation(address net.IP, subnet net.IPNet, network string, containerID string) {
+	allocation := &IPAMAllocation{
+		Address:     address.String(),
+		Subnet:      subnet.String(),
+		Network:     network,
+		ContainerID: containerID,
+		Host:        clusterAddress,
+		Timestamp:   time.Now(),
+	}
+	data, err := json.Marshal(allocation)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	err = retryIPAM(func() error {
+		oldValue, _ := datastore.Get(ipamAllocationStore, allocation.Address)
+		return datastore.Put(ipamAllocationStore, allocation.Address, data, oldValue)
+	})
+	if err != nil {
+		log.Errorf("Unable to record the allocation of %s. %v", allocation.Address, err)
+	}
+}
+
+func forgetAllocation(address net.IP, subnet net.IPNet) {
+	data, ok := datastore.Get(ipamAllocationStore, address.String())
 	if !ok {
-		addrArray = make([]byte, bc)
+		return
+	}
+	allocation := &IPAMAllocation{}
+	if err := json.Unmarshal(data, allocation); err == nil && allocation.Subnet != subnet.String() {
+		return
 	}
-	pos := testAndSetBit(addrArray)
-	eccerr := ecc.Put(dataStore, subnet.String(), addrArray, currVal)
-	if eccerr == ecc.OUTDATED {
-		return IPAMRequest(subnet)
+	if err := datastore.Delete(ipamAllocationStore, address.String()); err != nil {
+		log.Errorf("Unable to delete the allocation of %s. %v", address.String(), err)
 	}
-	return getIP(subnet, pos)
 }
 
-func IPAMRelease(address net.IP, subnet net.IPNet) bool {
-	addrArray, _, ok := ecc.Get(dataStore, subnet.String())
-	currVal := make([]byte, len(addrArray))
-	copy(currVal, addrArray)
+// GetAllocations returns the recorded allocations of a network sorted by
+// address
+func GetAllocations(network string) ([]IPAMAllocation, error) {
+	allocations := make([]IPAMAllocation, 0)
+	values, ok := datastore.GetAll(ipamAllocationStore)
 	if !ok {
-		return false
+		return allocations, nil
 	}
-	pos := getBitPosition(address, subnet)
-	clearBit(addrArray, pos-1)
-	eccerr := ecc.Put(dataStore, subnet.String(), addrArray, currVal)
-	if eccerr == ecc.OUTDATED {
-		return IPAMRelease(address, subnet)
+	for _, data := range values {
+		allocation := IPAMAllocation{}
+		if err := json.Unmarshal(data, &allocation); err != nil {
+			return nil, err
+		}
+		if allocation.Network == network {
+			allocations = append(allocations, allocation)
+		}
+	}
+	sort.Sort(byAllocationAddress(allocations))
+	return allocations, nil
+}
+
+type byAllocationAddress []IPAMAllocation
+
+func (b byAllocationAddress) Len() int      { return len(b) }
+func (b byAllocationAddress) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byAllocationAddress) Less(i, j int) bool {
+	return bytes.Compare(net.ParseIP(b[i].Address), net.ParseIP(b[j].Address)) < 0
+}
+
+// reconcileAllocations releases the container addresses allocated by this
+// host that are not held by any of the given live connections
+func reconcileAllocations(connections map[string]*Connection) []IPAMAllocation {
+	released := make([]IPAMAllocation, 0)
+	values, ok := datastore.GetAll(ipamAllocationStore)
+	if !ok {
+		return released
+	}
+	for _, data := range values {
+		allocation := IPAMAllocation{}
+		if err := json.Unmarshal(data, &allocation); err != nil {
+			log.Error(err)
+			continue
+		}
+		if allocation.ContainerID == "" || allocation.Host != clusterAddress ||
+			time.Since(allocation.Timestamp) < ipamReconcileGrace {
+			continue
+		}
+		if connection, ok := connections[allocation.ContainerID]; ok &&
+			(connection.ConnectionDetails.Ip == allocation.Address ||
+				connection.ConnectionDetails.Ip6 == allocation.Address) {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(allocation.Subnet)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Infof("Releasing orphaned address %s of container %s", allocation.Address, allocation.ContainerID)
+		address := net.ParseIP(allocation.Address)
+		if !IPAMRelease(address, *subnet) {
+			forgetAllocation(address, *subnet)
+		}
+		released = append(released, allocation)
 	}
-	return true
+	return released
 }
 
 func getBitPosition(address net.IP, subnet net.IPNet) uint {
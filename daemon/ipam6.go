@@ -0,0 +1,319 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// IPv6 subnets are too large for a bitmap. Only the allocated host offsets
+// are stored, along with the next offset to hand out so that addresses are
+// not reused right after being released.
+// Key = subnet, Value = ipam6Block
+// Addresses are allocated in the low 64 bits of the subnet. The offsets are
+// split into chunks of ipam6ChunkSize so that an allocation only rewrites a
+// small value, like the chunks of the IPv4 bitmap. The first chunk keeps the
+// subnet key, chunk n is stored under "<subnet>-<n>". The offsets of a chunk
+// are stored relative to its first offset.
+
+const ipam6Store = "ipam6"
+const ipam6ChunkSize = 1024
+
+type ipam6Block struct {
+	Next      uint64   `json:"next"`
+	Allocated []uint64 `json:"allocated"`
+}
+
+type uint64Slice []uint64
+
+func (u uint64Slice) Len() int           { return len(u) }
+func (u uint64Slice) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint64Slice) Less(i, j int) bool { return u[i] < u[j] }
+
+func (b *ipam6Block) index(offset uint64) (int, bool) {
+	i := sort.Search(len(b.Allocated), func(i int) bool { return b.Allocated[i] >= offset })
+	return i, i < len(b.Allocated) && b.Allocated[i] == offset
+}
+
+func (b *ipam6Block) add(offset uint64) bool {
+	i, found := b.index(offset)
+	if found {
+		return false
+	}
+	b.Allocated = append(b.Allocated, 0)
+	copy(b.Allocated[i+1:], b.Allocated[i:])
+	b.Allocated[i] = offset
+	return true
+}
+
+func (b *ipam6Block) remove(offset uint64) bool {
+	i, found := b.index(offset)
+	if !found {
+		return false
+	}
+	b.Allocated = append(b.Allocated[:i], b.Allocated[i+1:]...)
+	return true
+}
+
+// maxOffset6 returns the largest host offset of a subnet
+func maxOffset6(subnet net.IPNet) uint64 {
+	ones, bits := subnet.Mask.Size()
+	hostBits := uint(bits - ones)
+	if hostBits >= 64 {
+		return ^uint64(0)
+	}
+	return uint64(1)<<hostBits - 1
+}
+
+// offset6 returns the host offset of an address in a subnet. Addresses
+// outside of the low 64 bits of the subnet are not valid.
+func offset6(address net.IP, subnet net.IPNet) (uint64, bool) {
+	address = address.To16()
+	if address == nil || address.To4() != nil || !subnet.Contains(address) {
+		return 0, false
+	}
+	base := subnet.IP.To16()
+	for i := 0; i < 8; i++ {
+		if address[i] != base[i] {
+			return 0, false
+		}
+	}
+	offset := binary.BigEndian.Uint64(address[8:]) - binary.BigEndian.Uint64(base[8:])
+	return offset, offset <= maxOffset6(subnet)
+}
+
+func ip6At(subnet net.IPNet, offset uint64) net.IP {
+	address := make(net.IP, net.IPv6len)
+	copy(address, subnet.IP.To16())
+	binary.BigEndian.PutUint64(address[8:], binary.BigEndian.Uint64(address[8:])+offset)
+	return address
+}
+
+func ipam6ChunkKey(subnet net.IPNet, chunk uint64) string {
+	if chunk == 0 {
+		return subnet.String()
+	}
+	return fmt.Sprintf("%s-%d", subnet.String(), chunk)
+}
+
+func getIpam6Chunk(subnet net.IPNet, chunk uint64) (*ipam6Block, []byte, error) {
+	block := &ipam6Block{}
+	data, ok := datastore.Get(ipam6Store, ipam6ChunkKey(subnet, chunk))
+	if !ok {
+		return block, nil, nil
+	}
+	if err := json.Unmarshal(data, block); err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(uint64Slice(block.Allocated))
+	return block, data, nil
+}
+
+func putIpam6Chunk(subnet net.IPNet, chunk uint64, block *ipam6Block, oldValue []byte) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return datastore.Put(ipam6Store, ipam6ChunkKey(subnet, chunk), data, oldValue)
+}
+
+// chunkNext6 returns the next offset of a chunk, relative to the chunk, given
+// the next offset of the subnet
+func chunkNext6(next uint64, chunk uint64) uint64 {
+	base := chunk * ipam6ChunkSize
+	if next < base {
+		return 0
+	}
+	if next-base > ipam6ChunkSize {
+		return ipam6ChunkSize
+	}
+	return next - base
+}
+
+// migrateIpam6Block splits the offsets of a subnet stored as a single value
+// into chunks
+func migrateIpam6Block(subnet net.IPNet) error {
+	if ipamHints.migrated(subnet) {
+		return nil
+	}
+	var next uint64
+	err := retryIPAM(func() error {
+		block, oldValue, err := getIpam6Chunk(subnet, 0)
+		if err != nil {
+			return err
+		}
+		next = block.Next
+		if oldValue == nil || next <= ipam6ChunkSize &&
+			(len(block.Allocated) == 0 || block.Allocated[len(block.Allocated)-1] < ipam6ChunkSize) {
+			return nil
+		}
+		chunks := make(map[uint64]*ipam6Block)
+		for _, offset := range block.Allocated {
+			chunk := offset / ipam6ChunkSize
+			if chunks[chunk] == nil {
+				chunks[chunk] = &ipam6Block{Next: chunkNext6(next, chunk)}
+			}
+			chunks[chunk].Allocated = append(chunks[chunk].Allocated, offset%ipam6ChunkSize)
+		}
+		// The chunk of the next offset keeps it even without allocations
+		if chunks[next/ipam6ChunkSize] == nil {
+			chunks[next/ipam6ChunkSize] = &ipam6Block{Next: next % ipam6ChunkSize, Allocated: []uint64{}}
+		}
+		for chunk, b := range chunks {
+			if chunk == 0 {
+				continue
+			}
+			// A chunk that already exists was migrated by another host
+			err := putIpam6Chunk(subnet, chunk, b, nil)
+			if err != nil && err != ErrDatastoreOutdated {
+				return err
+			}
+		}
+		head := chunks[0]
+		if head == nil {
+			head = &ipam6Block{Next: chunkNext6(next, 0), Allocated: []uint64{}}
+		}
+		return putIpam6Chunk(subnet, 0, head, oldValue)
+	})
+	if err == nil {
+		ipamHints.setMigrated(subnet)
+		if next >= ipam6ChunkSize {
+			ipamHints.set(subnet, int(next/ipam6ChunkSize))
+		}
+	}
+	return err
+}
+
+// ipam6Request allocates the next free address of the pool of an IPv6
+// subnet, skipping the excluded addresses. Addresses released behind the
+// next offset of their chunk are handed out again only once no other
+// address is left.
+func ipam6Request(subnet net.IPNet) (net.IP, error) {
+	pool, err := getIPAMPool(subnet)
+	if err != nil {
+		return nil, err
+	}
+	// The subnet-router anycast address (offset 0) is never handed out
+	first, last := pool.bounds(subnet, 1, maxOffset6(subnet))
+	if first > last {
+		return nil, ErrPoolExhausted
+	}
+	if err := migrateIpam6Block(subnet); err != nil {
+		return nil, err
+	}
+	excluded := pool.excluded(subnet)
+	var address net.IP
+	err = retryIPAM(func() error {
+		address = nil
+		hint := uint64(ipamHints.get(subnet))
+		if hint < first/ipam6ChunkSize || hint > last/ipam6ChunkSize {
+			hint = first / ipam6ChunkSize
+		}
+		start := hint * ipam6ChunkSize
+		if start < first {
+			start = first
+		}
+		for _, reuse := range []bool{false, true} {
+			offset, wrapped := start, false
+			for !wrapped || offset < start {
+				chunk := offset / ipam6ChunkSize
+				base := chunk * ipam6ChunkSize
+				end := base + ipam6ChunkSize - 1
+				if end > last {
+					end = last
+				}
+				block, oldValue, err := getIpam6Chunk(subnet, chunk)
+				if err != nil {
+					return err
+				}
+				if !reuse && base+block.Next > offset {
+					offset = base + block.Next
+				}
+				for ; offset <= end; offset++ {
+					if r, ok := excludedRange(excluded, offset); ok {
+						if r.last >= end {
+							offset = end
+							break
+						}
+						offset = r.last
+					} else if block.add(offset - base) {
+						block.Next = offset - base + 1
+						if err := putIpam6Chunk(subnet, chunk, block, oldValue); err != nil {
+							return err
+						}
+						ipamHints.set(subnet, int(chunk))
+						address = ip6At(subnet, offset)
+						return nil
+					}
+				}
+				// Skip the chunks of an excluded range as a whole
+				if r, ok := excludedRange(excluded, end+1); ok && end < last {
+					end = r.last
+				}
+				if end >= last {
+					offset, wrapped = first, true
+				} else {
+					offset = end + 1
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if address == nil {
+		return nil, ErrPoolExhausted
+	}
+	return address, nil
+}
+
+func ipam6RequestAddress(address net.IP, subnet net.IPNet) error {
+	offset, ok := offset6(address, subnet)
+	if !ok || offset == 0 {
+		return ErrAddressNotInSubnet
+	}
+	if err := migrateIpam6Block(subnet); err != nil {
+		return err
+	}
+	chunk := offset / ipam6ChunkSize
+	return retryIPAM(func() error {
+		block, oldValue, err := getIpam6Chunk(subnet, chunk)
+		if err != nil {
+			return err
+		}
+		if !block.add(offset % ipam6ChunkSize) {
+			return ErrAddressInUse
+		}
+		return putIpam6Chunk(subnet, chunk, block, oldValue)
+	})
+}
+
+func ipam6Release(address net.IP, subnet net.IPNet) error {
+	offset, ok := offset6(address, subnet)
+	if !ok {
+		return ErrAddressNotInSubnet
+	}
+	if err := migrateIpam6Block(subnet); err != nil {
+		return err
+	}
+	chunk := offset / ipam6ChunkSize
+	found := true
+	err := retryIPAM(func() error {
+		block, oldValue, err := getIpam6Chunk(subnet, chunk)
+		if err != nil {
+			return err
+		}
+		if oldValue == nil || !block.remove(offset%ipam6ChunkSize) {
+			found = false
+			return nil
+		}
+		return putIpam6Chunk(subnet, chunk, block, oldValue)
+	})
+	if err == nil && !found {
+		return ErrAddressNotAllocated
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestIPAM6Request(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("fd00:10::/64")
+	for i := 1; i < 5; i++ {
+		address := IPAMRequest(*ipNet)
+		if offset, ok := offset6(address, *ipNet); !ok || offset != uint64(i) {
+			t.Fatal(address.String())
+		}
+	}
+
+	// Released addresses are not handed out again right away
+	IPAMRelease(net.ParseIP("fd00:10::2"), *ipNet)
+	if address := IPAMRequest(*ipNet); !address.Equal(net.ParseIP("fd00:10::5")) {
+		t.Fatal(address.String())
+	}
+}
+
+func TestIPAM6RequestAddress(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("fd00:20::/64")
+
+	if err := IPAMRequestAddress(net.ParseIP("fd00:20::1:2"), *ipNet); err != nil {
+		t.Fatal(err)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("fd00:20::1:2"), *ipNet); err != ErrAddressInUse {
+		t.Fatal("Reserving an address twice should conflict")
+	}
+	for _, address := range []string{"fd00:21::1", "fd00:20::", "10.0.0.1"} {
+		if err := IPAMRequestAddress(net.ParseIP(address), *ipNet); err != ErrAddressNotInSubnet {
+			t.Fatalf("%s should not be reservable", address)
+		}
+	}
+	if !IPAMRelease(net.ParseIP("fd00:20::1:2"), *ipNet) {
+		t.Fatal("Reserved address should be released")
+	}
+	if IPAMRelease(net.ParseIP("fd00:20::1:2"), *ipNet) {
+		t.Fatal("Address should not be released twice")
+	}
+}
+
+func TestIPAM6Exhausted(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("fd00:30::/126")
+	for i := 1; i < 4; i++ {
+		if address := IPAMRequest(*ipNet); address == nil {
+			t.Fatalf("Expected address %d to be allocated", i)
+		}
+	}
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("Subnet should be exhausted, got %s", address)
+	}
+	IPAMRelease(net.ParseIP("fd00:30::2"), *ipNet)
+	if address := IPAMRequest(*ipNet); !address.Equal(net.ParseIP("fd00:30::2")) {
+		t.Fatalf("Expected the released address, got %s", address)
+	}
+}
+
+func TestIPAM6RequestChunks(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("fd00:40::/117")
+
+	for i := 1; i < 2*ipam6ChunkSize; i++ {
+		address := IPAMRequest(*ipNet)
+		if offset, ok := offset6(address, *ipNet); !ok || offset != uint64(i) {
+			t.Fatalf("Expected offset %d, got %s", i, address)
+		}
+	}
+	block, _, _ := getIpam6Chunk(*ipNet, 1)
+	if len(block.Allocated) != ipam6ChunkSize || block.Allocated[0] != 0 {
+		t.Fatalf("The second chunk should hold its own offsets : %d", len(block.Allocated))
+	}
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("Subnet should be exhausted, got %s", address)
+	}
+	// Addresses released in an earlier chunk are found when the search wraps
+	IPAMRelease(net.ParseIP("fd00:40::7"), *ipNet)
+	if address := IPAMRequest(*ipNet); !address.Equal(net.ParseIP("fd00:40::7")) {
+		t.Fatalf("Expected the released address, got %s", address)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("fd00:40::400"), *ipNet); err != ErrAddressInUse {
+		t.Fatal("Address of the second chunk should be in use")
+	}
+}
+
+func TestIPAM6RequestExcludedChunks(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("fd00:41::/64")
+	// The excluded range spans millions of chunks
+	pool, _ := NewIPAMPool(*ipNet, "fd00:41::1-fd00:41::1:0:5", []string{"fd00:41::2-fd00:41::1:0:3"})
+	SetIPAMPool(pool)
+
+	for _, e := range []string{"fd00:41::1", "fd00:41::1:0:4", "fd00:41::1:0:5"} {
+		if address := IPAMRequest(*ipNet); address.String() != e {
+			t.Fatalf("Expected %s, got %s", e, address)
+		}
+	}
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("Exhausted pool allocated %s", address)
+	}
+}
+
+func TestIPAM6MigrateBlock(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("fd00:42::/64")
+
+	// Offsets written as a single value by an earlier version
+	legacy := &ipam6Block{Next: 2000, Allocated: []uint64{1, 1500, 70000}}
+	if err := putIpam6Chunk(*ipNet, 0, legacy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if address := IPAMRequest(*ipNet); !address.Equal(ip6At(*ipNet, 2000)) {
+		t.Fatalf("Expected the next offset of the legacy value, got %s", address)
+	}
+	for chunk, e := range map[uint64][]uint64{0: {1}, 1: {476, 976}, 68: {368}} {
+		if block, _, _ := getIpam6Chunk(*ipNet, chunk); !reflect.DeepEqual(block.Allocated, e) {
+			t.Fatalf("Chunk %d should hold %v, got %v", chunk, e, block.Allocated)
+		}
+	}
+	if !IPAMRelease(ip6At(*ipNet, 70000), *ipNet) {
+		t.Fatal("Migrated address should be released")
+	}
+}
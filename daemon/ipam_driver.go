@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/socketplane/socketplane/config"
+)
+
+// IPAMDriver allocates the addresses and subnets of the networks. The pool of
+// a subnet restricts the addresses that Request hands out.
+type IPAMDriver interface {
+	Request(subnet net.IPNet) (net.IP, error)
+	RequestAddress(address net.IP, subnet net.IPNet) error
+	Release(address net.IP, subnet net.IPNet) error
+	GetPool(subnet net.IPNet) (*IPAMPool, error)
+	// SetPool replaces the pool of a subnet. An empty pool is deleted.
+	SetPool(pool *IPAMPool) error
+	DeletePool(subnet string) error
+	// RequestSubnet returns a free IPv4 subnet of the given prefix length, or
+	// of the configured size if 0
+	RequestSubnet(prefixLength int) (*net.IPNet, error)
+	ReleaseSubnet(subnet *net.IPNet) error
+}
+
+var ipamDriver IPAMDriver = &bitmapIPAM{}
+
+func NewIPAMDriver(name string) (IPAMDriver, error) {
+	switch name {
+	case "", "bitmap":
+		return &bitmapIPAM{}, nil
+	case "http":
+		if config.IPAM.URL == "" {
+			return nil, errors.New("The http IPAM driver needs a url")
+		}
+		return NewHTTPIPAMDriver(config.IPAM.URL, config.IPAM.Timeout), nil
+	}
+	return nil, errors.New("Unknown IPAM driver " + name)
+}
+
+func SetIPAMDriver(driver IPAMDriver) {
+	ipamDriver = driver
+}
+
+// IPAMRequest allocates an address of the subnet. It returns nil when the
+// pool of the subnet is exhausted or the driver fails.
+func IPAMRequest(subnet net.IPNet) net.IP {
+	address, err := ipamDriver.Request(subnet)
+	if err != nil {
+		log.Errorf("Unable to allocate an address in %s. %v", subnet.String(), err)
+		return nil
+	}
+	return address
+}
+
+// IPAMRequestAddress reserves a specific address of the subnet
+func IPAMRequestAddress(address net.IP, subnet net.IPNet) error {
+	return ipamDriver.RequestAddress(address, subnet)
+}
+
+func IPAMRelease(address net.IP, subnet net.IPNet) bool {
+	if err := ipamDriver.Release(address, subnet); err != nil {
+		if err != ErrAddressNotAllocated {
+			log.Errorf("Unable to release %s. %v", address.String(), err)
+		}
+		return false
+	}
+	forgetAllocation(address, subnet)
+	return true
+}
+
+func GetIPAMPool(subnet net.IPNet) (*IPAMPool, error) {
+	return ipamDriver.GetPool(subnet)
+}
+
+func SetIPAMPool(pool *IPAMPool) error {
+	return ipamDriver.SetPool(pool)
+}
+
+func DeleteIPAMPool(subnet string) error {
+	return ipamDriver.DeletePool(subnet)
+}
+
+// AllocateSubnet returns a free IPv4 subnet for a new network
+func AllocateSubnet(prefixLength int) (*net.IPNet, error) {
+	return ipamDriver.RequestSubnet(prefixLength)
+}
+
+func ReleaseSubnet(subnet *net.IPNet) error {
+	return ipamDriver.ReleaseSubnet(subnet)
+}
@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ipamHTTPDefaultTimeout = 5 * time.Second
+
+// IPAMDriverRequest is the body of the requests of the http IPAM driver
+type IPAMDriverRequest struct {
+	Subnet       string    `json:"subnet,omitempty"`
+	Address      string    `json:"address,omitempty"`
+	PrefixLength int       `json:"prefix_length,omitempty"`
+	Pool         *IPAMPool `json:"pool,omitempty"`
+}
+
+// IPAMDriverResponse is the body of the responses of the external IPAM. A
+// failed request has an error message and, for the failures that socketplane
+// handles, one of the ipamCode error codes.
+type IPAMDriverResponse struct {
+	Address string    `json:"address,omitempty"`
+	Subnet  string    `json:"subnet,omitempty"`
+	Pool    *IPAMPool `json:"pool,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Code    string    `json:"code,omitempty"`
+}
+
+var ipamCodes = map[string]error{
+	"not_in_subnet": ErrAddressNotInSubnet,
+	"in_use":        ErrAddressInUse,
+	"excluded":      ErrAddressExcluded,
+	"exhausted":     ErrPoolExhausted,
+	"not_allocated": ErrAddressNotAllocated,
+	"no_subnet":     ErrNoSubnetAvailable,
+}
+
+// httpIPAM delegates the allocations to an external IPAM with JSON requests :
+//
+//	POST   <url>/address/request  {subnet, address}  -> {address}
+//	POST   <url>/address/release  {subnet, address}
+//	GET    <url>/pool?subnet=<subnet>               -> {pool}, 404 if none
+//	PUT    <url>/pool             {pool}
+//	DELETE <url>/pool?subnet=<subnet>
+//	POST   <url>/subnet/request   {prefix_length}   -> {subnet}
+//	POST   <url>/subnet/release   {subnet}
+//
+// The address of an address request is only set to reserve that address.
+type httpIPAM struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPIPAMDriver(baseURL string, timeout int) IPAMDriver {
+	t := ipamHTTPDefaultTimeout
+	if timeout > 0 {
+		t = time.Duration(timeout) * time.Second
+	}
+	return &httpIPAM{
+		url:    strings.TrimRight(baseURL, "/"),
+		client: &http.Client{Timeout: t},
+	}
+}
+
+func (h *httpIPAM) Request(subnet net.IPNet) (net.IP, error) {
+	response, err := h.call("POST", "/address/request", nil, &IPAMDriverRequest{Subnet: subnet.String()})
+	if err != nil {
+		return nil, err
+	}
+	address := net.ParseIP(response.Address)
+	if address == nil || !subnet.Contains(address) {
+		return nil, fmt.Errorf("External IPAM returned the invalid address %q for %s", response.Address, subnet.String())
+	}
+	return address, nil
+}
+
+func (h *httpIPAM) RequestAddress(address net.IP, subnet net.IPNet) error {
+	if address == nil || !subnet.Contains(address) {
+		return ErrAddressNotInSubnet
+	}
+	request := &IPAMDriverRequest{Subnet: subnet.String(), Address: address.String()}
+	_, err := h.call("POST", "/address/request", nil, request)
+	return err
+}
+
+func (h *httpIPAM) Release(address net.IP, subnet net.IPNet) error {
+	request := &IPAMDriverRequest{Subnet: subnet.String(), Address: address.String()}
+	_, err := h.call("POST", "/address/release", nil, request)
+	return err
+}
+
+func (h *httpIPAM) GetPool(subnet net.IPNet) (*IPAMPool, error) {
+	response, err := h.call("GET", "/pool", url.Values{"subnet": {subnet.String()}}, nil)
+	if err == errIPAMNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return response.Pool, nil
+}
+
+func (h *httpIPAM) SetPool(pool *IPAMPool) error {
+	if pool.empty() {
+		return h.DeletePool(pool.Subnet)
+	}
+	_, err := h.call("PUT", "/pool", nil, &IPAMDriverRequest{Pool: pool})
+	return err
+}
+
+func (h *httpIPAM) DeletePool(subnet string) error {
+	_, err := h.call("DELETE", "/pool", url.Values{"subnet": {subnet}}, nil)
+	if err == errIPAMNotFound {
+		return nil
+	}
+	return err
+}
+
+func (h *httpIPAM) RequestSubnet(prefixLength int) (*net.IPNet, error) {
+	response, err := h.call("POST", "/subnet/request", nil, &IPAMDriverRequest{PrefixLength: prefixLength})
+	if err != nil {
+		return nil, err
+	}
+	_, subnet, err := net.ParseCIDR(response.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("External IPAM returned the invalid subnet %q", response.Subnet)
+	}
+	return subnet, nil
+}
+
+func (h *httpIPAM) ReleaseSubnet(subnet *net.IPNet) error {
+	_, err := h.call("POST", "/subnet/release", nil, &IPAMDriverRequest{Subnet: subnet.String()})
+	return err
+}
+
+var errIPAMNotFound = errors.New("Not found in the external IPAM")
+
+func (h *httpIPAM) call(method string, path string, query url.Values, request *IPAMDriverRequest) (*IPAMDriverResponse, error) {
+	u := h.url + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	var body []byte
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	response := &IPAMDriverResponse{}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, response); err != nil && resp.StatusCode == http.StatusOK {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusOK {
+		return response, nil
+	}
+	if err, ok := ipamCodes[response.Code]; ok {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && response.Code == "" {
+		return nil, errIPAMNotFound
+	}
+	if response.Error == "" {
+		response.Error = resp.Status
+	}
+	return nil, fmt.Errorf("External IPAM %s %s failed : %s", method, path, response.Error)
+}
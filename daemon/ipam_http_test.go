@@ -0,0 +1,205 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/socketplane/socketplane/config"
+)
+
+// fakeIPAM is a minimal external IPAM that hands out the addresses of a
+// subnet in order
+type fakeIPAM struct {
+	sync.Mutex
+	allocated map[string]bool
+	pools     map[string]*IPAMPool
+	requests  []string
+}
+
+func newFakeIPAM() (*fakeIPAM, *httptest.Server) {
+	f := &fakeIPAM{allocated: make(map[string]bool), pools: make(map[string]*IPAMPool)}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeIPAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	request := &IPAMDriverRequest{}
+	json.NewDecoder(r.Body).Decode(request)
+
+	switch r.Method + " " + r.URL.Path {
+	case "POST /address/request":
+		_, subnet, err := net.ParseCIDR(request.Subnet)
+		if err != nil {
+			f.reply(w, http.StatusBadRequest, &IPAMDriverResponse{Error: "bad subnet"})
+			return
+		}
+		if request.Address != "" {
+			if f.allocated[request.Address] {
+				f.reply(w, http.StatusConflict, &IPAMDriverResponse{Error: "taken", Code: "in_use"})
+				return
+			}
+			f.allocated[request.Address] = true
+			f.reply(w, http.StatusOK, &IPAMDriverResponse{Address: request.Address})
+			return
+		}
+		for i := 1; i < 255; i++ {
+			address := getIP(*subnet, uint(i)).String()
+			if !f.allocated[address] {
+				f.allocated[address] = true
+				f.reply(w, http.StatusOK, &IPAMDriverResponse{Address: address})
+				return
+			}
+		}
+		f.reply(w, http.StatusServiceUnavailable, &IPAMDriverResponse{Error: "full", Code: "exhausted"})
+	case "POST /address/release":
+		if !f.allocated[request.Address] {
+			f.reply(w, http.StatusNotFound, &IPAMDriverResponse{Error: "unknown", Code: "not_allocated"})
+			return
+		}
+		delete(f.allocated, request.Address)
+		f.reply(w, http.StatusOK, &IPAMDriverResponse{})
+	case "GET /pool":
+		if pool, ok := f.pools[r.URL.Query().Get("subnet")]; ok {
+			f.reply(w, http.StatusOK, &IPAMDriverResponse{Pool: pool})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case "PUT /pool":
+		f.pools[request.Pool.Subnet] = request.Pool
+		f.reply(w, http.StatusOK, &IPAMDriverResponse{})
+	case "DELETE /pool":
+		delete(f.pools, r.URL.Query().Get("subnet"))
+		f.reply(w, http.StatusOK, &IPAMDriverResponse{})
+	case "POST /subnet/request":
+		if request.PrefixLength != 24 {
+			f.reply(w, http.StatusBadRequest, &IPAMDriverResponse{Error: "only /24"})
+			return
+		}
+		f.reply(w, http.StatusOK, &IPAMDriverResponse{Subnet: "10.90.0.0/24"})
+	case "POST /subnet/release":
+		f.reply(w, http.StatusOK, &IPAMDriverResponse{})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (f *fakeIPAM) reply(w http.ResponseWriter, code int, response *IPAMDriverResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
+
+func withIPAMDriver(driver IPAMDriver) func() {
+	orig := ipamDriver
+	SetIPAMDriver(driver)
+	return func() { SetIPAMDriver(orig) }
+}
+
+func TestNewIPAMDriver(t *testing.T) {
+	orig := config.IPAM
+	defer func() { config.IPAM = orig }()
+
+	for _, name := range []string{"", "bitmap"} {
+		if _, err := NewIPAMDriver(name); err != nil {
+			t.Fatalf("IPAM driver %q should be supported: %v", name, err)
+		}
+	}
+	config.IPAM = config.IPAMCfg{Driver: "http"}
+	if _, err := NewIPAMDriver("http"); err == nil {
+		t.Fatal("http IPAM driver without a url should fail")
+	}
+	config.IPAM.URL = "http://127.0.0.1:1"
+	if _, err := NewIPAMDriver("http"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewIPAMDriver("foo"); err == nil {
+		t.Fatal("unknown IPAM driver should fail")
+	}
+}
+
+func TestHTTPIPAMDriver(t *testing.T) {
+	defer useMemoryDatastore()()
+	fake, server := newFakeIPAM()
+	defer server.Close()
+	defer withIPAMDriver(NewHTTPIPAMDriver(server.URL+"/", 0))()
+	_, ipNet, _ := net.ParseCIDR("10.80.0.0/24")
+
+	for i := 1; i < 4; i++ {
+		if address := IPAMRequest(*ipNet).To4(); int(address[3]) != i {
+			t.Fatal(address.String())
+		}
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.80.0.2"), *ipNet); err != ErrAddressInUse {
+		t.Fatal("allocated address should be in use, got ", err)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.80.0.50"), *ipNet); err != nil {
+		t.Fatal(err)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.81.0.50"), *ipNet); err != ErrAddressNotInSubnet {
+		t.Fatal("address of another subnet should not be sent, got ", err)
+	}
+
+	recordAllocation(net.ParseIP("10.80.0.2"), *ipNet, "foo", "c1")
+	if !IPAMRelease(net.ParseIP("10.80.0.2"), *ipNet) {
+		t.Fatal("release failed")
+	}
+	if allocations, _ := GetAllocations("foo"); len(allocations) != 0 {
+		t.Fatal("released allocation should be forgotten")
+	}
+	if IPAMRelease(net.ParseIP("10.80.0.2"), *ipNet) {
+		t.Fatal("address released twice")
+	}
+	if address := IPAMRequest(*ipNet).To4(); address.String() != "10.80.0.2" {
+		t.Fatal(address.String())
+	}
+
+	if pool, err := GetIPAMPool(*ipNet); pool != nil || err != nil {
+		t.Fatalf("unknown pool should be nil, got %+v %v", pool, err)
+	}
+	pool, _ := NewIPAMPool(*ipNet, "10.80.0.100-10.80.0.200", []string{"10.80.0.150"})
+	if err := SetIPAMPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := GetIPAMPool(*ipNet); err != nil || stored.Pool.String() != "10.80.0.100-10.80.0.200" || len(stored.Exclude) != 1 {
+		t.Fatalf("pool not stored : %+v %v", stored, err)
+	}
+	if err := SetIPAMPool(&IPAMPool{Subnet: ipNet.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if pool, _ := GetIPAMPool(*ipNet); pool != nil {
+		t.Fatal("empty pool should be deleted")
+	}
+
+	if subnet, err := AllocateSubnet(24); err != nil || subnet.String() != "10.90.0.0/24" {
+		t.Fatalf("expected 10.90.0.0/24, got %v %v", subnet, err)
+	}
+	if _, err := AllocateSubnet(16); err == nil {
+		t.Fatal("failed subnet request should return an error")
+	}
+	if err := ReleaseSubnet(ipNet); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.requests) == 0 {
+		t.Fatal("no request reached the external IPAM")
+	}
+}
+
+func TestHTTPIPAMDriverUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	driver := NewHTTPIPAMDriver(server.URL, 1)
+	_, ipNet, _ := net.ParseCIDR("10.80.0.0/24")
+
+	if _, err := driver.Request(*ipNet); err == nil {
+		t.Fatal("unreachable IPAM should fail")
+	}
+	if _, err := driver.GetPool(*ipNet); err == nil {
+		t.Fatal("unreachable IPAM should fail")
+	}
+}
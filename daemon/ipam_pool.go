@@ -0,0 +1,221 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// A subnet may restrict the addresses that IPAM hands out to a pool and
+// exclude addresses or ranges that are used by hosts outside of socketplane.
+// Key = subnet, Value = IPAMPool
+
+const ipamPoolStore = "ipam_pool"
+
+var ErrAddressExcluded = errors.New("Requested address is excluded from allocation")
+
+// IPAMRange is an inclusive range of addresses
+type IPAMRange struct {
+	Start net.IP `json:"start"`
+	End   net.IP `json:"end"`
+}
+
+func (r IPAMRange) String() string {
+	if r.Start.Equal(r.End) {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+type IPAMPool struct {
+	Subnet  string      `json:"subnet"`
+	Pool    *IPAMRange  `json:"pool,omitempty"`
+	Exclude []IPAMRange `json:"exclude,omitempty"`
+}
+
+// ParseIPAMRange parses an address, a CIDR or a range of addresses in the
+// form start-end
+func ParseIPAMRange(value string) (*IPAMRange, error) {
+	value = strings.TrimSpace(value)
+	if _, cidr, err := net.ParseCIDR(value); err == nil {
+		return &IPAMRange{Start: cidr.IP, End: lastAddress(*cidr)}, nil
+	}
+	parts := strings.SplitN(value, "-", 2)
+	start := net.ParseIP(strings.TrimSpace(parts[0]))
+	end := start
+	if len(parts) == 2 {
+		end = net.ParseIP(strings.TrimSpace(parts[1]))
+	}
+	if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) ||
+		bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, fmt.Errorf("Invalid address range %s", value)
+	}
+	return &IPAMRange{Start: start, End: end}, nil
+}
+
+func lastAddress(subnet net.IPNet) net.IP {
+	address := make(net.IP, len(subnet.IP))
+	for i := range subnet.IP {
+		address[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+	return address
+}
+
+// NewIPAMPool builds the pool of a subnet. An empty pool allows the whole
+// subnet. Exclusions outside of the subnet are ignored so that the
+// exclusions of a dual-stack network can be given as a single list.
+func NewIPAMPool(subnet net.IPNet, pool string, exclude []string) (*IPAMPool, error) {
+	ipamPool := &IPAMPool{Subnet: subnet.String()}
+	if pool != "" {
+		r, err := ParseIPAMRange(pool)
+		if err != nil {
+			return nil, err
+		}
+		if !subnet.Contains(r.Start) || !subnet.Contains(r.End) {
+			return nil, fmt.Errorf("Pool %s is not in the subnet %s", pool, subnet.String())
+		}
+		ipamPool.Pool = r
+	}
+	for _, value := range exclude {
+		r, err := ParseIPAMRange(value)
+		if err != nil {
+			return nil, err
+		}
+		if subnet.Contains(r.Start) && subnet.Contains(r.End) {
+			ipamPool.Exclude = append(ipamPool.Exclude, *r)
+		}
+	}
+	return ipamPool, nil
+}
+
+func (p *IPAMPool) empty() bool {
+	return p.Pool == nil && len(p.Exclude) == 0
+}
+
+// excludes reports whether an address is in one of the excluded ranges
+func (p *IPAMPool) excludes(address net.IP) bool {
+	for _, r := range p.Exclude {
+		if bytes.Compare(address.To16(), r.Start.To16()) >= 0 && bytes.Compare(address.To16(), r.End.To16()) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// offsetRange is an inclusive range of host offsets of a subnet
+type offsetRange struct {
+	first, last uint64
+}
+
+// ipamOffset returns the host offset of an address in a subnet
+func ipamOffset(address net.IP, subnet net.IPNet) (uint64, bool) {
+	if subnet.IP.To4() == nil {
+		return offset6(address, subnet)
+	}
+	if address == nil || address.To4() == nil || !subnet.Contains(address) {
+		return 0, false
+	}
+	return uint64(binary.BigEndian.Uint32(address.To4()) - binary.BigEndian.Uint32(subnet.IP.To4())), true
+}
+
+// bounds returns the host offsets that may be allocated dynamically given the
+// host offsets of the subnet
+func (p *IPAMPool) bounds(subnet net.IPNet, first uint64, last uint64) (uint64, uint64) {
+	if p == nil || p.Pool == nil {
+		return first, last
+	}
+	if start, ok := ipamOffset(p.Pool.Start, subnet); ok && start > first {
+		first = start
+	}
+	if end, ok := ipamOffset(p.Pool.End, subnet); ok && end < last {
+		last = end
+	}
+	return first, last
+}
+
+// excluded returns the excluded host offsets of the subnet, sorted and merged
+func (p *IPAMPool) excluded(subnet net.IPNet) []offsetRange {
+	if p == nil {
+		return nil
+	}
+	ranges := make([]offsetRange, 0, len(p.Exclude))
+	for _, r := range p.Exclude {
+		first, ok1 := ipamOffset(r.Start, subnet)
+		last, ok2 := ipamOffset(r.End, subnet)
+		if ok1 && ok2 {
+			ranges = append(ranges, offsetRange{first, last})
+		}
+	}
+	sort.Sort(byFirstOffset(ranges))
+	merged := make([]offsetRange, 0, len(ranges))
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.first <= merged[n-1].last+1 {
+			if r.last > merged[n-1].last {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+type byFirstOffset []offsetRange
+
+func (b byFirstOffset) Len() int           { return len(b) }
+func (b byFirstOffset) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byFirstOffset) Less(i, j int) bool { return b[i].first < b[j].first }
+
+// excludedRange returns the excluded range that holds an offset
+func excludedRange(excluded []offsetRange, offset uint64) (offsetRange, bool) {
+	i := sort.Search(len(excluded), func(i int) bool { return excluded[i].last >= offset })
+	if i < len(excluded) && excluded[i].first <= offset {
+		return excluded[i], true
+	}
+	return offsetRange{}, false
+}
+
+// getIPAMPool returns the pool of a subnet, nil if the whole subnet is
+// available
+func getIPAMPool(subnet net.IPNet) (*IPAMPool, error) {
+	data, ok := datastore.Get(ipamPoolStore, subnet.String())
+	if !ok {
+		return nil, nil
+	}
+	pool := &IPAMPool{}
+	if err := json.Unmarshal(data, pool); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// setIPAMPool stores the pool of a subnet. An empty pool is removed.
+func setIPAMPool(pool *IPAMPool) error {
+	if pool.empty() {
+		return deleteIPAMPool(pool.Subnet)
+	}
+	data, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	oldValue, _ := datastore.Get(ipamPoolStore, pool.Subnet)
+	return retryIPAM(func() error {
+		err := datastore.Put(ipamPoolStore, pool.Subnet, data, oldValue)
+		if err == ErrDatastoreOutdated {
+			oldValue, _ = datastore.Get(ipamPoolStore, pool.Subnet)
+		}
+		return err
+	})
+}
+
+func deleteIPAMPool(subnet string) error {
+	if _, ok := datastore.Get(ipamPoolStore, subnet); !ok {
+		return nil
+	}
+	return datastore.Delete(ipamPoolStore, subnet)
+}
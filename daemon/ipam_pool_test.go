@@ -0,0 +1,118 @@
+package daemon
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIPAMRange(t *testing.T) {
+	tests := []struct {
+		value, start, end string
+	}{
+		{"10.1.0.5", "10.1.0.5", "10.1.0.5"},
+		{"10.1.0.5-10.1.0.9", "10.1.0.5", "10.1.0.9"},
+		{"10.1.0.16/28", "10.1.0.16", "10.1.0.31"},
+		{"fd00::10 - fd00::20", "fd00::10", "fd00::20"},
+	}
+	for _, test := range tests {
+		r, err := ParseIPAMRange(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Start.String() != test.start || r.End.String() != test.end {
+			t.Fatalf("%s parsed as %s", test.value, r)
+		}
+	}
+	for _, value := range []string{"", "foo", "10.1.0.9-10.1.0.5", "10.1.0.5-fd00::1"} {
+		if _, err := ParseIPAMRange(value); err == nil {
+			t.Fatalf("%q should not parse", value)
+		}
+	}
+}
+
+func TestIPAMRequestPool(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.15.0.0/24")
+	pool, err := NewIPAMPool(*ipNet, "10.15.0.10-10.15.0.20", []string{"10.15.0.12-10.15.0.13", "10.15.0.15", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Exclude) != 2 {
+		t.Fatalf("exclusions of another subnet should be ignored : %+v", pool.Exclude)
+	}
+	if err := SetIPAMPool(pool); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"10.15.0.10", "10.15.0.11", "10.15.0.14", "10.15.0.16", "10.15.0.17", "10.15.0.18", "10.15.0.19", "10.15.0.20"}
+	for _, e := range expected {
+		if address := IPAMRequest(*ipNet); address.String() != e {
+			t.Fatalf("expected %s, got %s", e, address)
+		}
+	}
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("exhausted pool allocated %s", address)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.15.0.15"), *ipNet); err != ErrAddressExcluded {
+		t.Fatal("excluded address should not be reservable, got ", err)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.15.0.100"), *ipNet); err != nil {
+		t.Fatal("address outside of the pool should be reservable : ", err)
+	}
+}
+
+func TestIPAMRequestBroadcast(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.16.0.0/28")
+
+	for i := 1; i < 15; i++ {
+		if address := IPAMRequest(*ipNet).To4(); int(address[3]) != i {
+			t.Fatal(address.String())
+		}
+	}
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("broadcast address %s was allocated", address)
+	}
+	for _, address := range []string{"10.16.0.0", "10.16.0.15"} {
+		if err := IPAMRequestAddress(net.ParseIP(address), *ipNet); err != ErrAddressNotInSubnet {
+			t.Fatalf("%s should not be reservable", address)
+		}
+	}
+}
+
+func TestIPAM6RequestPool(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("fd00:15::/64")
+	pool, _ := NewIPAMPool(*ipNet, "fd00:15::10-fd00:15::14", []string{"fd00:15::11-fd00:15::12"})
+	SetIPAMPool(pool)
+
+	for _, e := range []string{"fd00:15::10", "fd00:15::13", "fd00:15::14"} {
+		if address := IPAMRequest(*ipNet); address.String() != e {
+			t.Fatalf("expected %s, got %s", e, address)
+		}
+	}
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("exhausted pool allocated %s", address)
+	}
+	IPAMRelease(net.ParseIP("fd00:15::13"), *ipNet)
+	if address := IPAMRequest(*ipNet); address.String() != "fd00:15::13" {
+		t.Fatalf("released address should be reused, got %s", address)
+	}
+}
+
+func TestSetIPAMPoolEmpty(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.17.0.0/24")
+	pool, _ := NewIPAMPool(*ipNet, "10.17.0.100-10.17.0.110", nil)
+	SetIPAMPool(pool)
+	if address := IPAMRequest(*ipNet); address.String() != "10.17.0.100" {
+		t.Fatal(address.String())
+	}
+	SetIPAMPool(&IPAMPool{Subnet: ipNet.String()})
+	if pool, _ := GetIPAMPool(*ipNet); pool != nil {
+		t.Fatal("empty pool should be removed")
+	}
+	if address := IPAMRequest(*ipNet); address.String() != "10.17.0.1" {
+		t.Fatal(address.String())
+	}
+}
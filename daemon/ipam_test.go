@@ -1,10 +1,9 @@
 package daemon
 
 import (
+	"encoding/json"
 	"net"
 	"testing"
-
-	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/ecc"
 )
 
 func TestIPAMInit(t *testing.T) {
@@ -87,10 +86,252 @@ func TestGetIpPartialMask(t *testing.T) {
 }
 
 func TestIPAMCleanup(t *testing.T) {
-	ecc.Delete(dataStore, "192.170.0.0/24")
-	ecc.Delete(dataStore, "192.170.32.0/20")
-	ecc.Delete(dataStore, "192.167.1.0/24")
-	ecc.Delete(dataStore, "192.168.0.0/16")
-	ecc.Delete(dataStore, "192.169.32.0/20")
+	datastore.Delete(ipamStore, "192.170.0.0/24")
+	datastore.Delete(ipamStore, "192.170.32.0/20")
+	datastore.Delete(ipamStore, "192.167.1.0/24")
+	datastore.Delete(ipamStore, "192.168.0.0/16")
+	datastore.Delete(ipamStore, "192.169.32.0/20")
 	LeaveDatastore()
 }
+
+func TestIPAMAllocations(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.10.30.0/24")
+
+	gateway := IPAMRequest(*ipNet)
+	recordAllocation(gateway, *ipNet, "foo", "")
+	address := IPAMRequest(*ipNet)
+	recordAllocation(address, *ipNet, "foo", "c1")
+
+	allocations, err := GetAllocations("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 2 || allocations[0].Address != "10.10.30.1" || allocations[1].ContainerID != "c1" {
+		t.Fatalf("Incorrect allocations : %+v", allocations)
+	}
+	if allocations, _ := GetAllocations("bar"); len(allocations) != 0 {
+		t.Fatal("Allocations of another network should not be returned")
+	}
+
+	IPAMRelease(address, *ipNet)
+	if allocations, _ := GetAllocations("foo"); len(allocations) != 1 {
+		t.Fatal("Released allocation should be forgotten")
+	}
+}
+
+func TestReconcileAllocations(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.10.40.0/24")
+
+	for _, containerID := range []string{"", "live", "orphan"} {
+		recordAllocation(IPAMRequest(*ipNet), *ipNet, "foo", containerID)
+	}
+	recordAllocation(IPAMRequest(*ipNet), *ipNet, "foo", "young")
+	// Age all but the last allocation past the grace period
+	values, _ := datastore.GetAll(ipamAllocationStore)
+	for _, data := range values {
+		allocation := &IPAMAllocation{}
+		json.Unmarshal(data, allocation)
+		if allocation.ContainerID == "young" {
+			continue
+		}
+		allocation.Timestamp = allocation.Timestamp.Add(-2 * ipamReconcileGrace)
+		aged, _ := json.Marshal(allocation)
+		datastore.Put(ipamAllocationStore, allocation.Address, aged, data)
+	}
+
+	connections := map[string]*Connection{
+		"live": {ContainerID: "live", ConnectionDetails: OvsConnection{Ip: "10.10.40.2"}},
+	}
+	released := reconcileAllocations(connections)
+	if len(released) != 1 || released[0].ContainerID != "orphan" {
+		t.Fatalf("Only the orphan should be released : %+v", released)
+	}
+	if allocations, _ := GetAllocations("foo"); len(allocations) != 3 {
+		t.Fatalf("Expected 3 allocations left, got %d", len(allocations))
+	}
+	if address := IPAMRequest(*ipNet).To4(); address.String() != released[0].Address {
+		t.Fatalf("Released address should be reused, got %s", address)
+	}
+}
+
+func TestIPAMRequestAddress(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.10.60.0/24")
+
+	if err := IPAMRequestAddress(net.ParseIP("10.10.60.20"), *ipNet); err != nil {
+		t.Fatal(err)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.10.60.20"), *ipNet); err != ErrAddressInUse {
+		t.Fatal("Reserving an address twice should conflict")
+	}
+	for _, address := range []string{"10.10.61.20", "10.10.60.0", "foo"} {
+		if err := IPAMRequestAddress(net.ParseIP(address), *ipNet); err != ErrAddressNotInSubnet {
+			t.Fatalf("%s should not be reservable", address)
+		}
+	}
+	// Dynamic allocations skip the reserved address
+	for i := 1; i < 21; i++ {
+		if address := IPAMRequest(*ipNet).To4(); address.String() == "10.10.60.20" {
+			t.Fatal("Reserved address was allocated")
+		}
+	}
+	IPAMRelease(net.ParseIP("10.10.60.20"), *ipNet)
+	if err := IPAMRequestAddress(net.ParseIP("10.10.60.20"), *ipNet); err != nil {
+		t.Fatal("Released address should be reservable : ", err)
+	}
+}
+
+func TestIPAMRequestChunks(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.11.0.0/20")
+
+	for i := 1; i <= ipamChunkBits+10; i++ {
+		address := IPAMRequest(*ipNet).To4()
+		if i%256 != int(address[3]) || i/256 != int(address[2]) {
+			t.Fatal(address.String())
+		}
+	}
+	if _, ok := datastore.Get(ipamStore, ipamChunkKey(*ipNet, 1)); !ok {
+		t.Fatal("second chunk not stored")
+	}
+	if raw, _ := datastore.Get(ipamStore, ipNet.String()); len(raw) != ipamChunkBits/8 {
+		t.Fatalf("first chunk should hold %d bytes, got %d", ipamChunkBits/8, len(raw))
+	}
+	// Addresses released in an earlier chunk are handed out first
+	IPAMRelease(net.ParseIP("10.11.0.7"), *ipNet)
+	if address := IPAMRequest(*ipNet).To4(); address.String() != "10.11.0.7" {
+		t.Fatal(address.String())
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.11.4.10"), *ipNet); err != ErrAddressInUse {
+		t.Fatal("address of the second chunk should be in use")
+	}
+}
+
+func TestIPAMRequestExhausted(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.12.0.0/30")
+
+	for i := 1; i < 3; i++ {
+		if address := IPAMRequest(*ipNet).To4(); int(address[3]) != i {
+			t.Fatalf("allocation %d failed : %s", i, address)
+		}
+	}
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("exhausted subnet allocated %s", address)
+	}
+}
+
+func TestIPAMMigrateBitmap(t *testing.T) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR("10.13.0.0/20")
+
+	// A bitmap written as a single value with the first 1030 addresses taken
+	for i := 0; i < ipamChunkBits+6; i++ {
+		legacyIPAMRequest(*ipNet)
+	}
+	IPAMRelease(net.ParseIP("10.13.4.2"), *ipNet)
+	if address := IPAMRequest(*ipNet).To4(); address.String() != "10.13.4.2" {
+		t.Fatal(address.String())
+	}
+	if address := IPAMRequest(*ipNet).To4(); address.String() != "10.13.4.7" {
+		t.Fatal(address.String())
+	}
+	if raw, _ := datastore.Get(ipamStore, ipNet.String()); len(raw) != ipamChunkBits/8 {
+		t.Fatalf("bitmap not split, first chunk holds %d bytes", len(raw))
+	}
+}
+
+type outdatedDatastore struct {
+	Datastore
+}
+
+func (o outdatedDatastore) Put(store string, key string, value []byte, oldValue []byte) error {
+	return ErrDatastoreOutdated
+}
+
+func TestIPAMRequestContention(t *testing.T) {
+	defer useMemoryDatastore()()
+	SetDatastore(outdatedDatastore{datastore})
+	_, ipNet, _ := net.ParseCIDR("10.14.0.0/24")
+
+	if address := IPAMRequest(*ipNet); address != nil {
+		t.Fatalf("allocated %s without storing it", address)
+	}
+	if err := IPAMRequestAddress(net.ParseIP("10.14.0.5"), *ipNet); err != ErrIPAMContention {
+		t.Fatal("retries should be bounded, got ", err)
+	}
+	recordAllocation(net.ParseIP("10.14.0.6"), *ipNet, "foo", "c1")
+	if allocations, _ := GetAllocations("foo"); len(allocations) != 0 {
+		t.Fatalf("recorded an allocation without storing it : %+v", allocations)
+	}
+}
+
+// legacyIPAMRequest is the allocator that kept the whole subnet in a single
+// bitmap. It is kept to compare against.
+func legacyIPAMRequest(subnet net.IPNet) net.IP {
+	bc := (int(bitCount(subnet)) + 7) / 8
+	addrArray, ok := datastore.Get(ipamStore, subnet.String())
+	currVal := make([]byte, len(addrArray))
+	copy(currVal, addrArray)
+	if !ok {
+		addrArray = make([]byte, bc)
+	}
+	pos := testAndSetBit(addrArray)
+	err := datastore.Put(ipamStore, subnet.String(), addrArray, currVal)
+	if err == ErrDatastoreOutdated {
+		return legacyIPAMRequest(subnet)
+	}
+	return getIP(subnet, pos)
+}
+
+func benchmarkIPAMRequest(b *testing.B, cidr string, request func(net.IPNet) net.IP) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR(cidr)
+	size := int(bitCount(*ipNet)) - 1
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%size == 0 {
+			b.StopTimer()
+			SetDatastore(NewMemoryDatastore())
+			b.StartTimer()
+		}
+		request(*ipNet)
+	}
+}
+
+func benchmarkIPAMRequestParallel(b *testing.B, cidr string, request func(net.IPNet) net.IP) {
+	defer useMemoryDatastore()()
+	_, ipNet, _ := net.ParseCIDR(cidr)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			request(*ipNet)
+		}
+	})
+}
+
+func BenchmarkIPAMRequestLegacy16(b *testing.B) {
+	benchmarkIPAMRequest(b, "10.20.0.0/16", legacyIPAMRequest)
+}
+
+func BenchmarkIPAMRequest16(b *testing.B) {
+	benchmarkIPAMRequest(b, "10.20.0.0/16", IPAMRequest)
+}
+
+func BenchmarkIPAMRequestLegacy12(b *testing.B) {
+	benchmarkIPAMRequest(b, "10.32.0.0/12", legacyIPAMRequest)
+}
+
+func BenchmarkIPAMRequest12(b *testing.B) {
+	benchmarkIPAMRequest(b, "10.32.0.0/12", IPAMRequest)
+}
+
+func BenchmarkIPAMRequestLegacyParallel(b *testing.B) {
+	benchmarkIPAMRequestParallel(b, "10.48.0.0/12", legacyIPAMRequest)
+}
+
+func BenchmarkIPAMRequestParallel(b *testing.B) {
+	benchmarkIPAMRequestParallel(b, "10.48.0.0/12", IPAMRequest)
+}
@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// memoryDatastore is a process local Datastore. It is meant for single node
+// deployments and for exercising the network, vlan and ipam logic in tests.
+type memoryDatastore struct {
+	sync.Mutex
+	stores    map[string]map[string][]byte
+	listeners map[string][]DatastoreListener
+}
+
+func NewMemoryDatastore() Datastore {
+	return &memoryDatastore{
+		stores:    make(map[string]map[string][]byte),
+		listeners: make(map[string][]DatastoreListener),
+	}
+}
+
+func (m *memoryDatastore) Start(bindInterface string, bootstrap bool) error {
+	return nil
+}
+
+func (m *memoryDatastore) Join(address string) error {
+	return errors.New("memory datastore does not support clustering")
+}
+
+func (m *memoryDatastore) Leave() error {
+	m.Lock()
+	m.stores = make(map[string]map[string][]byte)
+	m.Unlock()
+	return nil
+}
+
+func (m *memoryDatastore) Get(store string, key string) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+	value, ok := m.stores[store][key]
+	if !ok {
+		return nil, false
+	}
+	return copyBytes(value), true
+}
+
+func (m *memoryDatastore) GetAll(store string) ([][]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.stores[store]
+	if !ok {
+		return nil, false
+	}
+	values := make([][]byte, 0, len(s))
+	for _, value := range s {
+		values = append(values, copyBytes(value))
+	}
+	return values, true
+}
+
+func (m *memoryDatastore) Put(store string, key string, value []byte, oldValue []byte) error {
+	m.Lock()
+	s, ok := m.stores[store]
+	if !ok {
+		s = make(map[string][]byte)
+		m.stores[store] = s
+	}
+	if existing, ok := s[key]; ok && !bytes.Equal(existing, oldValue) {
+		m.Unlock()
+		return ErrDatastoreOutdated
+	}
+	s[key] = copyBytes(value)
+	m.Unlock()
+	m.notify(store)
+	return nil
+}
+
+func (m *memoryDatastore) Delete(store string, key string) error {
+	m.Lock()
+	delete(m.stores[store], key)
+	m.Unlock()
+	m.notify(store)
+	return nil
+}
+
+// The memory datastore is not shared, the peers it may have are discovered
+// by other means
+func (m *memoryDatastore) Members() ([]string, error) {
+	return nil, ErrMembershipUnavailable
+}
+
+func (m *memoryDatastore) WatchNodes(listener DatastoreListener) {
+}
+
+func (m *memoryDatastore) WatchStore(store string, listener DatastoreListener) {
+	m.Lock()
+	m.listeners[store] = append(m.listeners[store], listener)
+	m.Unlock()
+}
+
+func (m *memoryDatastore) notify(store string) {
+	m.Lock()
+	snapshot := make(map[string][]byte)
+	for key, value := range m.stores[store] {
+		snapshot[key] = copyBytes(value)
+	}
+	listeners := m.listeners[store]
+	m.Unlock()
+	for _, l := range listeners {
+		l.NotifyStoreUpdate(store, snapshot)
+	}
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
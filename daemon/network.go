@@ -3,11 +3,11 @@ package daemon
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net"
-	"time"
+	"sync"
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
-	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/ecc"
 )
 
 const networkStore = "network"
@@ -16,15 +16,39 @@ const DefaultNetworkName = "default"
 
 const vlanCount = 4096
 
+// In the centralized mode the gateway of a network lives on the host that
+// created it. In the distributed mode every host has the gateway with the
+// same address and MAC, and routes and NATs the traffic of its containers.
+const (
+	GatewayCentralized = "centralized"
+	GatewayDistributed = "distributed"
+)
+
 type Network struct {
 	ID      string `json:"id"`
 	Subnet  string `json:"subnet"`
 	Gateway string `json:"gateway"`
-	Vlan    uint   `json:"vlan"`
+	// VNI identifies the network on the tunnels. Vlan is the cluster-wide
+	// VLAN of the networks created before VNIs were allocated.
+	VNI         uint   `json:"vni,omitempty"`
+	Vlan        uint   `json:"vlan,omitempty"`
+	Host        string `json:"host,omitempty"`
+	GatewayMode string `json:"gateway_mode,omitempty"`
+	Subnet6     string `json:"subnet6,omitempty"`
+	Gateway6    string `json:"gateway6,omitempty"`
+	// Pool and Pool6 restrict the addresses allocated in Subnet and Subnet6,
+	// Exclude lists addresses and ranges that are never allocated
+	Pool    string   `json:"pool,omitempty"`
+	Pool6   string   `json:"pool6,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func validGatewayMode(mode string) bool {
+	return mode == "" || mode == GatewayCentralized || mode == GatewayDistributed
 }
 
 func GetNetworks() ([]Network, error) {
-	netByteArray, _, ok := ecc.GetAll(networkStore)
+	netByteArray, ok := datastore.GetAll(networkStore)
 	networks := make([]Network, 0)
 	if ok {
 		for _, byteArray := range netByteArray {
@@ -40,7 +64,7 @@ func GetNetworks() ([]Network, error) {
 }
 
 func GetNetwork(id string) (*Network, error) {
-	netByteArray, _, ok := ecc.Get(networkStore, id)
+	netByteArray, ok := datastore.Get(networkStore, id)
 	if ok {
 		network := &Network{}
 		err := json.Unmarshal(netByteArray, network)
@@ -52,79 +76,229 @@ func GetNetwork(id string) (*Network, error) {
 	return nil, errors.New("Network unavailable")
 }
 
-func CreateNetwork(id string, subnet *net.IPNet) (*Network, error) {
+// CreateNetwork creates a network with an IPv4 subnet, an IPv6 subnet or
+// both. Either of them may be nil. The allocations in a subnet are restricted
+// by the pool of pools that has the same subnet, if any. The gateway of a
+// subnet is the requested one, if not nil, else it is allocated.
+func CreateNetwork(id string, subnet *net.IPNet, subnet6 *net.IPNet, requestedGateway net.IP, requestedGateway6 net.IP, gatewayMode string, pools []*IPAMPool) (*Network, error) {
 	network, err := GetNetwork(id)
 	if err == nil {
 		log.Debugf("Network '%s' found", id)
 		return network, nil
 	}
+	if !validGatewayMode(gatewayMode) {
+		return nil, errors.New("Invalid gateway mode " + gatewayMode)
+	}
+	if subnet6 != nil && subnet6.IP.To4() != nil {
+		return nil, errors.New("Invalid IPv6 subnet " + subnet6.String())
+	}
+	// The gateway interface of a network that exists on this host already
+	// has a route to its subnet
+	_, ifaceErr := GetIfaceAddr(id)
+	for _, s := range []*net.IPNet{subnet, subnet6} {
+		if s == nil {
+			continue
+		}
+		if err := CheckSubnetOverlaps(id, s, ifaceErr == nil); err != nil {
+			return nil, err
+		}
+	}
+	// The pool of every subnet is stored, even if empty, to replace the pool
+	// of a network that used the subnet before. The pools are deleted if the
+	// network fails to be created.
+	var pool, pool6 *IPAMPool
+	deletePools := func() {
+		for _, p := range []*IPAMPool{pool, pool6} {
+			if p == nil {
+				continue
+			}
+			if err := DeleteIPAMPool(p.Subnet); err != nil {
+				log.Errorf("Unable to delete the pool of %s. %v", p.Subnet, err)
+			}
+		}
+	}
+	if subnet != nil {
+		if pool, err = setNetworkPool(*subnet, pools); err != nil {
+			return nil, err
+		}
+	}
+	if subnet6 != nil {
+		if pool6, err = setNetworkPool(*subnet6, pools); err != nil {
+			deletePools()
+			return nil, err
+		}
+	}
 
-	vlan, err := allocateVlan()
+	vni, err := allocateVni()
 	if err != nil {
-		log.Debugf("Unable to allocate VLAN for Network '%s'. Error: %v", id, err.Error())
+		log.Debugf("Unable to allocate VNI for Network '%s'. Error: %v", id, err.Error())
+		deletePools()
 		return nil, err
 	}
 
-	var gateway net.IP
+	// reserved and reserved6 are the gateways allocated by this call, which
+	// are released if the network fails to be created. The address of an
+	// existing interface and a gateway allocated by Docker are not.
+	var gateway, gateway6, reserved, reserved6 net.IP
+	releaseAllocations := func() {
+		releaseVni(vni)
+		if reserved != nil {
+			IPAMRelease(reserved, *subnet)
+		}
+		if reserved6 != nil {
+			IPAMRelease(reserved6, *subnet6)
+		}
+	}
+	network = &Network{
+		ID:          id,
+		VNI:         vni,
+		Host:        clusterAddress,
+		GatewayMode: gatewayMode,
+	}
+	if pool != nil && pool.Pool != nil {
+		network.Pool = pool.Pool.String()
+	}
+	if pool6 != nil && pool6.Pool != nil {
+		network.Pool6 = pool6.Pool.String()
+	}
+	for _, p := range []*IPAMPool{pool, pool6} {
+		if p == nil {
+			continue
+		}
+		for _, r := range p.Exclude {
+			network.Exclude = append(network.Exclude, r.String())
+		}
+	}
 
 	addr, err := GetIfaceAddr(id)
 	if err != nil {
 		log.Debugf("Interface with name %s does not exist. Creating it.", id)
 		if ovs == nil {
+			releaseAllocations()
+			deletePools()
 			return nil, errors.New("OVS not connected")
 		}
-		// Interface does not exist, use the generated subnet
-		gateway = IPAMRequest(*subnet)
-		network = &Network{id, subnet.String(), gateway.String(), vlan}
-		if err = AddInternalPort(ovs, defaultBridgeName, network.ID, vlan); err != nil {
-			return network, err
-		}
-		// TODO : Lame. Remove the sleep. This is required now to keep netlink happy
-		// in the next step to find the created interface.
-		time.Sleep(time.Second * 1)
-
-		gatewayNet := &net.IPNet{gateway, subnet.Mask}
-
-		log.Debugf("Setting address %s on %s", gatewayNet.String(), network.ID)
-
-		if err = SetMtu(network.ID, mtu); err != nil {
-			return network, err
+		if subnet == nil && subnet6 == nil {
+			releaseAllocations()
+			deletePools()
+			return nil, errors.New("A network needs an IPv4 or an IPv6 subnet")
 		}
-		if err = SetInterfaceIp(network.ID, gatewayNet.String()); err != nil {
-			return network, err
-		}
-		if err = InterfaceUp(network.ID); err != nil {
-			return network, err
+		// Interface does not exist, use the generated subnet. The gateway
+		// port is created when the network is realized.
+		if subnet != nil {
+			var allocated bool
+			if gateway, allocated, err = networkGateway(*subnet, requestedGateway); err != nil {
+				releaseAllocations()
+				deletePools()
+				return nil, err
+			}
+			if allocated {
+				reserved = gateway
+			}
+			recordAllocation(gateway, *subnet, id, "")
+			network.Subnet = subnet.String()
+			network.Gateway = gateway.String()
 		}
 	} else {
 		log.Debugf("Interface with name %s already exists", id)
 		ifaceAddr := addr.String()
 		gateway, subnet, err = net.ParseCIDR(ifaceAddr)
 		if err != nil {
+			releaseAllocations()
+			deletePools()
+			return nil, err
+		}
+		network.Subnet = subnet.String()
+		network.Gateway = gateway.String()
+	}
+
+	if subnet6 != nil {
+		var allocated bool
+		if gateway6, allocated, err = networkGateway(*subnet6, requestedGateway6); err != nil {
+			releaseAllocations()
+			deletePools()
 			return nil, err
 		}
-		network = &Network{id, subnet.String(), gateway.String(), vlan}
+		if allocated {
+			reserved6 = gateway6
+		}
+		recordAllocation(gateway6, *subnet6, id, "")
+		network.Subnet6 = subnet6.String()
+		network.Gateway6 = gateway6.String()
 	}
 
 	data, err := json.Marshal(network)
 	if err != nil {
+		releaseAllocations()
+		deletePools()
 		return nil, err
 	}
 
-	eccerr := ecc.Put(networkStore, id, data, nil)
-	if eccerr == ecc.OUTDATED {
-		releaseVlan(vlan)
-		IPAMRelease(gateway, *subnet)
-		return CreateNetwork(id, subnet)
+	// The hosts realize the networks of the datastore, so a network that is
+	// not stored must not be realized either
+	err = datastore.Put(networkStore, id, data, nil)
+	if err == ErrDatastoreOutdated {
+		releaseAllocations()
+		// Another host created the network first, with its own pools
+		if existing, err := GetNetwork(id); err == nil {
+			log.Debugf("Network '%s' was created by another host", id)
+			restoreNetworkPools(existing, pool, pool6)
+			return existing, nil
+		}
+		return CreateNetwork(id, subnet, subnet6, requestedGateway, requestedGateway6, gatewayMode, pools)
+	} else if err != nil {
+		log.Errorf("Unable to store the network %s. %v", id, err)
+		releaseAllocations()
+		deletePools()
+		return nil, err
 	}
 
-	if err = setupIPTables(network.ID, network.Subnet); err != nil {
-		return network, err
+	// A network that cannot be realized is deleted, so that no host keeps it
+	// half created
+	realizeLock.Lock()
+	defer realizeLock.Unlock()
+	if err = realizeNetwork(network); err != nil {
+		log.Errorf("Unable to realize the network %s. %v", id, err)
+		if err := datastore.Delete(networkStore, id); err != nil {
+			log.Errorf("Unable to delete the network %s. %v", id, err)
+		}
+		if addr == nil && portUuidForName(id) != "" {
+			if err := unrealizeNetwork(id, network.Subnet, network.Subnet6); err != nil {
+				log.Errorf("Unable to remove the gateway of network %s. %v", id, err)
+			}
+		}
+		if err := unrealizeSegment(id); err != nil {
+			log.Errorf("Unable to remove the tunnel flows of network %s. %v", id, err)
+		}
+		releaseAllocations()
+		deletePools()
+		return nil, err
 	}
 
 	return network, nil
 }
 
+// networkGateway reserves the requested gateway of a subnet, or allocates one
+// if none was requested. A gateway that Docker allocated through the IPAM
+// driver is adopted, and reported as not allocated by this call.
+func networkGateway(subnet net.IPNet, requested net.IP) (net.IP, bool, error) {
+	if requested == nil {
+		gateway := IPAMRequest(subnet)
+		if gateway == nil {
+			return nil, false, errors.New("No address available in " + subnet.String())
+		}
+		return gateway, true, nil
+	}
+	err := IPAMRequestAddress(requested, subnet)
+	if err == ErrAddressInUse && dockerAllocated(requested, &subnet) {
+		return requested, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return requested, true, nil
+}
+
 func DeleteNetwork(id string) error {
 	network, err := GetNetwork(id)
 	if err != nil {
@@ -133,21 +307,340 @@ func DeleteNetwork(id string) error {
 	if ovs == nil {
 		return errors.New("OVS not connected")
 	}
-	eccerror := ecc.Delete(networkStore, id)
-	if eccerror != ecc.OK {
+	if err = datastore.Delete(networkStore, id); err != nil {
 		return errors.New("Error deleting network")
 	}
-	releaseVlan(network.Vlan)
+	if network.VNI != 0 {
+		if err := releaseVni(network.VNI); err != nil {
+			log.Errorf("Unable to release the VNI %d. %v", network.VNI, err)
+		}
+	}
+	if network.Vlan != 0 {
+		if err := releaseVlan(network.Vlan); err != nil {
+			log.Errorf("Unable to release the VLAN %d. %v", network.Vlan, err)
+		}
+	}
+	for _, subnet := range []string{network.Subnet, network.Subnet6} {
+		if subnet == "" {
+			continue
+		}
+		if err := DeleteIPAMPool(subnet); err != nil {
+			log.Errorf("Unable to delete the pool of %s. %v", subnet, err)
+		}
+	}
+	if _, subnet, err := net.ParseCIDR(network.Subnet); err == nil {
+		if err := ReleaseSubnet(subnet); err != nil {
+			log.Errorf("Unable to release the subnet %s. %v", network.Subnet, err)
+		}
+	}
+	// The other hosts converge when they are notified of the delete
+	realizeLock.Lock()
+	defer realizeLock.Unlock()
+	if portUuidForName(id) != "" {
+		if err := unrealizeNetwork(id, network.Subnet, network.Subnet6); err != nil {
+			return err
+		}
+	}
+	return unrealizeSegment(id)
+}
+
+var realizeLock sync.Mutex
+
+// setNetworkPool stores the pool of pools that has the given subnet
+func setNetworkPool(subnet net.IPNet, pools []*IPAMPool) (*IPAMPool, error) {
+	pool := &IPAMPool{Subnet: subnet.String()}
+	for _, p := range pools {
+		if p != nil && p.Subnet == subnet.String() {
+			pool = p
+		}
+	}
+	if err := SetIPAMPool(pool); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// restoreNetworkPools puts back the pools of a network that another host
+// created first, which setNetworkPool overwrote, and deletes the pools written
+// for the subnets that the network does not use
+func restoreNetworkPools(network *Network, pools ...*IPAMPool) {
+	for _, p := range pools {
+		if p == nil {
+			continue
+		}
+		if p.Subnet != network.Subnet && p.Subnet != network.Subnet6 {
+			if err := DeleteIPAMPool(p.Subnet); err != nil {
+				log.Errorf("Unable to delete the pool of %s. %v", p.Subnet, err)
+			}
+			continue
+		}
+		poolRange := network.Pool
+		if p.Subnet == network.Subnet6 {
+			poolRange = network.Pool6
+		}
+		_, subnet, _ := net.ParseCIDR(p.Subnet)
+		restored, err := NewIPAMPool(*subnet, poolRange, network.Exclude)
+		if err == nil {
+			err = SetIPAMPool(restored)
+		}
+		if err != nil {
+			log.Errorf("Unable to restore the pool of %s. %v", p.Subnet, err)
+		}
+	}
+}
+
+// isLocalNetwork reports whether the gateway of a network lives on this
+// host. Networks created before the owner was recorded belong to the host
+// that has their gateway port.
+func isLocalNetwork(network *Network) bool {
+	if network.GatewayMode == GatewayDistributed {
+		return true
+	}
+	if portUuidForName(network.ID) != "" {
+		_, ok := portsWithExternalId(NETWORK_KEY)[network.ID]
+		if ok || network.Host == "" {
+			return true
+		}
+	}
+	return network.Host != "" && network.Host == clusterAddress
+}
+
+// handOffNetworks gives the networks that have their gateway on this host to
+// another host, which realizes their gateway as it sees the update, and
+// removes their gateway port from this host. Distributed networks have a
+// gateway on every host. It returns the networks handed off.
+func handOffNetworks(host string) ([]string, error) {
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	handedOff := []string{}
+	for i := range networks {
+		network := &networks[i]
+		if network.GatewayMode == GatewayDistributed || !isLocalNetwork(network) {
+			continue
+		}
+		id := network.ID
+		err := retryIPAM(func() error {
+			oldValue, ok := datastore.Get(networkStore, id)
+			if !ok {
+				return nil
+			}
+			current := &Network{}
+			if err := json.Unmarshal(oldValue, current); err != nil {
+				return err
+			}
+			current.Host = host
+			data, err := json.Marshal(current)
+			if err != nil {
+				return err
+			}
+			return datastore.Put(networkStore, id, data, oldValue)
+		})
+		if err != nil {
+			return handedOff, err
+		}
+		log.Infof("Network %s handed off to %s", id, host)
+		handedOff = append(handedOff, id)
+		if err := unrealizeNetwork(id, network.Subnet, network.Subnet6); err != nil {
+			log.Errorf("Unable to remove the gateway of network %s. %v", id, err)
+		}
+	}
+	return handedOff, nil
+}
+
+// realizeNetwork makes sure that the gateway port of a local network exists
+// with the local VLAN tag of the network and the right address and that its
+// tunnel flows and NAT rules are installed. It is safe to call repeatedly.
+func realizeNetwork(network *Network) error {
+	if ovs == nil {
+		return errors.New("OVS not connected")
+	}
+	vlan, err := realizeSegment(network)
+	if err != nil {
+		return err
+	}
+	if portUuidForName(network.ID) == "" {
+		log.Infof("Creating gateway port for network %s", network.ID)
+		if err := AddInternalPort(ovs, defaultBridgeName, network.ID, vlan); err != nil {
+			return err
+		}
+		if err := waitForLink(network.ID); err != nil {
+			return err
+		}
+	} else if tag := portTag(network.ID); tag != vlan {
+		log.Infof("Updating VLAN of network %s from %d to %d", network.ID, tag, vlan)
+		if err := SetPortTag(ovs, network.ID, vlan); err != nil {
+			return err
+		}
+	}
+
+	ids := map[string]string{
+		NETWORK_KEY:     network.ID,
+		NETWORK_SUBNET:  network.Subnet,
+		NETWORK_SUBNET6: network.Subnet6,
+	}
+	if err := SetPortExternalIds(ovs, network.ID, ids); err != nil {
+		return err
+	}
+
+	if network.GatewayMode == GatewayDistributed {
+		if err := realizeAnycastGateway(network, vlan); err != nil {
+			return err
+		}
+	}
+
+	if err := SetMtu(network.ID, mtu); err != nil {
+		return err
+	}
+	if network.Subnet != "" {
+		if _, err := GetIfaceAddr(network.ID); err != nil {
+			if err := setGatewayAddress(network.ID, network.Gateway, network.Subnet); err != nil {
+				return err
+			}
+		}
+		if err := setupIPTables(network.ID, network.Subnet); err != nil {
+			return err
+		}
+	}
+	if network.Subnet6 != "" {
+		if err := enableIPv6Forwarding(); err != nil {
+			return err
+		}
+		if _, err := GetIfaceAddr6(network.ID); err != nil {
+			if err := setGatewayAddress(network.ID, network.Gateway6, network.Subnet6); err != nil {
+				return err
+			}
+		}
+		if err := setupIPTables(network.ID, network.Subnet6); err != nil {
+			return err
+		}
+	}
+	return InterfaceUp(network.ID)
+}
+
+func setGatewayAddress(name string, gateway string, subnet string) error {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	gatewayNet := &net.IPNet{net.ParseIP(gateway), ipNet.Mask}
+	log.Debugf("Setting address %s on %s", gatewayNet.String(), name)
+	return SetInterfaceIp(name, gatewayNet.String())
+}
+
+// The gateway routes the IPv6 traffic of the containers
+func enableIPv6Forwarding() error {
+	return ioutil.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+}
+
+// unrealizeNetwork removes the gateway port and NAT rules of a network
+func unrealizeNetwork(id string, subnet string, subnet6 string) error {
+	if ovs == nil {
+		return errors.New("OVS not connected")
+	}
+	log.Infof("Removing gateway port for network %s", id)
+	if tag := portTag(id); tag != 0 {
+		if err := deleteGatewayFlows(defaultBridgeName, tag); err != nil {
+			log.Error(err)
+		}
+	}
 	deletePort(ovs, defaultBridgeName, id)
+	for _, cidr := range []string{subnet, subnet6} {
+		if cidr == "" {
+			continue
+		}
+		if err := teardownIPTables(id, cidr); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// realizeAnycastGateway gives the gateway port of a distributed network the
+// MAC derived from the gateway address, so that it is identical on every
+// host, and keeps the gateways of the other hosts from being reached over the
+// tunnels.
+func realizeAnycastGateway(network *Network, vlan uint) error {
+	gateway := net.ParseIP(network.Gateway)
+	gateway6 := net.ParseIP(network.Gateway6)
+	mac := generateMacAddr(gateway6)
+	if gateway != nil {
+		mac = generateMacAddr(gateway)
+	}
+	iface, err := net.InterfaceByName(network.ID)
+	if err != nil {
+		return err
+	}
+	if iface.HardwareAddr.String() != mac.String() {
+		log.Debugf("Setting gateway MAC %s on %s", mac.String(), network.ID)
+		if err := SetInterfaceMac(network.ID, mac.String()); err != nil {
+			return err
+		}
+	}
+	return addGatewayFlows(defaultBridgeName, vlan, gateway, gateway6, mac)
+}
+
+// realizeNetworks converges the local gateway ports and tunnel flows with a
+// snapshot of the network store. Gateways of local networks are (re)created
+// and the ones of deleted networks are removed, as are their tunnel flows.
+func realizeNetworks(data map[string][]byte) {
+	realizeLock.Lock()
+	defer realizeLock.Unlock()
+	if ovs == nil {
+		log.Debug("OVS not connected. Skipping network realization")
+		return
+	}
+
+	networks := make(map[string]*Network)
+	for key, value := range data {
+		network := &Network{}
+		if err := json.Unmarshal(value, network); err != nil {
+			log.Errorf("Invalid network %s in the datastore. %v", key, err)
+			continue
+		}
+		networks[network.ID] = network
+	}
+
+	tags := getLocalVlans()
+	for _, network := range networks {
+		if isLocalNetwork(network) {
+			if err := realizeNetwork(network); err != nil {
+				log.Errorf("Unable to realize network %s. %v", network.ID, err)
+			}
+		} else if tag, ok := tags[network.ID]; ok {
+			if err := addTunnelFlows(tag, network); err != nil {
+				log.Errorf("Unable to realize network %s. %v", network.ID, err)
+			}
+		}
+	}
+	for id := range tags {
+		if _, ok := networks[id]; ok {
+			continue
+		}
+		if err := unrealizeSegment(id); err != nil {
+			log.Errorf("Unable to remove the tunnel flows of network %s. %v", id, err)
+		}
+	}
+
+	subnets := portsWithExternalId(NETWORK_SUBNET)
+	subnets6 := portsWithExternalId(NETWORK_SUBNET6)
+	for port := range portsWithExternalId(NETWORK_KEY) {
+		if _, ok := networks[port]; ok {
+			continue
+		}
+		if err := unrealizeNetwork(port, subnets[port], subnets6[port]); err != nil {
+			log.Errorf("Unable to remove network %s. %v", port, err)
+		}
+	}
+}
+
 func CreateDefaultNetwork() (*Network, error) {
 	subnet, err := GetAvailableSubnet()
 	if err != nil {
 		return &Network{}, err
 	}
-	return CreateNetwork(DefaultNetworkName, subnet)
+	return CreateNetwork(DefaultNetworkName, subnet, nil, nil, nil, "", nil)
 }
 
 func GetDefaultNetwork() (*Network, error) {
@@ -155,33 +648,38 @@ func GetDefaultNetwork() (*Network, error) {
 }
 
 func allocateVlan() (uint, error) {
-	vlanArray, _, ok := ecc.Get(vlanStore, "vlan")
-	currVal := make([]byte, vlanCount/8)
-	copy(currVal, vlanArray)
-	if !ok {
-		vlanArray = make([]byte, vlanCount/8)
+	vlan := uint(vlanCount)
+	err := retryIPAM(func() error {
+		vlanArray, ok := datastore.Get(vlanStore, "vlan")
+		currVal := make([]byte, vlanCount/8)
+		copy(currVal, vlanArray)
+		if !ok {
+			vlanArray = make([]byte, vlanCount/8)
+		}
+		vlan = testAndSetBit(vlanArray)
+		if vlan >= vlanCount {
+			return nil
+		}
+		return datastore.Put(vlanStore, "vlan", vlanArray, currVal)
+	})
+	if err != nil {
+		return vlanCount, err
 	}
-	vlan := testAndSetBit(vlanArray)
 	if vlan >= vlanCount {
-		return vlanCount, errors.New("Vlan unavailable")
-	}
-	eccerr := ecc.Put(vlanStore, "vlan", vlanArray, currVal)
-	if eccerr == ecc.OUTDATED {
-		return allocateVlan()
+		return vlanCount, ErrVlanUnavailable
 	}
 	return vlan, nil
 }
 
-func releaseVlan(vlan uint) {
-	vlanArray, _, ok := ecc.Get(vlanStore, "vlan")
-	currVal := make([]byte, vlanCount/8)
-	copy(currVal, vlanArray)
-	if !ok {
-		vlanArray = make([]byte, vlanCount/8)
-	}
-	clearBit(vlanArray, vlan-1)
-	eccerr := ecc.Put(vlanStore, "vlan", vlanArray, currVal)
-	if eccerr == ecc.OUTDATED {
-		releaseVlan(vlan)
-	}
+func releaseVlan(vlan uint) error {
+	return retryIPAM(func() error {
+		vlanArray, ok := datastore.Get(vlanStore, "vlan")
+		currVal := make([]byte, vlanCount/8)
+		copy(currVal, vlanArray)
+		if !ok {
+			vlanArray = make([]byte, vlanCount/8)
+		}
+		clearBit(vlanArray, vlan-1)
+		return datastore.Put(vlanStore, "vlan", vlanArray, currVal)
+	})
 }
@@ -1,12 +1,15 @@
 package daemon
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"testing"
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/libovsdb"
 )
 
 var subnetArray []*net.IPNet
@@ -40,7 +43,7 @@ func TestNetworkCreate(t *testing.T) {
 		t.Skip(msg)
 	}
 	for i := 0; i < len(subnetArray); i++ {
-		network, err := CreateNetwork(fmt.Sprintf("Network-%d", i+1), subnetArray[i])
+		network, err := CreateNetwork(fmt.Sprintf("Network-%d", i+1), subnetArray[i], nil, nil, nil, "", nil)
 		if err != nil {
 			t.Error("Error Creating network ", err)
 		}
@@ -85,3 +88,226 @@ func TestNetworkCleanup(t *testing.T) {
 		}
 	}
 }
+
+func networkCache() map[string]map[string]libovsdb.Row {
+	emptySet, _ := libovsdb.NewOvsSet([]string{})
+	externalIds := libovsdb.OvsMap{GoMap: map[interface{}]interface{}{
+		NETWORK_KEY:    "foo",
+		NETWORK_SUBNET: "10.1.0.0/24",
+	}}
+	return map[string]map[string]libovsdb.Row{
+		"Port": {
+			"p1": {Fields: map[string]interface{}{"name": "foo", "tag": float64(2), "external_ids": externalIds}},
+			"p2": {Fields: map[string]interface{}{"name": "legacy", "tag": *emptySet}},
+		},
+	}
+}
+
+func TestGatewayPortCache(t *testing.T) {
+	defer withOvsCache(networkCache())()
+
+	if tag := portTag("foo"); tag != 2 {
+		t.Fatalf("Expected tag 2, got %d", tag)
+	}
+	if tag := portTag("legacy"); tag != 0 {
+		t.Fatalf("Untagged port should have tag 0, got %d", tag)
+	}
+	ports := portsWithExternalId(NETWORK_SUBNET)
+	if len(ports) != 1 || ports["foo"] != "10.1.0.0/24" {
+		t.Fatalf("Incorrect gateway ports : %v", ports)
+	}
+}
+
+func TestIsLocalNetwork(t *testing.T) {
+	defer withOvsCache(networkCache())()
+	orig := clusterAddress
+	clusterAddress = "10.0.0.1"
+	defer func() { clusterAddress = orig }()
+
+	networks := []struct {
+		network *Network
+		local   bool
+	}{
+		{&Network{ID: "foo", Host: "10.0.0.2"}, true},
+		{&Network{ID: "legacy"}, true},
+		{&Network{ID: "legacy", Host: "10.0.0.2"}, false},
+		{&Network{ID: "bar", Host: "10.0.0.1"}, true},
+		{&Network{ID: "bar", Host: "10.0.0.2"}, false},
+		{&Network{ID: "bar"}, false},
+		{&Network{ID: "bar", Host: "10.0.0.2", GatewayMode: GatewayDistributed}, true},
+	}
+	for _, n := range networks {
+		if isLocalNetwork(n.network) != n.local {
+			t.Errorf("Network %+v should be local : %v", n.network, n.local)
+		}
+	}
+}
+
+func TestHandOffNetworks(t *testing.T) {
+	defer useMemoryDatastore()()
+	orig := clusterAddress
+	clusterAddress = "10.0.0.1"
+	defer func() { clusterAddress = orig }()
+	putNetwork(t, &Network{ID: "web", Subnet: "10.1.0.0/24", Host: "10.0.0.1", VNI: 1})
+	putNetwork(t, &Network{ID: "db", Subnet: "10.2.0.0/24", Host: "10.0.0.3", VNI: 2})
+	putNetwork(t, &Network{ID: "app", Subnet: "10.3.0.0/24", Host: "10.0.0.1", GatewayMode: GatewayDistributed, VNI: 3})
+
+	clusterMembers.update("10.0.0.1", MemberAlive)
+	clusterMembers.update("10.0.0.3", MemberAlive)
+	clusterMembers.update("10.0.0.2", MemberLeft)
+	defer clusterMembers.reset()
+	host, ok := clusterMembers.successor(clusterAddress)
+	if !ok || host != "10.0.0.3" {
+		t.Fatalf("Expected 10.0.0.3 to take over, got %q", host)
+	}
+
+	networks, err := handOffNetworks(host)
+	if err != nil || len(networks) != 1 || networks[0] != "web" {
+		t.Fatalf("Expected web to be handed off, got %v %v", networks, err)
+	}
+	for id, owner := range map[string]string{"web": "10.0.0.3", "db": "10.0.0.3", "app": "10.0.0.1"} {
+		if network, _ := GetNetwork(id); network.Host != owner {
+			t.Errorf("Network %s should belong to %s, got %s", id, owner, network.Host)
+		}
+	}
+}
+
+func TestNetworkGateway(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations(nil)()
+	_, subnet, _ := net.ParseCIDR("10.5.0.0/24")
+	if gateway, allocated, err := networkGateway(*subnet, nil); err != nil || !allocated || gateway.String() != "10.5.0.1" {
+		t.Fatalf("Expected the first address, got %v %v", gateway, err)
+	}
+	requested := net.ParseIP("10.5.0.254")
+	if gateway, allocated, err := networkGateway(*subnet, requested); err != nil || !allocated || !gateway.Equal(requested) {
+		t.Fatalf("Expected the requested gateway, got %v %v", gateway, err)
+	}
+	if _, _, err := networkGateway(*subnet, requested); err != ErrAddressInUse {
+		t.Fatalf("A gateway in use should be refused, got %v", err)
+	}
+
+	// Docker allocates the gateway of its networks through the IPAM driver
+	d := NewDaemon()
+	pluginCall(t, d, "IpamDriver.RequestPool", &ipamRequestPoolRequest{Pool: "10.6.0.0/24"}, nil)
+	pluginCall(t, d, "IpamDriver.RequestAddress", &ipamRequestAddressRequest{PoolID: "10.6.0.0/24", Address: "10.6.0.1"}, nil)
+	_, subnet, _ = net.ParseCIDR("10.6.0.0/24")
+	if gateway, allocated, err := networkGateway(*subnet, net.ParseIP("10.6.0.1")); err != nil || allocated || gateway.String() != "10.6.0.1" {
+		t.Fatalf("The gateway allocated by Docker should be adopted, got %v %v", gateway, err)
+	}
+}
+
+func TestCreateNetworkFailure(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations(nil)()
+	orig := ovs
+	ovs = nil
+	defer func() { ovs = orig }()
+
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/24")
+	pool, _ := NewIPAMPool(*subnet, "10.1.0.10-10.1.0.20", nil)
+	if _, err := CreateNetwork("sp-failed", subnet, nil, nil, nil, "", []*IPAMPool{pool}); err == nil {
+		t.Fatal("Creating a network without OVS should fail")
+	}
+	if block, _, _ := getVniBlock(); !block.add(1) {
+		t.Fatal("The VNI of the network should be released")
+	}
+	if pool, err := GetIPAMPool(*subnet); pool != nil || err != nil {
+		t.Fatalf("The pool of the network should be deleted, got %+v %v", pool, err)
+	}
+}
+
+// failingDatastore fails to store anything in one of the stores
+type failingDatastore struct {
+	Datastore
+	store string
+}
+
+func (f *failingDatastore) Put(store string, key string, value []byte, oldValue []byte) error {
+	if store == f.store {
+		return errors.New("Datastore unavailable")
+	}
+	return f.Datastore.Put(store, key, value, oldValue)
+}
+
+func TestCreateNetworkStoreFailure(t *testing.T) {
+	defer useMemoryDatastore()()
+	datastore = &failingDatastore{Datastore: datastore, store: networkStore}
+
+	// The interface exists, so the network needs no OVS to be stored
+	_, subnet, _ := net.ParseCIDR("127.0.0.0/8")
+	pool, _ := NewIPAMPool(*subnet, "127.0.0.10-127.0.0.20", nil)
+	if _, err := CreateNetwork("lo", subnet, nil, nil, nil, "", []*IPAMPool{pool}); err == nil {
+		t.Fatal("A network that cannot be stored should fail")
+	}
+	if block, _, _ := getVniBlock(); !block.add(1) {
+		t.Fatal("The VNI of the network should be released")
+	}
+	if pool, err := GetIPAMPool(*subnet); pool != nil || err != nil {
+		t.Fatalf("The pool of the network should be deleted, got %+v %v", pool, err)
+	}
+}
+
+// racingDatastore stores a network of another host just before a network is
+// stored
+type racingDatastore struct {
+	Datastore
+	network *Network
+}
+
+func (r *racingDatastore) Put(store string, key string, value []byte, oldValue []byte) error {
+	if store == networkStore && r.network != nil {
+		data, _ := json.Marshal(r.network)
+		r.Datastore.Put(store, r.network.ID, data, nil)
+		r.network = nil
+	}
+	return r.Datastore.Put(store, key, value, oldValue)
+}
+
+func TestCreateNetworkRace(t *testing.T) {
+	defer useMemoryDatastore()()
+	winner := &Network{ID: "lo", Subnet: "127.0.0.0/8", Gateway: "127.0.0.1", Host: "10.0.0.2", VNI: 7, Pool: "127.0.0.100-127.0.0.200"}
+	datastore = &racingDatastore{Datastore: datastore, network: winner}
+
+	// The gateway of the existing interface belongs to the other network
+	_, subnet, _ := net.ParseCIDR("127.0.0.0/8")
+	if err := IPAMRequestAddress(net.ParseIP("127.0.0.1"), *subnet); err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := NewIPAMPool(*subnet, "127.0.0.10-127.0.0.20", nil)
+	network, err := CreateNetwork("lo", subnet, nil, nil, nil, "", []*IPAMPool{pool})
+	if err != nil || network.Host != winner.Host || network.VNI != winner.VNI {
+		t.Fatalf("Expected the network of the other host, got %+v %v", network, err)
+	}
+	if pool, err := GetIPAMPool(*subnet); err != nil || pool.Pool == nil || pool.Pool.String() != winner.Pool {
+		t.Fatalf("The pool of the other network should be restored, got %+v %v", pool, err)
+	}
+	if !IPAMRelease(net.ParseIP("127.0.0.1"), *subnet) {
+		t.Fatal("The gateway of the existing interface should not be released")
+	}
+}
+
+func TestCreateNetworkRealizeFailure(t *testing.T) {
+	defer useMemoryDatastore()()
+	orig := ovs
+	ovs = nil
+	defer func() { ovs = orig }()
+
+	// The interface exists, so the network is stored before it fails to be
+	// realized without OVS
+	_, subnet, _ := net.ParseCIDR("127.0.0.0/8")
+	pool, _ := NewIPAMPool(*subnet, "127.0.0.10-127.0.0.20", nil)
+	network, err := CreateNetwork("lo", subnet, nil, nil, nil, "", []*IPAMPool{pool})
+	if err == nil || network != nil {
+		t.Fatalf("A network that cannot be realized should fail, got %+v", network)
+	}
+	if _, err := GetNetwork("lo"); err == nil {
+		t.Fatal("The network should be deleted")
+	}
+	if block, _, _ := getVniBlock(); !block.add(1) {
+		t.Fatal("The VNI of the network should be released")
+	}
+	if pool, err := GetIPAMPool(*subnet); pool != nil || err != nil {
+		t.Fatalf("The pool of the network should be deleted, got %+v %v", pool, err)
+	}
+}
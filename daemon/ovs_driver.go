@@ -17,6 +17,16 @@ var cache map[string]map[string]libovsdb.Row
 const CONTEXT_KEY = "container_id"
 const CONTEXT_VALUE = "container_data"
 
+// Gateway ports of the networks realized on this host are marked with the
+// network they belong to
+const NETWORK_KEY = "socketplane_network"
+const NETWORK_SUBNET = "socketplane_subnet"
+const NETWORK_SUBNET6 = "socketplane_subnet6"
+
+// The ports of the connections and endpoints are marked with the network they
+// belong to, so that their tag is known as the local tag of the network
+const SEGMENT_KEY = "socketplane_segment"
+
 func GetTableCache(tableName string) map[string]libovsdb.Row {
 	return cache[tableName]
 }
@@ -46,6 +56,12 @@ func monitorDockerBridge(ovs *libovsdb.OvsdbClient) {
 }
 
 func CreateOVSBridge(ovs *libovsdb.OvsdbClient, bridgeName string) error {
+	return createOVSBridge(ovs, bridgeName, true)
+}
+
+// createOVSBridge creates a bridge with an internal port of the same name.
+// STP is only needed on bridges that forward with the NORMAL action.
+func createOVSBridge(ovs *libovsdb.OvsdbClient, bridgeName string, stp bool) error {
 	namedBridgeUuid := "bridge"
 	namedPortUuid := "port"
 	namedIntfUuid := "intf"
@@ -77,7 +93,7 @@ func CreateOVSBridge(ovs *libovsdb.OvsdbClient, bridgeName string) error {
 	// bridge row to insert
 	bridge := make(map[string]interface{})
 	bridge["name"] = bridgeName
-	bridge["stp_enable"] = true
+	bridge["stp_enable"] = stp
 	bridge["ports"] = libovsdb.UUID{namedPortUuid}
 
 	insertBridgeOp := libovsdb.Operation{
@@ -123,16 +139,16 @@ func getRootUuid() string {
 	return ""
 }
 
-func addVxlanPort(ovs *libovsdb.OvsdbClient, bridgeName string, portName string, peerAddress string) {
+// addTunnelPort adds a tunnel of the given type, vxlan, gre or geneve, and
+// interface options to a bridge
+func addTunnelPort(ovs *libovsdb.OvsdbClient, bridgeName string, portName string, tunnelType string, options map[string]string) error {
 	namedPortUuid := "port"
 	namedIntfUuid := "intf"
 
-	options := make(map[string]interface{})
-	options["remote_ip"] = peerAddress
 	// intf row to insert
 	intf := make(map[string]interface{})
 	intf["name"] = portName
-	intf["type"] = `vxlan`
+	intf["type"] = tunnelType
 	intf["options"], _ = libovsdb.NewOvsMap(options)
 
 	insertIntfOp := libovsdb.Operation{
@@ -145,7 +161,7 @@ func addVxlanPort(ovs *libovsdb.OvsdbClient, bridgeName string, portName string,
 	// port row to insert
 	port := make(map[string]interface{})
 	port["name"] = portName
-	port["interfaces"] = libovsdb.UUID{namedIntfUuid}
+	port["interfaces"] = libovsdb.UUID{GoUuid: namedIntfUuid}
 
 	insertPortOp := libovsdb.Operation{
 		Op:       "insert",
@@ -155,7 +171,7 @@ func addVxlanPort(ovs *libovsdb.OvsdbClient, bridgeName string, portName string,
 	}
 
 	// Inserting a row in Port table requires mutating the bridge table.
-	mutateUuid := []libovsdb.UUID{libovsdb.UUID{namedPortUuid}}
+	mutateUuid := []libovsdb.UUID{libovsdb.UUID{GoUuid: namedPortUuid}}
 	mutateSet, _ := libovsdb.NewOvsSet(mutateUuid)
 	mutation := libovsdb.NewMutation("ports", "insert", mutateSet)
 	condition := libovsdb.NewCondition("name", "==", bridgeName)
@@ -167,18 +183,75 @@ func addVxlanPort(ovs *libovsdb.OvsdbClient, bridgeName string, portName string,
 		Mutations: []interface{}{mutation},
 		Where:     []interface{}{condition},
 	}
-	operations := []libovsdb.Operation{insertIntfOp, insertPortOp, mutateOp}
-	reply, _ := ovs.Transact("Open_vSwitch", operations...)
-	if len(reply) < len(operations) {
-		fmt.Println("Number of Replies should be atleast equal to number of Operations")
+	return transact(ovs, insertIntfOp, insertPortOp, mutateOp)
+}
+
+// setTunnelOptions updates the type and interface options of a tunnel
+func setTunnelOptions(ovs *libovsdb.OvsdbClient, portName string, tunnelType string, options map[string]string) error {
+	intf := make(map[string]interface{})
+	intf["type"] = tunnelType
+	intf["options"], _ = libovsdb.NewOvsMap(options)
+	condition := libovsdb.NewCondition("name", "==", portName)
+
+	updateOp := libovsdb.Operation{
+		Op:    "update",
+		Table: "Interface",
+		Row:   intf,
+		Where: []interface{}{condition},
 	}
-	for i, o := range reply {
-		if o.Error != "" && i < len(operations) {
-			fmt.Println("Transaction Failed due to an error :", o.Error, " details:", o.Details, " in ", operations[i])
-		} else if o.Error != "" {
-			fmt.Println("Transaction Failed due to an error :", o.Error)
-		}
+	return transact(ovs, updateOp)
+}
+
+// addPatchPort adds one end of a pair of patch ports to a bridge. A non zero
+// ofport is requested as the OpenFlow port number of the port.
+func addPatchPort(ovs *libovsdb.OvsdbClient, bridgeName string, portName string, peerName string, ofport uint) error {
+	namedPortUuid := "port"
+	namedIntfUuid := "intf"
+
+	options := make(map[string]interface{})
+	options["peer"] = peerName
+	// intf row to insert
+	intf := make(map[string]interface{})
+	intf["name"] = portName
+	intf["type"] = `patch`
+	intf["options"], _ = libovsdb.NewOvsMap(options)
+	if ofport != 0 {
+		intf["ofport_request"] = ofport
+	}
+
+	insertIntfOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Interface",
+		Row:      intf,
+		UUIDName: namedIntfUuid,
+	}
+
+	// port row to insert
+	port := make(map[string]interface{})
+	port["name"] = portName
+	port["interfaces"] = libovsdb.UUID{GoUuid: namedIntfUuid}
+
+	insertPortOp := libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Port",
+		Row:      port,
+		UUIDName: namedPortUuid,
+	}
+
+	// Inserting a row in Port table requires mutating the bridge table.
+	mutateUuid := []libovsdb.UUID{libovsdb.UUID{GoUuid: namedPortUuid}}
+	mutateSet, _ := libovsdb.NewOvsSet(mutateUuid)
+	mutation := libovsdb.NewMutation("ports", "insert", mutateSet)
+	condition := libovsdb.NewCondition("name", "==", bridgeName)
+
+	// simple mutate operation
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Bridge",
+		Mutations: []interface{}{mutation},
+		Where:     []interface{}{condition},
 	}
+	return transact(ovs, insertIntfOp, insertPortOp, mutateOp)
 }
 
 func portUuidForName(portName string) string {
@@ -191,6 +264,85 @@ func portUuidForName(portName string) string {
 	return ""
 }
 
+// bridgePorts returns the names of the ports of a bridge from the OVS cache
+func bridgePorts(bridgeName string) []string {
+	ports := []string{}
+	for _, row := range cache["Bridge"] {
+		if row.Fields["name"] != bridgeName {
+			continue
+		}
+		uuids := []interface{}{row.Fields["ports"]}
+		if set, ok := row.Fields["ports"].(libovsdb.OvsSet); ok {
+			uuids = set.GoSet
+		}
+		for _, uuid := range uuids {
+			if uuid, ok := uuid.(libovsdb.UUID); ok {
+				if name, ok := cache["Port"][uuid.GoUuid].Fields["name"].(string); ok {
+					ports = append(ports, name)
+				}
+			}
+		}
+	}
+	return ports
+}
+
+func interfaceForName(intfName string) (libovsdb.Row, bool) {
+	for _, row := range cache["Interface"] {
+		if row.Fields["name"] == intfName {
+			return row, true
+		}
+	}
+	return libovsdb.Row{}, false
+}
+
+// ovsStringField returns the value of an optional string column. Unset
+// optional columns are represented by an empty set.
+func ovsStringField(row libovsdb.Row, field string) string {
+	if value, ok := row.Fields[field].(string); ok {
+		return value
+	}
+	return ""
+}
+
+// ovsIntField returns the value of an optional integer column. OVSDB numbers
+// are decoded as float64.
+func ovsIntField(row libovsdb.Row, field string) (uint, bool) {
+	if value, ok := row.Fields[field].(float64); ok {
+		return uint(value), true
+	}
+	return 0, false
+}
+
+// portTag returns the VLAN tag of a port from the OVS cache
+func portTag(portName string) uint {
+	row, ok := cache["Port"][portUuidForName(portName)]
+	if !ok {
+		return 0
+	}
+	tag, _ := ovsIntField(row, "tag")
+	return tag
+}
+
+// portsWithExternalId returns the ports that carry the given external_ids
+// key, mapped to the value of the key
+func portsWithExternalId(key string) map[string]string {
+	ports := make(map[string]string)
+	for _, row := range cache["Port"] {
+		externalIds, ok := row.Fields["external_ids"].(libovsdb.OvsMap)
+		if !ok {
+			continue
+		}
+		value, ok := externalIds.GoMap[key].(string)
+		if !ok {
+			continue
+		}
+		if name, ok := row.Fields["name"].(string); ok {
+			ports[name] = value
+		}
+	}
+	return ports
+}
+
 func portExists(ovs *libovsdb.OvsdbClient, portName string) (bool, error) {
 	condition := libovsdb.NewCondition("name", "==", portName)
 	selectOp := libovsdb.Operation{
@@ -290,6 +442,55 @@ func UpdatePortContext(ovs *libovsdb.OvsdbClient, portName string, key string, c
 	return nil
 }
 
+func SetPortTag(ovs *libovsdb.OvsdbClient, portName string, tag uint) error {
+	port := make(map[string]interface{})
+	if tag != 0 {
+		port["tag"] = tag
+	} else {
+		port["tag"], _ = libovsdb.NewOvsSet([]uint{})
+	}
+	condition := libovsdb.NewCondition("name", "==", portName)
+
+	updateOp := libovsdb.Operation{
+		Op:    "update",
+		Table: "Port",
+		Row:   port,
+		Where: []interface{}{condition},
+	}
+
+	return transact(ovs, updateOp)
+}
+
+func SetPortExternalIds(ovs *libovsdb.OvsdbClient, portName string, ids map[string]string) error {
+	externalIds, _ := libovsdb.NewOvsMap(ids)
+	mutation := libovsdb.NewMutation("external_ids", "insert", externalIds)
+	condition := libovsdb.NewCondition("name", "==", portName)
+
+	mutateOp := libovsdb.Operation{
+		Op:        "mutate",
+		Table:     "Port",
+		Mutations: []interface{}{mutation},
+		Where:     []interface{}{condition},
+	}
+
+	return transact(ovs, mutateOp)
+}
+
+func transact(ovs *libovsdb.OvsdbClient, operations ...libovsdb.Operation) error {
+	reply, _ := ovs.Transact("Open_vSwitch", operations...)
+	if len(reply) < len(operations) {
+		return errors.New("Number of Replies should be atleast equal to number of Operations")
+	}
+	for i, o := range reply {
+		if o.Error != "" && i < len(operations) {
+			return fmt.Errorf("Transaction Failed due to an error : %v details: %v in %v", o.Error, o.Details, operations[i])
+		} else if o.Error != "" {
+			return fmt.Errorf("Transaction Failed due to an error : %v", o.Error)
+		}
+	}
+	return nil
+}
+
 func AddInternalPort(ovs *libovsdb.OvsdbClient, bridgeName string, portName string, tag uint) error {
 	namedPortUuid := "port"
 	namedIntfUuid := "intf"
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/samalba/dockerclient"
 )
 
@@ -99,8 +100,16 @@ func psAdapterPostHook(d *Daemon, reqParams adapterRequest) (postResp *adapterPo
 		var cfg = &Connection{}
 		var op = ConnectionAdd
 
+		// The Docker events watcher may attach and detach the container too
+		attachLock.Lock()
+		defer attachLock.Unlock()
+
 		switch reqParams.ClientRequest.Method {
 		case "POST":
+			if _, ok := d.connection(cid); ok {
+				log.Infof("Container %s already connected", cid)
+				return
+			}
 			docker, _ := dockerclient.NewDockerClient(
 				"unix:///var/run/docker.sock", nil)
 			info, err := docker.InspectContainer(cid)
@@ -119,14 +128,24 @@ func psAdapterPostHook(d *Daemon, reqParams adapterRequest) (postResp *adapterPo
 				if val[0] == "SP_NETWORK" {
 					cfg.Network = strings.Trim(val[1], " ")
 				}
+				if val[0] == "SP_IP" {
+					cfg.RequestedIP = strings.Trim(val[1], " ")
+				}
+			}
+
+			if cfg.RequestedIP != "" {
+				if err := reserveRequestedIP(cfg); err != nil {
+					log.Errorf("Unable to reserve %s for container %s. %v", cfg.RequestedIP, cid, err)
+					failPostHook(postResp, err)
+					return
+				}
 			}
 
 			op = ConnectionAdd
 		case "DELETE":
 			var ok bool
-			if cfg, ok = d.Connections[cid]; !ok {
-				fmt.Println("Couldn't find the connection", cid)
-				postResp.ModifiedServerResponse.Code = 500
+			if cfg, ok = d.connection(cid); !ok {
+				log.Infof("Container %s already disconnected", cid)
 				return
 			}
 
@@ -137,16 +156,30 @@ func psAdapterPostHook(d *Daemon, reqParams adapterRequest) (postResp *adapterPo
 			op,
 			cfg,
 			make(chan *Connection),
+			nil,
 		}
 
 		d.cC <- context
 
 		<-context.Result
+		if context.Err != nil {
+			log.Errorf("Unable to connect container %s. %v", cid, context.Err)
+			failPostHook(postResp, context.Err)
+		}
 	}
 
 	return
 }
 
+// failPostHook replaces the Docker response with the error, so that the
+// container start fails instead of leaving the container unconnected
+func failPostHook(postResp *adapterPostResponse, err error) {
+	apiErr := requestedIPError(err)
+	postResp.ModifiedServerResponse.Code = apiErr.Code
+	postResp.ModifiedServerResponse.ContentType = "text/plain; charset=utf-8"
+	postResp.ModifiedServerResponse.Body = apiErr.Message
+}
+
 func psAdapter(d *Daemon, w http.ResponseWriter, r *http.Request) *apiError {
 	var reqParams adapterRequest
 	decoder := json.NewDecoder(r.Body)
@@ -0,0 +1,251 @@
+package daemon
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/go-fastping"
+	"github.com/socketplane/socketplane/config"
+)
+
+// The underlay address of every peer is probed with ICMP echo requests. A
+// broken underlay path otherwise only shows as packet loss in the containers.
+// The tunnel to a peer is degraded once the peer missed a number of probes in
+// a row, and its port may then be brought down until the peer replies again.
+
+// reachabilityWindow is the number of probes the loss of a peer is computed on
+const reachabilityWindow = 10
+
+// PeerReachability holds the results of the probes of a peer. Loss is the
+// percentage of the last probes that were not replied to and Failures the
+// number of probes missed in a row.
+type PeerReachability struct {
+	Address    string    `json:"address"`
+	Sent       int       `json:"sent"`
+	Received   int       `json:"received"`
+	Loss       float64   `json:"loss"`
+	Latency    float64   `json:"latency_ms"`
+	AvgLatency float64   `json:"avg_latency_ms"`
+	Failures   int       `json:"failures"`
+	Reachable  bool      `json:"reachable"`
+	Degraded   bool      `json:"degraded"`
+	LastProbe  time.Time `json:"last_probe"`
+	LastReply  time.Time `json:"last_reply"`
+	history    []bool
+	rttTotal   time.Duration
+}
+
+// peerReachabilityList holds the reachability of the probed peers
+type peerReachabilityList struct {
+	sync.Mutex
+	peers map[string]*PeerReachability
+}
+
+var peerReachability = &peerReachabilityList{peers: make(map[string]*PeerReachability)}
+
+// record records the result of a probe of a peer, rtt being ignored when the
+// peer did not reply. It returns the reachability of the peer and whether its
+// tunnel was degraded or recovered by this probe.
+func (p *peerReachabilityList) record(peer string, rtt time.Duration, replied bool, threshold int) (PeerReachability, bool) {
+	p.Lock()
+	defer p.Unlock()
+	r, ok := p.peers[peer]
+	if !ok {
+		r = &PeerReachability{Address: peer}
+		p.peers[peer] = r
+	}
+	degraded := r.Degraded
+	now := time.Now()
+	r.Sent++
+	r.LastProbe = now
+	r.Reachable = replied
+	if replied {
+		r.Received++
+		r.rttTotal += rtt
+		r.Latency = milliseconds(rtt)
+		r.AvgLatency = milliseconds(r.rttTotal / time.Duration(r.Received))
+		r.LastReply = now
+		r.Failures = 0
+	} else {
+		r.Failures++
+	}
+	r.history = append(r.history, replied)
+	if len(r.history) > reachabilityWindow {
+		r.history = r.history[1:]
+	}
+	lost := 0
+	for _, h := range r.history {
+		if !h {
+			lost++
+		}
+	}
+	r.Loss = float64(lost) * 100 / float64(len(r.history))
+	r.Degraded = r.Failures >= threshold
+	return *r, r.Degraded != degraded
+}
+
+func (p *peerReachabilityList) get(peer string) (PeerReachability, bool) {
+	p.Lock()
+	defer p.Unlock()
+	r, ok := p.peers[peer]
+	if !ok {
+		return PeerReachability{}, false
+	}
+	return *r, true
+}
+
+// list returns the reachability of the peers sorted by address
+func (p *peerReachabilityList) list() []PeerReachability {
+	p.Lock()
+	defer p.Unlock()
+	addresses := make([]string, 0, len(p.peers))
+	for address := range p.peers {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	peers := make([]PeerReachability, 0, len(addresses))
+	for _, address := range addresses {
+		peers = append(peers, *p.peers[address])
+	}
+	return peers
+}
+
+// prune forgets the peers that are no longer probed
+func (p *peerReachabilityList) prune(peers []string) {
+	p.Lock()
+	defer p.Unlock()
+	probed := make(map[string]bool)
+	for _, peer := range peers {
+		probed[peer] = true
+	}
+	for address := range p.peers {
+		if !probed[address] {
+			delete(p.peers, address)
+		}
+	}
+}
+
+func (p *peerReachabilityList) reset() {
+	p.Lock()
+	p.peers = make(map[string]*PeerReachability)
+	p.Unlock()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pingPeers sends an ICMP echo request to every peer and returns the round
+// trip time of the peers that replied within timeout
+var pingPeers = fastpingPeers
+
+func fastpingPeers(peers []string, timeout time.Duration) (map[string]time.Duration, error) {
+	var lock sync.Mutex
+	rtts := make(map[string]time.Duration)
+	p := fastping.NewPinger()
+	p.MaxRTT = timeout
+	for _, peer := range peers {
+		if err := p.AddIP(peer); err != nil {
+			log.Errorf("Unable to probe %s. %v", peer, err)
+		}
+	}
+	p.OnRecv = func(addr *net.IPAddr, rtt time.Duration) {
+		lock.Lock()
+		rtts[addr.IP.String()] = rtt
+		lock.Unlock()
+	}
+	// Destination unreachable and the like only count as lost probes
+	p.OnErr = func(addr *net.IPAddr, icmpType int) {}
+	err := p.Run()
+	lock.Lock()
+	defer lock.Unlock()
+	return rtts, err
+}
+
+// monitoredPeers returns the peers to probe. The alive members known from the
+// node updates are used when the datastore does not report the membership.
+func monitoredPeers() ([]string, error) {
+	members, err := datastore.Members()
+	if err == ErrMembershipUnavailable {
+		members, err = nil, nil
+		for _, member := range clusterMembers.list() {
+			if member.Status == MemberAlive {
+				members = append(members, member.Address)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	peers := []string{}
+	for _, member := range members {
+		if member != clusterAddress {
+			peers = append(peers, member)
+		}
+	}
+	return peers, nil
+}
+
+// probePeers probes every peer once, records their reachability and brings
+// the ports of the degraded tunnels down if configured to
+func probePeers() error {
+	peers, err := monitoredPeers()
+	if err != nil {
+		return err
+	}
+	peerReachability.prune(peers)
+	if len(peers) == 0 {
+		return nil
+	}
+	timeout := time.Duration(config.Monitor.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	threshold := config.Monitor.Threshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	// The probes could not be sent, which says nothing about the peers
+	rtts, err := pingPeers(peers, timeout)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		rtt, replied := rtts[peer]
+		r, changed := peerReachability.record(peer, rtt, replied, threshold)
+		if changed && r.Degraded {
+			log.Warnf("Tunnel to %s degraded. The peer missed the last %d probes", peer, r.Failures)
+		} else if changed {
+			log.Infof("Tunnel to %s recovered", peer)
+		}
+		if ovs == nil {
+			continue
+		}
+		if err := setTunnelPortState(peer, r.Degraded && config.Monitor.PortDown); err != nil {
+			log.Errorf("Unable to change the state of the tunnel to %s. %v", peer, err)
+		}
+	}
+	return nil
+}
+
+// setTunnelPortState brings the port of the tunnel to a peer down or up
+func setTunnelPortState(peer string, down bool) error {
+	port := tunnelPortForPeer(peer)
+	intf, ok := interfaceForName(port)
+	if !ok {
+		return nil
+	}
+	if (ovsStringField(intf, "admin_state") == "down") == down {
+		return nil
+	}
+	state := "up"
+	if down {
+		state = "down"
+	}
+	log.Infof("Bringing tunnel %s %s", port, state)
+	_, err := ofctl("mod-port", tunnelBridgeName, port, state)
+	return err
+}
@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withPinger(pinger func([]string, time.Duration) (map[string]time.Duration, error)) func() {
+	orig := pingPeers
+	pingPeers = pinger
+	return func() { pingPeers = orig }
+}
+
+func TestPeerReachability(t *testing.T) {
+	defer peerReachability.reset()
+
+	peerReachability.record("10.0.0.2", 2*time.Millisecond, true, 2)
+	r, changed := peerReachability.record("10.0.0.2", 4*time.Millisecond, true, 2)
+	if changed || !r.Reachable || r.Degraded || r.Latency != 4 || r.AvgLatency != 3 || r.Loss != 0 {
+		t.Fatalf("Peer should be reachable : %+v", r)
+	}
+	r, changed = peerReachability.record("10.0.0.2", 0, false, 2)
+	if changed || r.Reachable || r.Degraded || r.Failures != 1 || r.Loss*3 != 100 {
+		t.Fatalf("A single lost probe should not degrade the tunnel : %+v", r)
+	}
+	r, changed = peerReachability.record("10.0.0.2", 0, false, 2)
+	if !changed || !r.Degraded || r.Sent != 4 || r.Received != 2 || r.Loss != 50 {
+		t.Fatalf("The tunnel should be degraded : %+v", r)
+	}
+	r, changed = peerReachability.record("10.0.0.2", time.Millisecond, true, 2)
+	if !changed || r.Degraded || r.Failures != 0 {
+		t.Fatalf("The tunnel should have recovered : %+v", r)
+	}
+
+	for i := 0; i < reachabilityWindow; i++ {
+		r, _ = peerReachability.record("10.0.0.2", time.Millisecond, true, 2)
+	}
+	if r.Loss != 0 {
+		t.Fatalf("The loss should only account for the last probes : %+v", r)
+	}
+}
+
+func TestProbePeers(t *testing.T) {
+	defer func(orig Datastore) { datastore = orig }(datastore)
+	defer peerReachability.reset()
+	defer withPinger(func(peers []string, timeout time.Duration) (map[string]time.Duration, error) {
+		return map[string]time.Duration{"10.0.0.2": time.Millisecond}, nil
+	})()
+
+	peerReachability.record("10.0.0.9", 0, false, 1)
+	datastore = &membersDatastore{members: []string{"10.0.0.2", "10.0.0.3"}}
+	for i := 0; i < 3; i++ {
+		if err := probePeers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peers := peerReachability.list()
+	if len(peers) != 2 || peers[0].Address != "10.0.0.2" || peers[1].Address != "10.0.0.3" {
+		t.Fatalf("Only the members should be probed : %+v", peers)
+	}
+	if peers[0].Degraded || peers[0].Received != 3 {
+		t.Fatalf("10.0.0.2 should be reachable : %+v", peers[0])
+	}
+	if !peers[1].Degraded || peers[1].Sent != 3 || peers[1].Loss != 100 {
+		t.Fatalf("10.0.0.3 should be degraded : %+v", peers[1])
+	}
+	if status := getTunnelStatus("10.0.0.3"); !status.Degraded || status.Healthy {
+		t.Fatalf("The tunnel to 10.0.0.3 should be degraded : %+v", status)
+	}
+
+	// The peers are left alone when the probes cannot be sent
+	defer withPinger(func(peers []string, timeout time.Duration) (map[string]time.Duration, error) {
+		return nil, errors.New("socket: operation not permitted")
+	})()
+	if err := probePeers(); err == nil {
+		t.Fatal("Expected the probe to fail")
+	}
+	if r, _ := peerReachability.get("10.0.0.2"); r.Sent != 3 {
+		t.Fatalf("A failed probe should not be recorded : %+v", r)
+	}
+}
+
+func TestMonitoredPeers(t *testing.T) {
+	defer func(orig Datastore) { datastore = orig }(datastore)
+	defer clusterMembers.reset()
+	clusterMembers.update("10.0.0.2", MemberAlive)
+	clusterMembers.update("10.0.0.3", MemberLeft)
+
+	datastore = NewMemoryDatastore()
+	if peers, err := monitoredPeers(); err != nil || len(peers) != 1 || peers[0] != "10.0.0.2" {
+		t.Fatalf("The alive members should be probed without membership : %v. %v", peers, err)
+	}
+}
+
+func TestGetClusterReachabilityApi(t *testing.T) {
+	defer peerReachability.reset()
+	peerReachability.record("10.0.0.3", 0, false, 1)
+	peerReachability.record("10.0.0.2", time.Millisecond, true, 1)
+
+	daemon := NewDaemon()
+	request, _ := http.NewRequest("GET", "/v0.1/cluster/reachability", nil)
+	response := httptest.NewRecorder()
+
+	createRouter(daemon).ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %v:\n\tReceived: %v", "200", response.Code)
+	}
+	peers := []PeerReachability{}
+	if err := json.Unmarshal(response.Body.Bytes(), &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].Address != "10.0.0.2" || !peers[0].Reachable || !peers[1].Degraded {
+		t.Fatalf("Unexpected reachability %+v", peers)
+	}
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The cluster state is kept outside of the datastore data directory as the
+// latter is deleted when leaving the cluster and does not survive reboots.
+const clusterStateFile = "/var/lib/socketplane/cluster.json"
+
+// ClusterState records the runtime cluster bind and join requests so that
+// the daemon can restore its membership on restart
+type ClusterState struct {
+	BindInterface string                   `json:"bind_interface"`
+	Peers         []string                 `json:"peers"`
+	Tunnels       map[string]TunnelOptions `json:"tunnels,omitempty"`
+}
+
+func loadClusterState(path string) (*ClusterState, error) {
+	state := &ClusterState{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func saveClusterState(path string, state *ClusterState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func removeClusterState(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *ClusterState) addPeer(address string) {
+	for _, peer := range s.Peers {
+		if peer == address {
+			return
+		}
+	}
+	s.Peers = append(s.Peers, address)
+}
@@ -0,0 +1,233 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/socketplane/socketplane/config"
+)
+
+// Networks created without a subnet get one carved out of the supernets of
+// the subnet pool. The subnets carved out of a supernet are recorded so that
+// hosts allocating at the same time never pick the same subnet.
+// Key = supernet, Value = JSON list of the carved subnets
+
+const subnetPoolStore = "subnet_pool"
+
+var ErrNoSubnetAvailable = errors.New("No subnet available in the subnet pool")
+
+// SubnetConflictError is returned when the subnet of a new network overlaps
+// the subnet of another network of the cluster or a route of this host
+type SubnetConflictError struct {
+	Message       string `json:"error"`
+	Subnet        string `json:"subnet"`
+	Network       string `json:"network,omitempty"`
+	NetworkSubnet string `json:"network_subnet,omitempty"`
+	Route         string `json:"route,omitempty"`
+}
+
+func (e *SubnetConflictError) Error() string {
+	return e.Message
+}
+
+// CheckSubnetOverlaps checks that a subnet of the network id overlaps neither
+// the subnets of the other networks in the network store nor, unless
+// skipRoutes is set, the routes of this host. Networks created on two hosts at
+// the same time are not detected.
+func CheckSubnetOverlaps(id string, subnet *net.IPNet, skipRoutes bool) error {
+	networks, err := GetNetworks()
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		if network.ID == id {
+			continue
+		}
+		for _, cidr := range []string{network.Subnet, network.Subnet6} {
+			_, other, err := net.ParseCIDR(cidr)
+			if err != nil || (other.IP.To4() == nil) != (subnet.IP.To4() == nil) {
+				continue
+			}
+			if NetworkOverlaps(subnet, other) {
+				return &SubnetConflictError{
+					Message: fmt.Sprintf("Subnet %s overlaps the subnet %s of network %s",
+						subnet.String(), other.String(), network.ID),
+					Subnet:        subnet.String(),
+					Network:       network.ID,
+					NetworkSubnet: other.String(),
+				}
+			}
+		}
+	}
+	if skipRoutes {
+		return nil
+	}
+	family := netlink.FAMILY_V4
+	if subnet.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := routeDestinations(family)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if NetworkOverlaps(subnet, route) {
+			return &SubnetConflictError{
+				Message: fmt.Sprintf("Subnet %s overlaps the route to %s", subnet.String(), route.String()),
+				Subnet:  subnet.String(),
+				Route:   route.String(),
+			}
+		}
+	}
+	return nil
+}
+
+// allocateSubnet carves the first free IPv4 subnet of the given prefix length,
+// or of the configured size if 0, out of the subnet pool. The subnet does not
+// overlap any network of the cluster nor any route of this host.
+func allocateSubnet(prefixLength int) (*net.IPNet, error) {
+	if prefixLength == 0 {
+		prefixLength = config.Network.SubnetSize
+	}
+	if prefixLength < 1 || prefixLength > 30 {
+		return nil, fmt.Errorf("Invalid prefix length %d", prefixLength)
+	}
+	used, err := routeDestinations(netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		if _, subnet, err := net.ParseCIDR(network.Subnet); err == nil {
+			used = append(used, subnet)
+		}
+	}
+
+	for _, pool := range config.Network.SubnetPool {
+		_, supernet, err := net.ParseCIDR(pool)
+		if err != nil || supernet.IP.To4() == nil {
+			return nil, fmt.Errorf("Invalid subnet pool %s", pool)
+		}
+		var subnet *net.IPNet
+		err = retryIPAM(func() error {
+			carved, oldValue, err := getCarvedSubnets(supernet)
+			if err != nil {
+				return err
+			}
+			subnet = carveSubnet(supernet, prefixLength, append(carved, used...))
+			if subnet == nil {
+				return nil
+			}
+			return putCarvedSubnets(supernet, append(carved, subnet), oldValue)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if subnet != nil {
+			return subnet, nil
+		}
+	}
+	return nil, ErrNoSubnetAvailable
+}
+
+// releaseSubnet returns a subnet carved out of the subnet pool
+func releaseSubnet(subnet *net.IPNet) error {
+	for _, pool := range config.Network.SubnetPool {
+		_, supernet, err := net.ParseCIDR(pool)
+		if err != nil || !supernet.Contains(subnet.IP) {
+			continue
+		}
+		err = retryIPAM(func() error {
+			carved, oldValue, err := getCarvedSubnets(supernet)
+			if err != nil || oldValue == nil {
+				return err
+			}
+			remaining := make([]*net.IPNet, 0, len(carved))
+			for _, c := range carved {
+				if c.String() != subnet.String() {
+					remaining = append(remaining, c)
+				}
+			}
+			if len(remaining) == len(carved) {
+				return nil
+			}
+			return putCarvedSubnets(supernet, remaining, oldValue)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getCarvedSubnets(supernet *net.IPNet) ([]*net.IPNet, []byte, error) {
+	data, ok := datastore.Get(subnetPoolStore, supernet.String())
+	if !ok {
+		return nil, nil, nil
+	}
+	cidrs := []string{}
+	if err := json.Unmarshal(data, &cidrs); err != nil {
+		return nil, nil, err
+	}
+	carved := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, subnet, err := net.ParseCIDR(cidr); err == nil {
+			carved = append(carved, subnet)
+		}
+	}
+	return carved, data, nil
+}
+
+func putCarvedSubnets(supernet *net.IPNet, carved []*net.IPNet, oldValue []byte) error {
+	cidrs := make([]string, 0, len(carved))
+	for _, subnet := range carved {
+		cidrs = append(cidrs, subnet.String())
+	}
+	data, err := json.Marshal(cidrs)
+	if err != nil {
+		return err
+	}
+	return datastore.Put(subnetPoolStore, supernet.String(), data, oldValue)
+}
+
+// carveSubnet returns the first subnet of the given prefix length in the
+// supernet that does not overlap any of the used subnets, nil if there is none
+func carveSubnet(supernet *net.IPNet, prefixLength int, used []*net.IPNet) *net.IPNet {
+	ones, bits := supernet.Mask.Size()
+	if bits != 32 || prefixLength < ones || prefixLength > 32 {
+		return nil
+	}
+	size := uint64(1) << uint(32-prefixLength)
+	start := uint64(binary.BigEndian.Uint32(supernet.IP.To4()))
+	end := start + uint64(1)<<uint(32-ones)
+	for candidate := start; candidate+size <= end; {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(candidate))
+		subnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLength, 32)}
+		next := candidate + size
+		overlaps := false
+		for _, u := range used {
+			if u.IP.To4() == nil || !NetworkOverlaps(subnet, u) {
+				continue
+			}
+			overlaps = true
+			// Skip past the used subnet, which may be larger than the candidate
+			_, last := NetworkRange(u)
+			if after := (uint64(binary.BigEndian.Uint32(last.To4())) + size) / size * size; after > next {
+				next = after
+			}
+		}
+		if !overlaps {
+			return subnet
+		}
+		candidate = next
+	}
+	return nil
+}
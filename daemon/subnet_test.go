@@ -0,0 +1,157 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/socketplane/socketplane/config"
+)
+
+func withRouteDestinations(routes []string) func() {
+	orig := routeDestinations
+	routeDestinations = func(family int) ([]*net.IPNet, error) {
+		destinations := make([]*net.IPNet, 0, len(routes))
+		for _, route := range routes {
+			_, destination, _ := net.ParseCIDR(route)
+			destinations = append(destinations, destination)
+		}
+		return destinations, nil
+	}
+	return func() { routeDestinations = orig }
+}
+
+func withSubnetPool(pool []string, size int) func() {
+	orig := config.Network
+	config.Network = config.NetworkCfg{SubnetPool: pool, SubnetSize: size}
+	return func() { config.Network = orig }
+}
+
+func TestCarveSubnet(t *testing.T) {
+	_, supernet, _ := net.ParseCIDR("10.100.0.0/16")
+	tests := []struct {
+		prefixLength int
+		used         []string
+		expected     string
+	}{
+		{24, nil, "10.100.0.0/24"},
+		{24, []string{"10.100.0.0/24", "10.100.1.128/25"}, "10.100.2.0/24"},
+		{24, []string{"10.100.0.0/20"}, "10.100.16.0/24"},
+		{20, []string{"10.100.0.5/32"}, "10.100.16.0/20"},
+		{24, []string{"10.0.0.0/8"}, ""},
+		{8, nil, ""},
+	}
+	for _, test := range tests {
+		used := make([]*net.IPNet, 0, len(test.used))
+		for _, u := range test.used {
+			_, subnet, _ := net.ParseCIDR(u)
+			used = append(used, subnet)
+		}
+		subnet := carveSubnet(supernet, test.prefixLength, used)
+		if (subnet == nil && test.expected != "") || (subnet != nil && subnet.String() != test.expected) {
+			t.Fatalf("/%d with %v : expected %q, got %v", test.prefixLength, test.used, test.expected, subnet)
+		}
+	}
+}
+
+func TestAllocateSubnet(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations([]string{"10.100.0.0/24"})()
+	defer withSubnetPool([]string{"10.100.0.0/22", "10.200.0.0/24"}, 24)()
+
+	network := &Network{ID: "foo", Subnet: "10.100.1.0/24"}
+	data, _ := json.Marshal(network)
+	datastore.Put(networkStore, network.ID, data, nil)
+
+	expected := []string{"10.100.2.0/24", "10.100.3.0/24", "10.200.0.0/24"}
+	for _, e := range expected {
+		if subnet, err := AllocateSubnet(0); err != nil || subnet.String() != e {
+			t.Fatalf("expected %s, got %v %v", e, subnet, err)
+		}
+	}
+	if _, err := AllocateSubnet(0); err != ErrNoSubnetAvailable {
+		t.Fatal("exhausted pool should fail, got ", err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.100.3.0/24")
+	if err := ReleaseSubnet(subnet); err != nil {
+		t.Fatal(err)
+	}
+	if subnet, err := AllocateSubnet(0); err != nil || subnet.String() != "10.100.3.0/24" {
+		t.Fatalf("released subnet should be reused, got %v %v", subnet, err)
+	}
+	if _, err := AllocateSubnet(31); err == nil {
+		t.Fatal("/31 should not be allocated")
+	}
+}
+
+func TestAllocateSubnetConcurrent(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations(nil)()
+	defer withSubnetPool([]string{"10.100.0.0/16"}, 24)()
+
+	var wg sync.WaitGroup
+	subnets := make(chan string, 16)
+	for i := 0; i < cap(subnets); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subnet, err := AllocateSubnet(0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			subnets <- subnet.String()
+		}()
+	}
+	wg.Wait()
+	close(subnets)
+	seen := make(map[string]bool)
+	for subnet := range subnets {
+		if seen[subnet] {
+			t.Fatalf("%s allocated twice", subnet)
+		}
+		seen[subnet] = true
+	}
+}
+
+func TestCheckSubnetOverlaps(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer withRouteDestinations([]string{"192.168.0.0/24"})()
+	for _, network := range []*Network{
+		{ID: "web", Subnet: "10.2.0.0/16"},
+		{ID: "db", Subnet: "172.16.3.0/24", Subnet6: "fd00:3::/64"},
+	} {
+		data, _ := json.Marshal(network)
+		datastore.Put(networkStore, network.ID, data, nil)
+	}
+
+	tests := []struct {
+		id, subnet, network, route string
+	}{
+		{"foo", "10.2.1.0/24", "web", ""},
+		{"foo", "10.0.0.0/8", "web", ""},
+		{"foo", "fd00:3::/48", "db", ""},
+		{"foo", "192.168.0.128/25", "", "192.168.0.0/24"},
+		{"foo", "10.4.0.0/16", "", ""},
+		{"web", "10.2.0.0/16", "", ""},
+	}
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		err := CheckSubnetOverlaps(test.id, subnet, false)
+		if test.network == "" && test.route == "" {
+			if err != nil {
+				t.Fatalf("%s of %s should not conflict : %v", test.subnet, test.id, err)
+			}
+			continue
+		}
+		conflict, ok := err.(*SubnetConflictError)
+		if !ok || conflict.Network != test.network || conflict.Route != test.route {
+			t.Fatalf("%s : expected a conflict with %q %q, got %v", test.subnet, test.network, test.route, err)
+		}
+	}
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/16")
+	if err := CheckSubnetOverlaps("foo", subnet, true); err != nil {
+		t.Fatal("routes should be skipped : ", err)
+	}
+}
@@ -0,0 +1,343 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/libovsdb"
+	"github.com/socketplane/socketplane/config"
+)
+
+// The tunnels to the peers are named after their type and the address of the
+// peer, for example vxlan-10.0.0.2. Their encapsulation is configured for the
+// whole cluster and may be overridden for a peer when joining it.
+
+const (
+	TunnelVxlan  = "vxlan"
+	TunnelGre    = "gre"
+	TunnelGeneve = "geneve"
+)
+
+var tunnelTypes = []string{TunnelVxlan, TunnelGre, TunnelGeneve}
+
+// TunnelOptions is the encapsulation of a tunnel. DstPort and TTL are left to
+// OVS when 0, as is the DF bit of the outer header when DF is empty.
+type TunnelOptions struct {
+	Type    string `json:"type,omitempty"`
+	DstPort int    `json:"dst_port,omitempty"`
+	TTL     int    `json:"ttl,omitempty"`
+	DF      string `json:"df_default,omitempty"`
+}
+
+func (o TunnelOptions) empty() bool {
+	return o == TunnelOptions{}
+}
+
+func (o TunnelOptions) validate() error {
+	if o.Type != "" && tunnelPrefix(o.Type) == "" {
+		return errors.New("Invalid tunnel type " + o.Type)
+	}
+	if o.DstPort < 0 || o.DstPort > 65535 {
+		return fmt.Errorf("Invalid tunnel destination port %d", o.DstPort)
+	}
+	if o.DstPort != 0 && o.Type == TunnelGre {
+		return errors.New("GRE tunnels have no destination port")
+	}
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("Invalid tunnel TTL %d", o.TTL)
+	}
+	if o.DF != "" && o.DF != "true" && o.DF != "false" {
+		return errors.New("Invalid tunnel DF bit " + o.DF)
+	}
+	return nil
+}
+
+// merge returns the options with the fields set in override replaced. The
+// destination port is not carried over to another type of tunnel.
+func (o TunnelOptions) merge(override TunnelOptions) TunnelOptions {
+	if override.Type != "" && override.Type != o.Type {
+		o.Type = override.Type
+		o.DstPort = 0
+	}
+	if override.DstPort != 0 {
+		o.DstPort = override.DstPort
+	}
+	if override.TTL != 0 {
+		o.TTL = override.TTL
+	}
+	if override.DF != "" {
+		o.DF = override.DF
+	}
+	return o
+}
+
+// ovsOptions returns the options column of the interface of a tunnel
+func (o TunnelOptions) ovsOptions(peer string) map[string]string {
+	options := map[string]string{
+		"remote_ip": peer,
+		// The key of every frame is set by the flows of its network
+		"key": "flow",
+	}
+	if o.DstPort != 0 {
+		options["dst_port"] = strconv.Itoa(o.DstPort)
+	}
+	if o.TTL != 0 {
+		options["ttl"] = strconv.Itoa(o.TTL)
+	}
+	if o.DF != "" {
+		options["df_default"] = o.DF
+	}
+	return options
+}
+
+func defaultTunnelOptions() TunnelOptions {
+	options := TunnelOptions{
+		Type:    config.Tunnel.Type,
+		DstPort: config.Tunnel.DstPort,
+		TTL:     config.Tunnel.TTL,
+		DF:      config.Tunnel.DF,
+	}
+	if options.Type == "" {
+		options.Type = TunnelVxlan
+	}
+	return options
+}
+
+// tunnelPrefix returns the prefix of the names of the tunnels of a type
+func tunnelPrefix(tunnelType string) string {
+	for _, t := range tunnelTypes {
+		if t == tunnelType {
+			return t + "-"
+		}
+	}
+	return ""
+}
+
+func tunnelPortName(tunnelType string, peer string) string {
+	return tunnelPrefix(tunnelType) + peer
+}
+
+// tunnelPeer returns the peer of a tunnel port
+func tunnelPeer(port string) (string, bool) {
+	for _, t := range tunnelTypes {
+		if strings.HasPrefix(port, tunnelPrefix(t)) {
+			return strings.TrimPrefix(port, tunnelPrefix(t)), true
+		}
+	}
+	return "", false
+}
+
+// tunnelPorts returns the tunnel ports in the OVS cache mapped to their peer
+func tunnelPorts() map[string]string {
+	ports := make(map[string]string)
+	for _, row := range GetTableCache("Port") {
+		name, ok := row.Fields["name"].(string)
+		if !ok {
+			continue
+		}
+		if peer, ok := tunnelPeer(name); ok {
+			ports[name] = peer
+		}
+	}
+	return ports
+}
+
+// tunnelPortForPeer returns the tunnel port to a peer, or the name of the
+// tunnel it would be given if there is none
+func tunnelPortForPeer(peer string) string {
+	for port, p := range tunnelPorts() {
+		if p == peer {
+			return port
+		}
+	}
+	tunnel := peerTunnels.get(peer)
+	return tunnelPortName(tunnel.Type, peer)
+}
+
+// tunnelMatches reports whether the interface of a tunnel has the given type
+// and options
+func tunnelMatches(intf libovsdb.Row, tunnelType string, options map[string]string) bool {
+	if ovsStringField(intf, "type") != tunnelType {
+		return false
+	}
+	current := make(map[string]string)
+	if ovsMap, ok := intf.Fields["options"].(libovsdb.OvsMap); ok {
+		for key, value := range ovsMap.GoMap {
+			current[fmt.Sprint(key)] = fmt.Sprint(value)
+		}
+	}
+	return reflect.DeepEqual(current, options)
+}
+
+// peerTunnelList holds the tunnel options of the peers that were joined with
+// options of their own
+type peerTunnelList struct {
+	sync.Mutex
+	options map[string]TunnelOptions
+}
+
+var peerTunnels = &peerTunnelList{options: make(map[string]TunnelOptions)}
+
+// get returns the tunnel options of a peer
+func (p *peerTunnelList) get(peer string) TunnelOptions {
+	p.Lock()
+	defer p.Unlock()
+	return defaultTunnelOptions().merge(p.options[peer])
+}
+
+func (p *peerTunnelList) set(peer string, options TunnelOptions) {
+	p.Lock()
+	defer p.Unlock()
+	p.options[peer] = options
+}
+
+// list returns the options of the peers that have options of their own
+func (p *peerTunnelList) list() map[string]TunnelOptions {
+	p.Lock()
+	defer p.Unlock()
+	options := make(map[string]TunnelOptions, len(p.options))
+	for peer, o := range p.options {
+		options[peer] = o
+	}
+	return options
+}
+
+func (p *peerTunnelList) reset() {
+	p.Lock()
+	defer p.Unlock()
+	p.options = make(map[string]TunnelOptions)
+}
+
+// The tunnels are created and removed on membership events. Events missed
+// during a restart or an OVS reconnect are caught up by the reconciler, which
+// periodically compares the tunnels with the members of the cluster.
+
+const tunnelReconcileInterval = time.Minute
+
+// TunnelReconcileStats are the metrics of the tunnel reconciler. Added and
+// Removed count the tunnels changed since the daemon started.
+type TunnelReconcileStats struct {
+	Runs      int       `json:"runs"`
+	Added     int       `json:"added"`
+	Removed   int       `json:"removed"`
+	Errors    int       `json:"errors"`
+	LastRun   time.Time `json:"last_run"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type tunnelReconcileMetrics struct {
+	sync.Mutex
+	stats TunnelReconcileStats
+}
+
+var tunnelMetrics = &tunnelReconcileMetrics{}
+
+func (m *tunnelReconcileMetrics) record(added int, removed int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.stats.Runs++
+	m.stats.Added += added
+	m.stats.Removed += removed
+	m.stats.LastRun = time.Now()
+	m.stats.LastError = ""
+	if err != nil {
+		m.stats.Errors++
+		m.stats.LastError = err.Error()
+	}
+}
+
+func (m *tunnelReconcileMetrics) get() TunnelReconcileStats {
+	m.Lock()
+	defer m.Unlock()
+	return m.stats
+}
+
+func (m *tunnelReconcileMetrics) reset() {
+	m.Lock()
+	m.stats = TunnelReconcileStats{}
+	m.Unlock()
+}
+
+// tunnelUpToDate reports whether the only tunnel to a peer is the one with
+// the tunnel options of the peer
+func tunnelUpToDate(peer string, ports map[string]string) bool {
+	tunnel := peerTunnels.get(peer)
+	name := tunnelPortName(tunnel.Type, peer)
+	for port, p := range ports {
+		if p == peer && port != name {
+			return false
+		}
+	}
+	intf, ok := interfaceForName(name)
+	return ok && portUuidForName(name) != "" && tunnelMatches(intf, tunnel.Type, tunnel.ovsOptions(peer))
+}
+
+// reconcileTunnels removes the tunnels to the hosts that are not members of
+// the cluster and creates or updates the tunnels to the members. It returns
+// the peers whose tunnel was added or updated and the removed tunnel ports.
+func reconcileTunnels() ([]string, []string, error) {
+	members, err := datastore.Members()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ovs == nil {
+		return nil, nil, errors.New("OVS not connected")
+	}
+	wanted := make(map[string]bool)
+	for _, member := range members {
+		if member != clusterAddress {
+			wanted[member] = true
+		}
+	}
+
+	var failed error
+	added, removed := []string{}, []string{}
+	ports := tunnelPorts()
+	for port, peer := range ports {
+		if !wanted[peer] {
+			deletePort(ovs, tunnelBridgeName, port)
+			removed = append(removed, port)
+		}
+	}
+	for peer := range wanted {
+		if tunnelUpToDate(peer, ports) {
+			continue
+		}
+		if err := AddPeer(peer); err != nil {
+			log.Errorf("Unable to create the tunnel to %s. %v", peer, err)
+			failed = err
+			continue
+		}
+		added = append(added, peer)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, failed
+}
+
+// runTunnelReconcile runs the reconciler once, logging its activity and
+// recording its metrics
+func runTunnelReconcile() {
+	added, removed, err := reconcileTunnels()
+	if err == ErrMembershipUnavailable {
+		log.Debug("Cluster membership unavailable. Skipping tunnel reconciliation")
+		return
+	}
+	tunnelMetrics.record(len(added), len(removed), err)
+	if err != nil {
+		log.Errorf("Tunnel reconciliation failed. %v", err)
+	}
+	if len(added) > 0 {
+		log.Infof("Tunnel reconciliation created or updated the tunnels to %v", added)
+	}
+	if len(removed) > 0 {
+		log.Infof("Tunnel reconciliation removed the stale tunnels %v", removed)
+	}
+}
@@ -0,0 +1,161 @@
+package daemon
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/libovsdb"
+	"github.com/socketplane/socketplane/config"
+)
+
+func withTunnelConfig(tunnel config.TunnelCfg) func() {
+	orig := config.Tunnel
+	config.Tunnel = tunnel
+	return func() { config.Tunnel = orig }
+}
+
+func TestPeerTunnelOptions(t *testing.T) {
+	defer withTunnelConfig(config.TunnelCfg{Type: "vxlan", DstPort: 8472, DF: "false"})()
+	defer peerTunnels.reset()
+	peerTunnels.set("10.0.0.3", TunnelOptions{Type: TunnelGre, TTL: 32})
+	peerTunnels.set("10.0.0.4", TunnelOptions{DstPort: 4789})
+
+	tests := []struct {
+		peer     string
+		expected TunnelOptions
+	}{
+		{"10.0.0.2", TunnelOptions{Type: TunnelVxlan, DstPort: 8472, DF: "false"}},
+		{"10.0.0.3", TunnelOptions{Type: TunnelGre, TTL: 32, DF: "false"}},
+		{"10.0.0.4", TunnelOptions{Type: TunnelVxlan, DstPort: 4789, DF: "false"}},
+	}
+	for _, test := range tests {
+		if tunnel := peerTunnels.get(test.peer); tunnel != test.expected {
+			t.Fatalf("%s : expected %+v, got %+v", test.peer, test.expected, tunnel)
+		}
+	}
+
+	options := peerTunnels.get("10.0.0.3").ovsOptions("10.0.0.3")
+	expected := map[string]string{"remote_ip": "10.0.0.3", "key": "flow", "ttl": "32", "df_default": "false"}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("Expected options %v, got %v", expected, options)
+	}
+}
+
+func TestDefaultTunnelOptions(t *testing.T) {
+	defer withTunnelConfig(config.TunnelCfg{})()
+	if tunnel := defaultTunnelOptions(); tunnel.Type != TunnelVxlan {
+		t.Fatalf("Tunnels should default to vxlan, got %+v", tunnel)
+	}
+}
+
+func TestTunnelPorts(t *testing.T) {
+	defer withOvsCache(map[string]map[string]libovsdb.Row{
+		"Port": {
+			"p1": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.2"}},
+			"p2": {Fields: map[string]interface{}{"name": "gre-10.0.0.3"}},
+			"p3": {Fields: map[string]interface{}{"name": "geneve-10.0.0.4"}},
+			"p4": {Fields: map[string]interface{}{"name": "patch-int"}},
+		},
+	})()
+	expected := map[string]string{
+		"vxlan-10.0.0.2":  "10.0.0.2",
+		"gre-10.0.0.3":    "10.0.0.3",
+		"geneve-10.0.0.4": "10.0.0.4",
+	}
+	if ports := tunnelPorts(); !reflect.DeepEqual(ports, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ports)
+	}
+	if status := getTunnelStatus("10.0.0.3"); !status.Exists || status.Port != "gre-10.0.0.3" {
+		t.Fatalf("The gre tunnel should be reported : %+v", status)
+	}
+}
+
+func TestTunnelMatches(t *testing.T) {
+	options := TunnelOptions{Type: TunnelGeneve}.ovsOptions("10.0.0.2")
+	ovsOptions, _ := libovsdb.NewOvsMap(map[string]string{"remote_ip": "10.0.0.2", "key": "flow"})
+	intf := libovsdb.Row{Fields: map[string]interface{}{"type": "geneve", "options": *ovsOptions}}
+	if !tunnelMatches(intf, TunnelGeneve, options) {
+		t.Fatal("The tunnel should match")
+	}
+	if tunnelMatches(intf, TunnelVxlan, options) {
+		t.Fatal("A tunnel of another type should not match")
+	}
+	options["ttl"] = "64"
+	if tunnelMatches(intf, TunnelGeneve, options) {
+		t.Fatal("A tunnel with other options should not match")
+	}
+}
+
+// membersDatastore reports a fixed cluster membership
+type membersDatastore struct {
+	Datastore
+	members []string
+	err     error
+}
+
+func (m *membersDatastore) Members() ([]string, error) {
+	return m.members, m.err
+}
+
+func TestTunnelUpToDate(t *testing.T) {
+	defer withTunnelConfig(config.TunnelCfg{Type: "vxlan"})()
+	defer peerTunnels.reset()
+	upToDate, _ := libovsdb.NewOvsMap(map[string]string{"remote_ip": "10.0.0.2", "key": "flow"})
+	outdated, _ := libovsdb.NewOvsMap(map[string]string{"remote_ip": "10.0.0.3"})
+	defer withOvsCache(map[string]map[string]libovsdb.Row{
+		"Port": {
+			"p1": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.2"}},
+			"p2": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.3"}},
+			"p3": {Fields: map[string]interface{}{"name": "gre-10.0.0.2"}},
+		},
+		"Interface": {
+			"i1": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.2", "type": "vxlan", "options": *upToDate}},
+			"i2": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.3", "type": "vxlan", "options": *outdated}},
+		},
+	})()
+	ports := tunnelPorts()
+
+	if tunnelUpToDate("10.0.0.2", ports) {
+		t.Fatal("A second tunnel to 10.0.0.2 should be removed")
+	}
+	delete(ports, "gre-10.0.0.2")
+	if !tunnelUpToDate("10.0.0.2", ports) {
+		t.Fatal("The tunnel to 10.0.0.2 is up to date")
+	}
+	if tunnelUpToDate("10.0.0.3", ports) {
+		t.Fatal("The tunnel to 10.0.0.3 lacks the flow key")
+	}
+	if tunnelUpToDate("10.0.0.4", ports) {
+		t.Fatal("There is no tunnel to 10.0.0.4")
+	}
+	peerTunnels.set("10.0.0.2", TunnelOptions{TTL: 64})
+	if tunnelUpToDate("10.0.0.2", ports) {
+		t.Fatal("The tunnel to 10.0.0.2 should get the TTL of the peer")
+	}
+}
+
+func TestRunTunnelReconcile(t *testing.T) {
+	defer func(orig Datastore) { datastore = orig }(datastore)
+	defer tunnelMetrics.reset()
+	tunnelMetrics.reset()
+
+	datastore = NewMemoryDatastore()
+	runTunnelReconcile()
+	if stats := tunnelMetrics.get(); stats.Runs != 0 {
+		t.Fatalf("Reconciliation should be skipped without membership : %+v", stats)
+	}
+
+	datastore = &membersDatastore{err: errors.New("Datastore not started")}
+	runTunnelReconcile()
+	stats := tunnelMetrics.get()
+	if stats.Runs != 1 || stats.Errors != 1 || stats.LastError == "" || stats.LastRun.IsZero() {
+		t.Fatalf("The failed run should be recorded : %+v", stats)
+	}
+
+	tunnelMetrics.record(2, 1, nil)
+	stats = tunnelMetrics.get()
+	if stats.Runs != 2 || stats.Added != 2 || stats.Removed != 1 || stats.Errors != 1 || stats.LastError != "" {
+		t.Fatalf("Unexpected metrics %+v", stats)
+	}
+}
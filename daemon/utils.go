@@ -4,8 +4,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-
+	"math"
 	"net"
+	"time"
 
 	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/vishvananda/netlink"
@@ -18,19 +19,39 @@ var (
 )
 
 func CheckRouteOverlaps(toCheck *net.IPNet) error {
-	networks, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	family := netlink.FAMILY_V4
+	if toCheck.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	networks, err := routeDestinations(family)
 	if err != nil {
 		return err
 	}
 
 	for _, network := range networks {
-		if network.Dst != nil && NetworkOverlaps(toCheck, network.Dst) {
+		if NetworkOverlaps(toCheck, network) {
 			return ErrNetworkOverlaps
 		}
 	}
 	return nil
 }
 
+// routeDestinations returns the destinations of the host routes of a family,
+// the default route excepted
+var routeDestinations = func(family int) ([]*net.IPNet, error) {
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil, err
+	}
+	destinations := make([]*net.IPNet, 0, len(routes))
+	for _, route := range routes {
+		if route.Dst != nil {
+			destinations = append(destinations, route.Dst)
+		}
+	}
+	return destinations, nil
+}
+
 // Detects overlap between one IPNet and another
 func NetworkOverlaps(netX *net.IPNet, netY *net.IPNet) bool {
 	if firstIP, _ := NetworkRange(netX); netY.Contains(firstIP) {
@@ -44,11 +65,12 @@ func NetworkOverlaps(netX *net.IPNet, netY *net.IPNet) bool {
 
 // Calculates the first and last IP addresses in an IPNet
 func NetworkRange(network *net.IPNet) (net.IP, net.IP) {
-	var (
-		netIP   = network.IP.To4()
-		firstIP = netIP.Mask(network.Mask)
-		lastIP  = net.IPv4(0, 0, 0, 0).To4()
-	)
+	netIP := network.IP.To4()
+	if netIP == nil || len(network.Mask) == net.IPv6len {
+		netIP = network.IP.To16()
+	}
+	firstIP := netIP.Mask(network.Mask)
+	lastIP := make(net.IP, len(netIP))
 
 	for i := 0; i < len(lastIP); i++ {
 		lastIP[i] = netIP[i] | ^network.Mask[i]
@@ -56,8 +78,16 @@ func NetworkRange(network *net.IPNet) (net.IP, net.IP) {
 	return firstIP, lastIP
 }
 
-// Given a netmask, calculates the number of available hosts
+// Given a netmask, calculates the number of available hosts. IPv6 sizes are
+// capped to the largest int32.
 func NetworkSize(mask net.IPMask) int32 {
+	if len(mask) == net.IPv6len {
+		ones, bits := mask.Size()
+		if bits-ones >= 31 {
+			return math.MaxInt32
+		}
+		return int32(1) << uint(bits-ones)
+	}
 	m := net.IPv4Mask(0, 0, 0, 0)
 	for i := 0; i < net.IPv4len; i++ {
 		m[i] = ^mask[i]
@@ -67,25 +97,42 @@ func NetworkSize(mask net.IPMask) int32 {
 
 // Return the IPv4 address of a network interface
 func GetIfaceAddr(name string) (*net.IPNet, error) {
+	return getIfaceAddr(name, netlink.FAMILY_V4)
+}
+
+// Return the global IPv6 address of a network interface
+func GetIfaceAddr6(name string) (*net.IPNet, error) {
+	return getIfaceAddr(name, netlink.FAMILY_V6)
+}
+
+func getIfaceAddr(name string, family int) (*net.IPNet, error) {
 	iface, err := netlink.LinkByName(name)
 	if err != nil {
 		return nil, err
 	}
 
-	addrs, err := netlink.AddrList(iface, netlink.FAMILY_V4)
+	addrs, err := netlink.AddrList(iface, family)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(addrs) == 0 {
+	ipNets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		// The link-local addresses are configured by the kernel
+		if !addr.IP.IsLinkLocalUnicast() {
+			ipNets = append(ipNets, addr.IPNet)
+		}
+	}
+
+	if len(ipNets) == 0 {
 		return nil, fmt.Errorf("Interface %v has no IP addresses", name)
 	}
 
-	if len(addrs) > 1 {
-		log.Info("Interface %v has more than 1 IPv4 address. Defaulting to using %v\n", name, addrs[0].IP)
+	if len(ipNets) > 1 {
+		log.Infof("Interface %v has more than 1 address. Defaulting to using %v", name, ipNets[0].IP)
 	}
 
-	return addrs[0].IPNet, nil
+	return ipNets[0], nil
 }
 
 func GetDefaultRouteIface() (int, error) {
@@ -100,6 +147,28 @@ func GetDefaultRouteIface() (int, error) {
 	return -1, ErrNoDefaultRoute
 }
 
+// linkTimeout bounds the wait for the interface of a new OVS port, which the
+// kernel creates after ovsdb commits the port
+var linkTimeout = 5 * time.Second
+
+const linkPollInterval = 50 * time.Millisecond
+
+// waitForLink waits until netlink sees an interface, so that the subsequent
+// calls find it
+func waitForLink(name string) error {
+	deadline := time.Now().Add(linkTimeout)
+	for {
+		_, err := netlink.LinkByName(name)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Interface %s not found. %v", name, err)
+		}
+		time.Sleep(linkPollInterval)
+	}
+}
+
 func InterfaceUp(name string) error {
 	iface, err := netlink.LinkByName(name)
 	if err != nil {
@@ -150,7 +219,11 @@ func SetDefaultGateway(ip, ifaceName string) error {
 		return errors.New("Invalid gateway address")
 	}
 
-	_, dst, err := net.ParseCIDR("0.0.0.0/0")
+	defaultDst := "0.0.0.0/0"
+	if gw.To4() == nil {
+		defaultDst = "::/0"
+	}
+	_, dst, err := net.ParseCIDR(defaultDst)
 	if err != nil {
 		return err
 	}
@@ -2,9 +2,11 @@ package daemon
 
 import (
 	"bytes"
+	"math"
 	"net"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/vishvananda/netlink"
 	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/vishvananda/netns"
@@ -121,6 +123,17 @@ func TestInterfaceUpDown(t *testing.T) {
 	}
 }
 
+func TestWaitForLink(t *testing.T) {
+	defer func(timeout time.Duration) { linkTimeout = timeout }(linkTimeout)
+	linkTimeout = 100 * time.Millisecond
+	if err := waitForLink("lo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForLink("sp-missing"); err == nil {
+		t.Fatal("A missing interface should time out")
+	}
+}
+
 func TestChangeInterfaceName(t *testing.T) {
 	teardown := setUp(t)
 	defer teardown()
@@ -308,3 +321,28 @@ func TestGetIfaceForRoute(t *testing.T) {
 		t.Fatal("return value not testIface")
 	}
 }
+
+func TestNetworkRangeIPv6(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("fd00:1::/64")
+	first, last := NetworkRange(netA)
+	if !first.Equal(net.ParseIP("fd00:1::")) {
+		t.Fatalf("got: %v, expected fd00:1::", first)
+	}
+	if !last.Equal(net.ParseIP("fd00:1::ffff:ffff:ffff:ffff")) {
+		t.Fatalf("got: %v, expected fd00:1::ffff:ffff:ffff:ffff", last)
+	}
+
+	_, netB, _ := net.ParseCIDR("fd00:1::8000:0/96")
+	if !NetworkOverlaps(netA, netB) {
+		t.Fatal("netA and netB overlap")
+	}
+}
+
+func TestNetworkSizeIPv6(t *testing.T) {
+	if size := NetworkSize(net.CIDRMask(120, 128)); size != 256 {
+		t.Fatalf("got %v, expected 256", size)
+	}
+	if size := NetworkSize(net.CIDRMask(64, 128)); size != math.MaxInt32 {
+		t.Fatalf("got %v, expected the size to be capped", size)
+	}
+}
@@ -0,0 +1,508 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// Every network is a VXLAN segment of its own. The VNI of a network is
+// allocated cluster-wide out of the 24 bit VNI space. The VLAN tags that keep
+// the networks apart on docker0-ovs are local to each host and only allocated
+// for the networks that have a port on the host.
+//
+// The tunnels live on docker0-tun, which is patched to docker0-ovs. Frames
+// that leave docker0-ovs with the local tag of a network are untagged, given
+// the VNI of the network and looked up in the MAC table of docker0-tun. Frames
+// that arrive with that VNI teach the table the tunnel of their source MAC,
+// and are tagged with the local tag and sent to docker0-ovs. Known unicast
+// destinations are sent to their tunnel, while broadcast, multicast and
+// unknown unicast frames are flooded to every tunnel. Frames with an unknown
+// VNI are dropped.
+//
+// Earlier versions send the frames of every network tagged with its VLAN over
+// keyless tunnels, i.e. with VNI 0. Upgraded hosts register in the vni_host
+// store, and the networks of earlier versions are only migrated to the VNI of
+// their VLAN once every member of the cluster has registered. Until then they
+// are carried the way earlier versions do, so that the cluster can be upgraded
+// one host at a time.
+//
+// The local tag of a network is the tag of its ports on docker0-ovs, which
+// carry the network in their external_ids, so that the tags live and die with
+// the bridge of the host. Tags allocated since the daemon started are kept in
+// memory as well, since a network may have no port yet.
+//
+// vni: Key = "vni", Value = ipam6Block of the allocated VNIs
+// vni_host: Key = address of an upgraded host
+
+const vniStore = "vni"
+const vniHostStore = "vni_host"
+const vniCount = 1 << 24
+
+const tunnelBridgeName = "docker0-tun"
+
+// The MACs learned from the tunnels are kept per VNI in the MAC table of
+// docker0-tun, and forgotten after macAgingTime seconds
+const (
+	tunnelMacTable = 10
+	macAgingTime   = 300
+)
+
+// The flows of a network have the local tag of the network as cookie, with a
+// prefix per kind of flows, so that deleting the flows of one kind never
+// deletes the others
+const (
+	gatewayCookie = 1 << 32
+	tunnelCookie  = 2 << 32
+)
+
+// flowCookie returns the cookie of the flows of a kind for a local tag
+func flowCookie(prefix uint64, tag uint) uint64 {
+	return prefix | uint64(tag)
+}
+
+// docker0-ovs is patched to docker0-tun through patch-tun and patch-int.
+// patch-int has a fixed OpenFlow port number so that the flows can match it.
+const (
+	patchTunPort = "patch-tun"
+	patchIntPort = "patch-int"
+	patchOfport  = 1
+)
+
+var ErrVniUnavailable = errors.New("VNI unavailable")
+var ErrVlanUnavailable = errors.New("Vlan unavailable")
+
+// networkVni returns the VNI of a network. Networks created before VNIs were
+// allocated use their VLAN, which is unique in the cluster as well.
+func networkVni(network *Network) uint {
+	if network.VNI != 0 {
+		return network.VNI
+	}
+	return network.Vlan
+}
+
+func getVniBlock() (*ipam6Block, []byte, error) {
+	block := &ipam6Block{}
+	data, ok := datastore.Get(vniStore, vniStore)
+	if !ok {
+		return block, nil, nil
+	}
+	if err := json.Unmarshal(data, block); err != nil {
+		return nil, nil, err
+	}
+	return block, data, nil
+}
+
+func putVniBlock(block *ipam6Block, oldValue []byte) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return datastore.Put(vniStore, vniStore, data, oldValue)
+}
+
+// allocateVni allocates the VNI of a new network. VNIs are handed out in turn
+// so that the VNI of a deleted network is not reused right away. The VLANs of
+// the networks that have not been migrated yet are skipped.
+func allocateVni() (uint, error) {
+	networks, err := GetNetworks()
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[uint64]bool)
+	for i := range networks {
+		used[uint64(networkVni(&networks[i]))] = true
+	}
+	var vni uint64
+	err = retryIPAM(func() error {
+		vni = 0
+		block, oldValue, err := getVniBlock()
+		if err != nil {
+			return err
+		}
+		candidate := block.Next
+		if candidate < 1 || candidate >= vniCount {
+			candidate = 1
+		}
+		for i := 1; i < vniCount; i++ {
+			if !used[candidate] && block.add(candidate) {
+				vni = candidate
+				break
+			}
+			candidate = candidate%(vniCount-1) + 1
+		}
+		if vni == 0 {
+			return nil
+		}
+		block.Next = vni + 1
+		return putVniBlock(block, oldValue)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if vni == 0 {
+		return 0, ErrVniUnavailable
+	}
+	return uint(vni), nil
+}
+
+// reserveVni marks a VNI as allocated. Reserving an allocated VNI is a no-op.
+func reserveVni(vni uint) error {
+	return retryIPAM(func() error {
+		block, oldValue, err := getVniBlock()
+		if err != nil {
+			return err
+		}
+		if !block.add(uint64(vni)) {
+			return nil
+		}
+		return putVniBlock(block, oldValue)
+	})
+}
+
+func releaseVni(vni uint) error {
+	return retryIPAM(func() error {
+		block, oldValue, err := getVniBlock()
+		if err != nil {
+			return err
+		}
+		if !block.remove(uint64(vni)) {
+			return nil
+		}
+		return putVniBlock(block, oldValue)
+	})
+}
+
+// registerVniHost records that this host carries the networks on their VNIs
+func registerVniHost() error {
+	if clusterAddress == "" {
+		return nil
+	}
+	if _, ok := datastore.Get(vniHostStore, clusterAddress); ok {
+		return nil
+	}
+	err := datastore.Put(vniHostStore, clusterAddress, []byte(clusterAddress), nil)
+	if err == ErrDatastoreOutdated {
+		return nil
+	}
+	return err
+}
+
+// legacyMembers returns the members of the cluster that run an earlier
+// version, as they have not registered in the vni_host store
+func legacyMembers() ([]string, error) {
+	members, err := datastore.Members()
+	if err == ErrMembershipUnavailable {
+		members, err = clusterMembers.alive(clusterAddress), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	legacy := []string{}
+	for _, member := range members {
+		if _, ok := datastore.Get(vniHostStore, member); !ok {
+			legacy = append(legacy, member)
+		}
+	}
+	sort.Strings(legacy)
+	return legacy, nil
+}
+
+// migrateNetworkVnis registers this host and gives the networks created
+// before VNIs were allocated the VNI of their VLAN, once every member of the
+// cluster has registered. Hosts that migrate at the same time agree since the
+// VNI only depends on the VLAN.
+func migrateNetworkVnis() error {
+	if err := registerVniHost(); err != nil {
+		return err
+	}
+	legacy, err := legacyMembers()
+	if err != nil {
+		return err
+	}
+	if len(legacy) > 0 {
+		log.Infof("Networks not migrated to VNIs until %v are upgraded", legacy)
+		return nil
+	}
+	networks, err := GetNetworks()
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		if network.VNI != 0 || network.Vlan == 0 {
+			continue
+		}
+		if err := reserveVni(network.Vlan); err != nil {
+			return err
+		}
+		id := network.ID
+		err := retryIPAM(func() error {
+			oldValue, ok := datastore.Get(networkStore, id)
+			if !ok {
+				return nil
+			}
+			current := &Network{}
+			if err := json.Unmarshal(oldValue, current); err != nil {
+				return err
+			}
+			if current.VNI != 0 || current.Vlan == 0 {
+				return nil
+			}
+			current.VNI = current.Vlan
+			data, err := json.Marshal(current)
+			if err != nil {
+				return err
+			}
+			return datastore.Put(networkStore, id, data, oldValue)
+		})
+		if err != nil {
+			return err
+		}
+		log.Infof("Network %s migrated to VNI %d", id, network.Vlan)
+	}
+	return nil
+}
+
+// localVlanList holds the local tags allocated by this daemon
+type localVlanList struct {
+	sync.Mutex
+	tags map[string]uint
+}
+
+var localVlans = &localVlanList{tags: make(map[string]uint)}
+
+// portVlans returns the local tags of the networks that have a port on this
+// host, along with every tag in use, including the ones of the ports that
+// predate the external_ids
+func portVlans() (map[string]uint, map[uint]bool) {
+	tags := make(map[string]uint)
+	for _, key := range []string{NETWORK_KEY, SEGMENT_KEY} {
+		for port, network := range portsWithExternalId(key) {
+			if tag := portTag(port); tag != 0 {
+				tags[network] = tag
+			}
+		}
+	}
+	used := make(map[uint]bool)
+	for _, row := range GetTableCache("Port") {
+		if tag, ok := ovsIntField(row, "tag"); ok {
+			used[tag] = true
+		}
+	}
+	return tags, used
+}
+
+// getLocalVlans returns the local tags of the networks
+func getLocalVlans() map[string]uint {
+	localVlans.Lock()
+	defer localVlans.Unlock()
+	return localVlans.get()
+}
+
+func (l *localVlanList) get() map[string]uint {
+	tags, _ := portVlans()
+	for id, tag := range l.tags {
+		tags[id] = tag
+	}
+	return tags
+}
+
+// localVlan returns the local tag of a network, allocating it if needed, and
+// whether it was allocated. Networks created before VNIs were allocated keep
+// their VLAN, which is the tag of their existing ports, and no other network
+// is given such a VLAN.
+func localVlan(network *Network) (uint, bool, error) {
+	networks, err := GetNetworks()
+	if err != nil {
+		return 0, false, err
+	}
+	localVlans.Lock()
+	defer localVlans.Unlock()
+	tags := localVlans.get()
+	if tag, ok := tags[network.ID]; ok {
+		localVlans.tags[network.ID] = tag
+		return tag, false, nil
+	}
+	// The ports that predate the external_ids and have the VLAN of the
+	// network are its own
+	_, used := portVlans()
+	claimed := make(map[uint]bool)
+	for _, t := range tags {
+		claimed[t] = true
+	}
+	for _, n := range networks {
+		if n.ID != network.ID && n.Vlan != 0 {
+			claimed[n.Vlan] = true
+		}
+	}
+	for t := range claimed {
+		used[t] = true
+	}
+	var tag uint
+	if network.Vlan != 0 && network.Vlan < vlanCount-1 && !claimed[network.Vlan] {
+		tag = network.Vlan
+	}
+	for t := uint(1); tag == 0 && t < vlanCount-1; t++ {
+		if !used[t] {
+			tag = t
+		}
+	}
+	if tag == 0 {
+		return 0, false, ErrVlanUnavailable
+	}
+	localVlans.tags[network.ID] = tag
+	return tag, true, nil
+}
+
+// releaseLocalVlan forgets the local tag of a network, 0 if it had none
+func releaseLocalVlan(id string) uint {
+	localVlans.Lock()
+	defer localVlans.Unlock()
+	tag := localVlans.get()[id]
+	delete(localVlans.tags, id)
+	return tag
+}
+
+// realizeSegment makes sure that a network has a local tag and that its
+// frames are carried over the tunnels with its VNI. It returns the local tag.
+func realizeSegment(network *Network) (uint, error) {
+	tag, allocated, err := localVlan(network)
+	if err != nil {
+		return 0, err
+	}
+	// The flows of a tag or a segment that this daemon forgot may be left over
+	if allocated {
+		if err := deleteTunnelFlows(tag); err != nil {
+			return 0, err
+		}
+		if _, err := ofctl("del-flows", tunnelBridgeName, segmentMatch(network)); err != nil {
+			return 0, err
+		}
+	}
+	return tag, addTunnelFlows(tag, network)
+}
+
+// legacySegment reports whether a network is carried the way earlier
+// versions do, as it has not been migrated to a VNI yet
+func legacySegment(network *Network) bool {
+	return network.VNI == 0 && network.Vlan != 0
+}
+
+// segmentMatch matches the frames of a network on the tunnels
+func segmentMatch(network *Network) string {
+	if legacySegment(network) {
+		return fmt.Sprintf("tun_id=0,dl_vlan=%d", network.Vlan)
+	}
+	return fmt.Sprintf("tun_id=%d", network.VNI)
+}
+
+// unrealizeSegment removes the tunnel flows and the local tag of a network
+func unrealizeSegment(id string) error {
+	tag := releaseLocalVlan(id)
+	if tag == 0 {
+		return nil
+	}
+	return deleteTunnelFlows(tag)
+}
+
+// createTunnelBridge creates the bridge of the tunnels and patches it to
+// docker0-ovs. The tunnels that earlier versions created on docker0-ovs are
+// moved over.
+func createTunnelBridge() error {
+	exists, err := portExists(ovs, tunnelBridgeName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := createOVSBridge(ovs, tunnelBridgeName, false); err != nil {
+			return err
+		}
+	}
+	if portUuidForName(patchTunPort) == "" {
+		if err := addPatchPort(ovs, OvsBridge.Name, patchTunPort, patchIntPort, 0); err != nil {
+			return err
+		}
+	}
+	if portUuidForName(patchIntPort) == "" {
+		if err := addPatchPort(ovs, tunnelBridgeName, patchIntPort, patchTunPort, patchOfport); err != nil {
+			return err
+		}
+	}
+	for _, port := range bridgePorts(OvsBridge.Name) {
+		peer, ok := tunnelPeer(port)
+		if !ok {
+			continue
+		}
+		log.Infof("Moving tunnel %s to %s", port, tunnelBridgeName)
+		deletePort(ovs, OvsBridge.Name, port)
+		tunnel := peerTunnels.get(peer)
+		name := tunnelPortName(tunnel.Type, peer)
+		if err := addTunnelPort(ovs, tunnelBridgeName, name, tunnel.Type, tunnel.ovsOptions(peer)); err != nil {
+			return err
+		}
+	}
+	// Only the flows of the networks forward frames, and never from a tunnel
+	// to another one
+	if _, err := ofctl("add-flow", tunnelBridgeName, "priority=0,actions=drop"); err != nil {
+		return err
+	}
+	_, err = ofctl("mod-port", tunnelBridgeName, tunnelBridgeName, "no-flood")
+	return err
+}
+
+// tunnelFlows returns the flows that map the local tag of a network to its
+// VNI on docker0-tun. The learned flows have the cookie of the tag as well.
+func tunnelFlows(tag uint, vni uint) []string {
+	cookie := fmt.Sprintf("cookie=%#x,priority=100", flowCookie(tunnelCookie, tag))
+	learn := fmt.Sprintf("learn(table=%d,cookie=%#x,hard_timeout=%d,priority=100,"+
+		"NXM_NX_TUN_ID[],NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[],output:NXM_OF_IN_PORT[])", tunnelMacTable, flowCookie(tunnelCookie, tag), macAgingTime)
+	return []string{
+		fmt.Sprintf("%s,in_port=%d,dl_vlan=%d,actions=strip_vlan,set_tunnel:%d,resubmit(,%d)", cookie, patchOfport, tag, vni, tunnelMacTable),
+		fmt.Sprintf("%s,tun_id=%d,actions=%s,mod_vlan_vid:%d,output:%d", cookie, vni, learn, tag, patchOfport),
+		fmt.Sprintf("table=%d,cookie=%#x,priority=50,tun_id=%d,actions=FLOOD", tunnelMacTable, flowCookie(tunnelCookie, tag), vni),
+	}
+}
+
+// legacyTunnelFlows returns the flows that carry a network that has not been
+// migrated yet with its cluster-wide VLAN on VNI 0, as earlier versions do.
+// The MACs are learned per VLAN.
+func legacyTunnelFlows(tag uint, vlan uint) []string {
+	cookie := fmt.Sprintf("cookie=%#x,priority=100", flowCookie(tunnelCookie, tag))
+	learn := fmt.Sprintf("learn(table=%d,cookie=%#x,hard_timeout=%d,priority=100,"+
+		"NXM_NX_TUN_ID[],NXM_OF_VLAN_TCI[0..11],NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[],output:NXM_OF_IN_PORT[])", tunnelMacTable, flowCookie(tunnelCookie, tag), macAgingTime)
+	return []string{
+		fmt.Sprintf("%s,in_port=%d,dl_vlan=%d,actions=mod_vlan_vid:%d,set_tunnel:0,resubmit(,%d)", cookie, patchOfport, tag, vlan, tunnelMacTable),
+		fmt.Sprintf("%s,tun_id=0,dl_vlan=%d,actions=%s,mod_vlan_vid:%d,output:%d", cookie, vlan, learn, tag, patchOfport),
+		fmt.Sprintf("table=%d,cookie=%#x,priority=50,tun_id=0,dl_vlan=%d,actions=FLOOD", tunnelMacTable, flowCookie(tunnelCookie, tag), vlan),
+	}
+}
+
+// addTunnelFlows maps the local tag of a network to its segment on
+// docker0-tun. The flows of a network that was carried on VNI 0 before its
+// migration are removed.
+func addTunnelFlows(tag uint, network *Network) error {
+	flows := tunnelFlows(tag, network.VNI)
+	if legacySegment(network) {
+		flows = legacyTunnelFlows(tag, network.Vlan)
+	} else if network.Vlan != 0 {
+		legacy := &Network{Vlan: network.Vlan}
+		if _, err := ofctl("del-flows", tunnelBridgeName, segmentMatch(legacy)); err != nil {
+			return err
+		}
+	}
+	for _, flow := range flows {
+		if _, err := ofctl("add-flow", tunnelBridgeName, flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteTunnelFlows(tag uint) error {
+	_, err := ofctl("del-flows", tunnelBridgeName, fmt.Sprintf("cookie=%#x/-1", flowCookie(tunnelCookie, tag)))
+	return err
+}
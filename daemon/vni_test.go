@@ -0,0 +1,212 @@
+package daemon
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/socketplane/socketplane/Godeps/_workspace/src/github.com/socketplane/libovsdb"
+)
+
+func putNetwork(t *testing.T, network *Network) {
+	data, _ := json.Marshal(network)
+	if err := datastore.Put(networkStore, network.ID, data, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateVni(t *testing.T) {
+	defer useMemoryDatastore()()
+	// A network that has not been migrated yet still uses its VLAN as VNI
+	putNetwork(t, &Network{ID: "legacy", Vlan: 2})
+
+	for _, expected := range []uint{1, 3, 4} {
+		vni, err := allocateVni()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vni != expected {
+			t.Fatalf("Expected VNI %d, got %d", expected, vni)
+		}
+	}
+	if err := releaseVni(1); err != nil {
+		t.Fatal(err)
+	}
+	if vni, _ := allocateVni(); vni != 5 {
+		t.Fatalf("Released VNI should not be reused right away, got %d", vni)
+	}
+
+	block, oldValue, _ := getVniBlock()
+	block.Next = vniCount - 1
+	if err := putVniBlock(block, oldValue); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []uint{vniCount - 1, 1} {
+		if vni, _ := allocateVni(); vni != expected {
+			t.Fatalf("Expected VNI %d, got %d", expected, vni)
+		}
+	}
+}
+
+func TestMigrateNetworkVnis(t *testing.T) {
+	defer useMemoryDatastore()()
+	orig := clusterAddress
+	clusterAddress = "10.0.0.1"
+	defer func() { clusterAddress = orig }()
+	clusterMembers.update("10.0.0.2", MemberAlive)
+	defer clusterMembers.reset()
+	putNetwork(t, &Network{ID: "legacy", Vlan: 7})
+	putNetwork(t, &Network{ID: "migrated", VNI: 8})
+
+	// 10.0.0.2 runs an earlier version
+	if err := migrateNetworkVnis(); err != nil {
+		t.Fatal(err)
+	}
+	if network, _ := GetNetwork("legacy"); network.VNI != 0 {
+		t.Fatalf("Network should not be migrated before every host is upgraded : %+v", network)
+	}
+	if _, ok := datastore.Get(vniHostStore, "10.0.0.1"); !ok {
+		t.Fatal("The host should be registered")
+	}
+	datastore.Put(vniHostStore, "10.0.0.2", []byte("10.0.0.2"), nil)
+
+	for i := 0; i < 2; i++ {
+		if err := migrateNetworkVnis(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	network, _ := GetNetwork("legacy")
+	if network.VNI != 7 || network.Vlan != 7 {
+		t.Fatalf("Network should be migrated to VNI 7 : %+v", network)
+	}
+	block, _, _ := getVniBlock()
+	if !reflect.DeepEqual(block.Allocated, []uint64{7}) {
+		t.Fatalf("The VNI of the legacy network should be reserved : %v", block.Allocated)
+	}
+	if vni, _ := allocateVni(); vni == 7 || vni == 8 {
+		t.Fatalf("VNI %d is already used", vni)
+	}
+}
+
+func TestLocalVlan(t *testing.T) {
+	defer useMemoryDatastore()()
+	defer func(tags map[string]uint) { localVlans.tags = tags }(localVlans.tags)
+	localVlans.tags = make(map[string]uint)
+	ids := func(key string, network string) libovsdb.OvsMap {
+		return libovsdb.OvsMap{GoMap: map[interface{}]interface{}{key: network}}
+	}
+	// The gateway port of other, a port of app and the ports that predate the
+	// external_ids
+	defer withOvsCache(map[string]map[string]libovsdb.Row{
+		"Port": {
+			"p1": {Fields: map[string]interface{}{"name": "other", "tag": float64(3), "external_ids": ids(NETWORK_KEY, "other")}},
+			"p2": {Fields: map[string]interface{}{"name": "ovs0000001", "tag": float64(5), "external_ids": ids(SEGMENT_KEY, "app")}},
+			"p3": {Fields: map[string]interface{}{"name": "ovs0000002", "tag": float64(1)}},
+			"p4": {Fields: map[string]interface{}{"name": "ovs0000003", "tag": float64(2)}},
+		},
+	})()
+	legacy := &Network{ID: "legacy", Vlan: 1, VNI: 1}
+	other := &Network{ID: "other", Vlan: 3, VNI: 3}
+	web := &Network{ID: "web", VNI: 10}
+	db := &Network{ID: "db", VNI: 11}
+	app := &Network{ID: "app", VNI: 12}
+	for _, network := range []*Network{legacy, other, web, db, app} {
+		putNetwork(t, network)
+	}
+
+	tests := []struct {
+		network   *Network
+		expected  uint
+		allocated bool
+	}{
+		{web, 4, true},
+		{legacy, 1, true},
+		{web, 4, false},
+		{app, 5, false},
+		{other, 3, false},
+		{db, 6, true},
+	}
+	for _, test := range tests {
+		tag, allocated, err := localVlan(test.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag != test.expected || allocated != test.allocated {
+			t.Fatalf("Expected tag %d (allocated %v) for %s, got %d (%v)", test.expected, test.allocated, test.network.ID, tag, allocated)
+		}
+	}
+
+	if tag := releaseLocalVlan("web"); tag != 4 {
+		t.Fatalf("Expected tag 4 to be released, got %d", tag)
+	}
+	if tag := releaseLocalVlan("web"); tag != 0 {
+		t.Fatalf("Tag of web should already be released, got %d", tag)
+	}
+	// The tags of the ports remain
+	releaseLocalVlan("app")
+	if tags := getLocalVlans(); !reflect.DeepEqual(tags, map[string]uint{"legacy": 1, "other": 3, "app": 5, "db": 6}) {
+		t.Fatalf("Unexpected local tags %v", tags)
+	}
+}
+
+func TestTunnelFlows(t *testing.T) {
+	expected := []string{
+		"cookie=0x200000002,priority=100,in_port=1,dl_vlan=2,actions=strip_vlan,set_tunnel:10,resubmit(,10)",
+		"cookie=0x200000002,priority=100,tun_id=10,actions=learn(table=10,cookie=0x200000002,hard_timeout=300,priority=100," +
+			"NXM_NX_TUN_ID[],NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[],output:NXM_OF_IN_PORT[]),mod_vlan_vid:2,output:1",
+		"table=10,cookie=0x200000002,priority=50,tun_id=10,actions=FLOOD",
+	}
+	if flows := tunnelFlows(2, 10); !reflect.DeepEqual(flows, expected) {
+		t.Fatalf("Unexpected flows %v", flows)
+	}
+	if flowCookie(gatewayCookie, 2) == flowCookie(tunnelCookie, 2) {
+		t.Fatal("The gateway and tunnel flows of a tag should have distinct cookies")
+	}
+}
+
+func TestLegacyTunnelFlows(t *testing.T) {
+	expected := []string{
+		"cookie=0x200000002,priority=100,in_port=1,dl_vlan=2,actions=mod_vlan_vid:7,set_tunnel:0,resubmit(,10)",
+		"cookie=0x200000002,priority=100,tun_id=0,dl_vlan=7,actions=learn(table=10,cookie=0x200000002,hard_timeout=300,priority=100," +
+			"NXM_NX_TUN_ID[],NXM_OF_VLAN_TCI[0..11],NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[],output:NXM_OF_IN_PORT[]),mod_vlan_vid:2,output:1",
+		"table=10,cookie=0x200000002,priority=50,tun_id=0,dl_vlan=7,actions=FLOOD",
+	}
+	if flows := legacyTunnelFlows(2, 7); !reflect.DeepEqual(flows, expected) {
+		t.Fatalf("Unexpected flows %v", flows)
+	}
+	networks := map[string]*Network{
+		"tun_id=0,dl_vlan=7": {ID: "legacy", Vlan: 7},
+		"tun_id=7":           {ID: "migrated", Vlan: 7, VNI: 7},
+		"tun_id=8":           {ID: "new", VNI: 8},
+	}
+	for match, network := range networks {
+		if segmentMatch(network) != match {
+			t.Errorf("Network %s should match %s, got %s", network.ID, match, segmentMatch(network))
+		}
+	}
+}
+
+func TestBridgePorts(t *testing.T) {
+	ports, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUuid: "p1"}, {GoUuid: "p2"}})
+	defer withOvsCache(map[string]map[string]libovsdb.Row{
+		"Bridge": {
+			"b1": {Fields: map[string]interface{}{"name": defaultBridgeName, "ports": *ports}},
+			"b2": {Fields: map[string]interface{}{"name": tunnelBridgeName, "ports": libovsdb.UUID{GoUuid: "p3"}}},
+		},
+		"Port": {
+			"p1": {Fields: map[string]interface{}{"name": defaultBridgeName}},
+			"p2": {Fields: map[string]interface{}{"name": "vxlan-10.0.0.2"}},
+			"p3": {Fields: map[string]interface{}{"name": tunnelBridgeName}},
+		},
+	})()
+
+	if ports := bridgePorts(defaultBridgeName); !reflect.DeepEqual(ports, []string{defaultBridgeName, "vxlan-10.0.0.2"}) {
+		t.Fatalf("Unexpected ports of %s : %v", defaultBridgeName, ports)
+	}
+	if ports := bridgePorts(tunnelBridgeName); !reflect.DeepEqual(ports, []string{tunnelBridgeName}) {
+		t.Fatalf("Unexpected ports of %s : %v", tunnelBridgeName, ports)
+	}
+	if ports := bridgePorts("missing"); len(ports) != 0 {
+		t.Fatalf("Unexpected ports %v", ports)
+	}
+}
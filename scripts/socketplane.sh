@@ -17,8 +17,10 @@ COMMANDS:
     help
             Help and usage
 
-    install [unattended] [nopowerstrip]
-            Install SocketPlane (installs docker and openvswitch)
+    install [unattended] [powerstrip]
+            Install SocketPlane (installs docker and openvswitch). Containers
+            are attached as they start, or through the Powerstrip adapter
+            with powerstrip
 
     uninstall
             Remove Socketplane installation
@@ -35,8 +37,8 @@ COMMANDS:
     info [container_id]
             Show SocketPlane info for all containers, or for a given container_id
 
-    run [-n foo] <docker_run_args>
-            Run a container and optionally specify which network to attach to
+    run [-n foo] [-i ip] <docker_run_args>
+            Run a container and optionally specify which network to attach to and its address
 
     start <container_id>
             Start a <container_id>
@@ -53,11 +55,22 @@ COMMANDS:
     cluster bind <interface>
             Bind clustering to a specific interface
 
-    cluster join <address>
-            Join the cluster at the specified address
+    cluster join <address> [--tunnel vxlan|gre|geneve] [--dst-port port]
+                           [--ttl ttl] [--df true|false]
+            Join the cluster at the specified address. The tunnel options
+            override the tunnel options of the daemon for this peer.
 
-    cluster leave
-            Leave the cluster
+    cluster info
+            Display the cluster bind interface, bootstrap status and members
+
+    cluster members
+            List the cluster members and the health of their tunnels
+
+    cluster reachability
+            Display the latency and loss of the probes of every peer
+
+    cluster leave [--force]
+            Leave the cluster. --force detaches any connected containers
 
     network list
             List all created networks
@@ -65,8 +78,17 @@ COMMANDS:
     network info <name>
             Display information about a given network
 
-    network create <name> [cidr]
-            Create a network
+    network allocations <name>
+            Display the addresses allocated in a network and their owners
+
+    network create <name> [cidr] [--ipv6 cidr] [--distributed] [--prefix length]
+                   [--pool start-end] [--pool6 start-end] [--exclude range]
+            Create a network. Without a cidr, a subnet of the given prefix
+            length is allocated from the subnet pool of the daemon.
+            With --distributed every host routes the traffic of its containers.
+            --pool restricts the allocated addresses to a range of the subnet.
+            --exclude, which may be repeated, never allocates an address,
+            a start-end range or a cidr
 
     network delete <name> [cidr]
             Delete a network
@@ -252,7 +274,7 @@ start_socketplane() {
     flags="--iface=auto"
 
     bstrap=manual
-    ps=yes
+    ps=no
 
     while true; do
 	args=$@
@@ -264,6 +286,9 @@ start_socketplane() {
 	    unattended )
 		bstrap=auto
 		;;
+	    powerstrip )
+		ps=yes
+		;;
 	    nopowerstrip )
 		ps=no
 		;;
@@ -303,11 +328,26 @@ start_socketplane() {
     if [ ! -f /etc/socketplane/socketplane.toml ]; then
         mkdir -p /etc/socketplane
         cp $PWD/socketplane.toml /etc/socketplane/socketplane.toml
+        if [ "$ps" != "yes" ]; then
+            # The Docker events and the network driver plugin are off by default
+            sed -i -e 's/^events = false/events = true/' \
+                -e 's|^plugin = ""|plugin = "/run/docker/plugins/socketplane.sock"|' \
+                /etc/socketplane/socketplane.toml
+        fi
+    fi
+    if [ "$ps" = "yes" ]; then
+        # Powerstrip attaches the containers in place of the Docker events
+        sed -i 's/^events = true/events = false/' /etc/socketplane/socketplane.toml
     fi
 
+    # The named network namespaces of ip netns can be connected
+    mkdir -p /var/run/netns
     cid=$(docker run --name socketplane -itd --privileged=true \
         -v /etc/socketplane/socketplane.toml:/etc/socketplane/socketplane.toml \
 	-v /var/run/docker.sock:/var/run/docker.sock \
+	-v /var/run/netns:/var/run/netns:rslave \
+	-v /run/docker/plugins:/run/docker/plugins \
+	-v /var/run/openvswitch:/var/run/openvswitch \
 	-v /usr/bin/docker:/usr/bin/docker -v /proc:/hostproc -e PROCFS=/hostproc \
 	--net=host socketplane/socketplane socketplane $flags)
 
@@ -435,22 +475,36 @@ container_run() {
         network=$2
         shift 2
     fi
+    ip=""
+    if [ $1 = '-i' ]; then
+        ip=$2
+        shift 2
+    fi
 
     attach="false"
     if [ -z "$(echo "$@" | grep -e '-[a-zA-Z]*d[a-zA-Z]*\s')" ]; then
         attach="true"
     fi
 
+    # The daemon attaches the container on its start event if it watches them
+    env=""
+    if [ -n "$network" ]; then
+        env="$env -e SP_NETWORK=$network"
+    fi
+    if [ -n "$ip" ]; then
+        env="$env -e SP_IP=$ip"
+    fi
+
     if [ "$attach" = "false" ]; then
-         cid=$(docker run --net=none $@)
+         cid=$(docker run --net=none $env $@)
     else
-         cid=$(docker run --net=none -d $@)
+         cid=$(docker run --net=none $env -d $@)
     fi
 
     cPid=$(docker inspect --format='{{ .State.Pid }}' $cid)
     cName=$(docker inspect --format='{{ .Name }}' $cid)
 
-    json=$(curl -s -X POST http://localhost:6675/v0.1/connections -d "{ \"container_id\": \"$cid\", \"container_name\": \"$cName\", \"container_pid\": \"$cPid\", \"network\": \"$network\" }")
+    json=$(curl -s -X POST http://localhost:6675/v0.1/connections -d "{ \"container_id\": \"$cid\", \"container_name\": \"$cName\", \"container_pid\": \"$cPid\", \"network\": \"$network\", \"requested_ip\": \"$ip\" }")
     result=$(echo $json | sed 's/[,{}]/\n/g' | sed 's/^".*":"\(.*\)"/\1/g' | awk -v RS="" '{ print $7, $8, $9, $10, $11 }')
 
     if [ "$attach" = "false" ]; then
@@ -495,13 +549,53 @@ cluster_bind() {
 }
 
 cluster_join(){
-    log_info "Requesting SocketPlane to join the cluster at $1"
-    curl -s -X POST http://localhost:6675/v0.1/cluster/join?address=$1
+    address=$1
+    query="address=$address"
+    shift
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --tunnel)
+                query="$query&tunnel=$2"
+                ;;
+            --dst-port)
+                query="$query&dst_port=$2"
+                ;;
+            --ttl)
+                query="$query&ttl=$2"
+                ;;
+            --df)
+                query="$query&df_default=$2"
+                ;;
+            *)
+                log_fatal "Unknown option $1"
+                exit 1
+                ;;
+        esac
+        shift 2
+    done
+    log_info "Requesting SocketPlane to join the cluster at $address"
+    curl -s -X POST "http://localhost:6675/v0.1/cluster/join?$query"
+}
+
+cluster_info(){
+    curl -s -X GET http://localhost:6675/v0.1/cluster | python -m json.tool
+}
+
+cluster_members(){
+    curl -s -X GET http://localhost:6675/v0.1/cluster/members | python -m json.tool
+}
+
+cluster_reachability(){
+    curl -s -X GET http://localhost:6675/v0.1/cluster/reachability | python -m json.tool
 }
 
 cluster_leave(){
     log_info "Requesting SocketPlane to leave cluster"
-    curl -s -X POST http://localhost:6675/v0.1/cluster/leave
+    if [ "$1" = "--force" ]; then
+        curl -s -X POST http://localhost:6675/v0.1/cluster/leave?force=true
+    else
+        curl -s -X POST http://localhost:6675/v0.1/cluster/leave
+    fi
 }
 
 network_list() {
@@ -512,11 +606,56 @@ network_info() {
     curl -s -X GET http://localhost:6675/v0.1/networks/$1| python -m json.tool
 }
 
+network_allocations() {
+    curl -s -X GET http://localhost:6675/v0.1/networks/$1/allocations | python -m json.tool
+}
+
 network_create() #name
                  #cidr
 {
     #ToDo: Check CIDR is valid
-    curl -s -X POST http://localhost:6675/v0.1/networks -d "{ \"id\": \"$1\", \"subnet\": \"$2\" }" | python -m json.tool
+    name=$1
+    shift
+    subnet=""
+    if [ $# -gt 0 ] && [ "${1#--}" = "$1" ]; then
+        subnet=$1
+        shift
+    fi
+    mode=""
+    subnet6=""
+    pool=""
+    pool6=""
+    exclude=""
+    prefix=0
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --distributed)
+                mode="distributed"
+                ;;
+            --ipv6)
+                subnet6=$2
+                shift
+                ;;
+            --prefix)
+                prefix=$2
+                shift
+                ;;
+            --pool)
+                pool=$2
+                shift
+                ;;
+            --pool6)
+                pool6=$2
+                shift
+                ;;
+            --exclude)
+                exclude="$exclude${exclude:+, }\"$2\""
+                shift
+                ;;
+        esac
+        shift
+    done
+    curl -s -X POST http://localhost:6675/v0.1/networks -d "{ \"id\": \"$name\", \"subnet\": \"$subnet\", \"subnet6\": \"$subnet6\", \"gateway_mode\": \"$mode\", \"pool\": \"$pool\", \"pool6\": \"$pool6\", \"exclude\": [ $exclude ], \"prefix_length\": $prefix }" | python -m json.tool
 
 }
 
@@ -657,8 +796,18 @@ case "$1" in
 		shift
 		cluster_join $@
 		;;
+            info)
+		cluster_info
+		;;
+            members)
+		cluster_members
+		;;
+            reachability)
+		cluster_reachability
+		;;
             leave)
-	    	cluster_leave
+	    	shift
+	    	cluster_leave $@
 		;;
 	    *)
                 log_fatal "Unknown Command"
@@ -676,6 +825,10 @@ case "$1" in
                 shift
                 network_info $@
                 ;;
+            allocations)
+                shift
+                network_allocations $@
+                ;;
             create)
                 shift
                 network_create $@